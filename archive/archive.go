@@ -0,0 +1,218 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archive implements the portable archive format used by hopdump
+// and hoprestore, and the functions that dump and restore a Hop through
+// its client interface.
+//
+// An archive starts with a header:
+//
+//	magic[8] time[8] basetime[8]
+//
+// basetime is the time of the archive an incremental dump was based on,
+// zero for full dumps. The header is followed by records:
+//
+//	type[1] key[s] version[8] flags[s] value[n] crc32[4]
+//
+// The checksum (IEEE) covers the record bytes that precede it. The
+// archive ends with a record of type End, whose version field contains the
+// number of records before it.
+//
+// The Entry records contain the whole entry. Incremental dumps contain
+// Entry records only for the keys whose version changed, Unchanged
+// records (without flags and value) for the other keys, and Removed
+// records for the keys that don't exist anymore. Because each archive
+// lists all keys with their versions, the next incremental dump needs only
+// the previous archive.
+package archive
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"hop"
+	"io"
+	"time"
+)
+
+const (
+	Entry     = 'E'
+	Unchanged = 'U'
+	Removed   = 'R'
+	End       = 'Z'
+)
+
+const magic = "hoparch1"
+
+var Eformat = errors.New("invalid archive")
+var Echecksum = errors.New("archive checksum mismatch")
+var Etruncated = errors.New("archive truncated")
+
+type Record struct {
+	Type    byte
+	Key     string
+	Version uint64
+	Flags   string
+	Value   []byte
+}
+
+type Writer struct {
+	w     *bufio.Writer
+	count uint64
+}
+
+type Reader struct {
+	r        *bufio.Reader
+	count    uint64
+	end      bool
+	Time     time.Time
+	BaseTime time.Time // zero for full dumps
+}
+
+func NewWriter(w io.Writer, t, base time.Time) (*Writer, error) {
+	aw := &Writer{w: bufio.NewWriter(w)}
+	buf := make([]byte, len(magic)+16)
+	copy(buf, magic)
+	p := hop.Pint64(uint64(t.UnixNano()), buf[len(magic):])
+	if base.IsZero() {
+		hop.Pint64(0, p)
+	} else {
+		hop.Pint64(uint64(base.UnixNano()), p)
+	}
+
+	if _, err := aw.w.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return aw, nil
+}
+
+func (w *Writer) Write(r *Record) error {
+	w.count++
+	return w.write(r)
+}
+
+func (w *Writer) write(r *Record) error {
+	if len(r.Key) > 0xFFFF || len(r.Flags) > 0xFFFF {
+		return Eformat
+	}
+
+	buf := make([]byte, 1+2+len(r.Key)+8+2+len(r.Flags)+4+len(r.Value)+4)
+	buf[0] = r.Type
+	p := hop.Pstr(r.Key, buf[1:])
+	p = hop.Pint64(r.Version, p)
+	p = hop.Pstr(r.Flags, p)
+	p = hop.Pblob(r.Value, p)
+	hop.Pint32(crc32.ChecksumIEEE(buf[0:len(buf)-4]), p)
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// Writes the End record and flushes the archive
+func (w *Writer) Close() error {
+	if err := w.write(&Record{Type: End, Version: w.count}); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	ar := &Reader{r: bufio.NewReader(r)}
+	buf := make([]byte, len(magic)+16)
+	if _, err := io.ReadFull(ar.r, buf); err != nil {
+		return nil, Eformat
+	}
+
+	if string(buf[0:len(magic)]) != magic {
+		return nil, Eformat
+	}
+
+	t, p := hop.Gint64(buf[len(magic):])
+	base, _ := hop.Gint64(p)
+	ar.Time = time.Unix(0, int64(t))
+	if base != 0 {
+		ar.BaseTime = time.Unix(0, int64(base))
+	}
+
+	return ar, nil
+}
+
+// Returns the next record, or io.EOF after the End record
+func (r *Reader) Read() (rec *Record, err error) {
+	if r.end {
+		return nil, io.EOF
+	}
+
+	// type[1] key[s]
+	buf, err := r.readn(nil, 3)
+	if err != nil {
+		return
+	}
+
+	n, _ := hop.Gint16(buf[1:])
+	if buf, err = r.readn(buf, int(n)+8+2); err != nil {
+		return
+	}
+
+	// flags[s]
+	n, _ = hop.Gint16(buf[len(buf)-2:])
+	if buf, err = r.readn(buf, int(n)+4); err != nil {
+		return
+	}
+
+	// value[n] crc32[4]
+	vn, _ := hop.Gint32(buf[len(buf)-4:])
+	if vn == ^uint32(0) {
+		vn = 0
+	}
+
+	if buf, err = r.readn(buf, int(vn)+4); err != nil {
+		return
+	}
+
+	sum, _ := hop.Gint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(buf[0:len(buf)-4]) != sum {
+		return nil, Echecksum
+	}
+
+	rec = new(Record)
+	rec.Type = buf[0]
+	p := buf[1:]
+	rec.Key, p = hop.Gstr(p)
+	rec.Version, p = hop.Gint64(p)
+	rec.Flags, p = hop.Gstr(p)
+	rec.Value, p = hop.Gblob(p)
+	switch rec.Type {
+	default:
+		return nil, Eformat
+
+	case Entry, Unchanged, Removed:
+		r.count++
+
+	case End:
+		if rec.Version != r.count {
+			return nil, Etruncated
+		}
+
+		r.end = true
+		return nil, io.EOF
+	}
+
+	return
+}
+
+func (r *Reader) readn(buf []byte, n int) ([]byte, error) {
+	nbuf := make([]byte, len(buf)+n)
+	copy(nbuf, buf)
+	if _, err := io.ReadFull(r.r, nbuf[len(buf):]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = Etruncated
+		}
+
+		return nil, err
+	}
+
+	return nbuf, nil
+}
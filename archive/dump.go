@@ -0,0 +1,286 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"hop"
+	"hop/rmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type Stats struct {
+	Entries   int // Entry records
+	Unchanged int // Unchanged records
+	Removed   int // Removed records
+	Skipped   int // keys that disappeared during the dump
+	Errors    int // failed operations (restore)
+}
+
+// Reads the versions of all keys listed in a previous archive
+func ReadVersions(r *Reader) (vers map[string]uint64, err error) {
+	vers = make(map[string]uint64)
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if rec.Type != Removed {
+			vers[rec.Key] = rec.Version
+		}
+	}
+
+	return vers, nil
+}
+
+func prefixRegexp(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return ".*"
+	}
+
+	qs := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		qs[i] = regexp.QuoteMeta(p)
+	}
+
+	return "^(" + strings.Join(qs, "|") + ")"
+}
+
+func hasPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dumps the keys that start with one of the prefixes (all keys if there
+// are none). If prev is not nil, the dump is incremental and only the
+// entries whose version is different from the one in prev are written.
+// The entries are read by workers goroutines.
+func Dump(h hop.GetterHop, w *Writer, prefixes []string, prev map[string]uint64, workers int) (st *Stats, err error) {
+	ver, val, err := h.Get("#/keys:"+prefixRegexp(prefixes), hop.Any)
+	if err != nil {
+		return
+	}
+
+	var keys []string
+	if ver != 0 && len(val) > 0 {
+		for _, k := range bytes.Split(val, []byte{0}) {
+			key := string(k)
+			if !strings.HasPrefix(key, "#/") && hasPrefix(key, prefixes) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	st = new(Stats)
+	kchan := make(chan string, workers)
+	rchan := make(chan *Record, workers)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range kchan {
+				rec, e := dumpKey(h, key, prev)
+				if e != nil {
+					lock.Lock()
+					if err == nil {
+						err = fmt.Errorf("%s: %v", key, e)
+					}
+					lock.Unlock()
+					continue
+				}
+
+				rchan <- rec
+			}
+		}()
+	}
+
+	go func() {
+		for _, key := range keys {
+			kchan <- key
+		}
+
+		close(kchan)
+		wg.Wait()
+		close(rchan)
+	}()
+
+	var werr error
+	exist := make(map[string]bool)
+	for rec := range rchan {
+		switch {
+		case werr != nil:
+			continue
+		case rec.Type == Removed:
+			// removed before we got to it
+			st.Skipped++
+			continue
+		case rec.Type == Unchanged:
+			st.Unchanged++
+		default:
+			st.Entries++
+		}
+
+		exist[rec.Key] = true
+		werr = w.Write(rec)
+	}
+
+	if err == nil {
+		err = werr
+	}
+
+	if err != nil {
+		return
+	}
+
+	for key := range prev {
+		if !exist[key] && hasPrefix(key, prefixes) {
+			st.Removed++
+			if err = w.Write(&Record{Type: Removed, Key: key}); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func dumpKey(h hop.GetterHop, key string, prev map[string]uint64) (rec *Record, err error) {
+	if pver, ok := prev[key]; ok {
+		st, err := hop.GetStat(h, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if st != nil && st.Version == pver {
+			return &Record{Type: Unchanged, Key: key, Version: pver}, nil
+		}
+	}
+
+	ver, val, err := h.Get(key, hop.Any)
+	if err != nil {
+		return
+	}
+
+	if ver == 0 {
+		return &Record{Type: Removed, Key: key}, nil
+	}
+
+	f, err := hop.GetFlags(h, key)
+	if err != nil {
+		// the Hop doesn't support flags
+		f, err = new(hop.Flags), nil
+	}
+
+	return &Record{Type: Entry, Key: key, Version: ver, Flags: f.String(), Value: val}, nil
+}
+
+// Restores the records from the archive. The Entry records are created,
+// or set if the entry already exists and replace is true or the archive is
+// incremental. The versions of the restored entries are preserved if the
+// Hop implements VersionCreateHop and the entry doesn't exist.
+// The records are restored by workers goroutines, the errors are counted
+// and the first one is returned after all records are processed.
+func Restore(h hop.Hop, r *Reader, workers int, replace bool) (st *Stats, err error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	replace = replace || !r.BaseTime.IsZero()
+	st = new(Stats)
+	rchan := make(chan *Record, workers)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rec := range rchan {
+				e := restoreRecord(h, rec, replace)
+				lock.Lock()
+				if e != nil {
+					st.Errors++
+					if err == nil {
+						err = fmt.Errorf("%s: %v", rec.Key, e)
+					}
+				} else if rec.Type == Removed {
+					st.Removed++
+				} else {
+					st.Entries++
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	var rerr error
+	for {
+		var rec *Record
+
+		rec, rerr = r.Read()
+		if rerr != nil {
+			break
+		}
+
+		if rec.Type == Unchanged {
+			st.Unchanged++
+			continue
+		}
+
+		rchan <- rec
+	}
+
+	close(rchan)
+	wg.Wait()
+	if rerr != io.EOF {
+		err = rerr
+	}
+
+	return
+}
+
+func restoreRecord(h hop.Hop, rec *Record, replace bool) (err error) {
+	switch rec.Type {
+	case Removed:
+		err = h.Remove(rec.Key)
+		if rmt.IsError(err, hop.Enoent) {
+			err = nil
+		}
+
+	case Entry:
+		if vh, ok := h.(hop.VersionCreateHop); ok && rec.Version != 0 {
+			err = vh.CreateVersion(rec.Key, rec.Flags, rec.Version, rec.Value)
+		} else {
+			_, err = h.Create(rec.Key, rec.Flags, rec.Value)
+		}
+
+		if replace && rmt.IsError(err, hop.Eexist) {
+			_, err = h.Set(rec.Key, rec.Value)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,188 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"sync"
+)
+
+// Implemented by the Hops that can have multiple operations in flight
+// without a goroutine for each of them. The methods return immediately,
+// the results are available from the returned Future.
+type AsyncHop interface {
+	CreateAsync(key, flags string, value []byte) *Future
+	RemoveAsync(key string) *Future
+	GetAsync(key string, version uint64) *Future
+	SetAsync(key string, value []byte) *Future
+	TestSetAsync(key string, oldversion uint64, oldvalue, value []byte) *Future
+	AtomicAsync(key string, op uint16, values [][]byte) *Future
+}
+
+// The result of an asynchronous operation. The fields are valid after
+// the operation completes. Version is the version returned by the
+// operation, Value the value returned by Get and TestSet, and Vals the
+// values returned by Atomic.
+type Future struct {
+	Version uint64
+	Value   []byte
+	Vals    [][]byte
+	Err     error
+
+	lock      sync.Mutex
+	completed bool
+	done      chan struct{}
+	cbs       []func(f *Future)
+}
+
+func NewFuture() *Future {
+	f := new(Future)
+	f.done = make(chan struct{})
+	return f
+}
+
+// Returns a channel that is closed when the operation completes
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Waits for the operation to complete and returns its error
+func (f *Future) Wait() error {
+	<-f.done
+	return f.Err
+}
+
+// Returns true if the operation completed
+func (f *Future) Completed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.completed
+}
+
+// Calls cb when the operation completes, or immediately if it already
+// completed. The callbacks are called in the order they were added. They
+// may be called from the goroutine that receives the responses from the
+// server and shouldn't block.
+func (f *Future) Then(cb func(f *Future)) {
+	f.lock.Lock()
+	if !f.completed {
+		f.cbs = append(f.cbs, cb)
+		f.lock.Unlock()
+		return
+	}
+
+	f.lock.Unlock()
+	cb(f)
+}
+
+// Sets the result of the operation and calls the callbacks. Only the
+// first call has effect.
+func (f *Future) Complete(ver uint64, val []byte, vals [][]byte, err error) {
+	f.lock.Lock()
+	if f.completed {
+		f.lock.Unlock()
+		return
+	}
+
+	f.Version, f.Value, f.Vals, f.Err = ver, val, vals, err
+	f.completed = true
+	cbs := f.cbs
+	f.cbs = nil
+	close(f.done)
+	f.lock.Unlock()
+
+	for _, cb := range cbs {
+		cb(f)
+	}
+}
+
+// Runs the operation in a new goroutine and completes the returned Future
+// with its result. Used for the Hops that don't implement AsyncHop.
+func GoFuture(op func() (ver uint64, val []byte, vals [][]byte, err error)) *Future {
+	f := NewFuture()
+	go func() {
+		f.Complete(op())
+	}()
+
+	return f
+}
+
+// Waits for all futures to complete. Returns the first error.
+func WaitAll(fs ...*Future) (err error) {
+	for _, f := range fs {
+		if e := f.Wait(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// The following functions call the asynchronous method if the Hop
+// implements AsyncHop, otherwise run the synchronous one in a goroutine.
+
+func CreateAsync(h CreatorHop, key, flags string, value []byte) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.CreateAsync(key, flags, value)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		ver, err := h.Create(key, flags, value)
+		return ver, nil, nil, err
+	})
+}
+
+func RemoveAsync(h CreatorHop, key string) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.RemoveAsync(key)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		return 0, nil, nil, h.Remove(key)
+	})
+}
+
+func GetAsync(h GetterHop, key string, version uint64) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.GetAsync(key, version)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		ver, val, err := h.Get(key, version)
+		return ver, val, nil, err
+	})
+}
+
+func SetAsync(h SetterHop, key string, value []byte) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.SetAsync(key, value)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		ver, err := h.Set(key, value)
+		return ver, nil, nil, err
+	})
+}
+
+func TestSetAsync(h TestSetterHop, key string, oldversion uint64, oldvalue, value []byte) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.TestSetAsync(key, oldversion, oldvalue, value)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		ver, val, err := h.TestSet(key, oldversion, oldvalue, value)
+		return ver, val, nil, err
+	})
+}
+
+func AtomicAsync(h AtomicHop, key string, op uint16, values [][]byte) *Future {
+	if ah, ok := h.(AsyncHop); ok {
+		return ah.AtomicAsync(key, op, values)
+	}
+
+	return GoFuture(func() (uint64, []byte, [][]byte, error) {
+		ver, vals, err := h.Atomic(key, op, values)
+		return ver, nil, vals, err
+	})
+}
@@ -62,7 +62,13 @@ var chopaddr = flag.String("chopaddr", "", "address for the CHop instance")
 var chopmaddr = flag.String("chopmaddr", "", "master of the CHop group")
 var chopmem = flag.Uint64("chopmem", 16*1024*1024, "maximum memory used for cache in CHop")
 var chopelem = flag.Int("chopelem", 1024, "maximum number of elements in the cache in CHop")
+var choppolicy = flag.String("choppolicy", "lru", "CHop eviction policy (lru | lfu | arc | tinylfu)")
 var chopdomain = flag.String("chopdomain", "", "CHop consistency domain")
+var chopdpolicy = flag.String("chopdpolicy", "strong", "CHop consistency domain policy (strong | local)")
+var chopdirty = flag.Uint64("chopdirty", 0, "maximum size of dirty values in CHop (write-through if zero)")
+var chopflush = flag.Duration("chopflush", time.Second, "flush interval for CHop write-back")
+var chopmaxage = flag.Duration("chopmaxage", 0, "maximum age of the values cached in CHop (unlimited if zero)")
+var chopreval = flag.Duration("chopreval", 0, "CHop serves values up to chopmaxage+chopreval old while revalidating them")
 
 // KCHop flags
 var kcdbname = flag.String("kcdb", "", "Kyoto Cabinet database name")
@@ -301,7 +307,7 @@ func main() {
 		s.SetDebugLevel(*debug)
 
 	case "d2hop":
-		s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, hops)
+		s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, hops, nil)
 		if err != nil {
 			fmt.Printf("Can't create D2Hop instance: %v\n", err)
 			return
@@ -322,13 +328,31 @@ func main() {
 	if *chopaddr != "" {
 		var err error
 
-		chophop, err = chop.NewCache(hoph, *chopmem, *chopelem, *proto, *chopaddr, *chopmaddr)
+		chophop, err = chop.NewCache(hoph, *chopmem, *chopelem, *choppolicy)
 		if err != nil {
 			fmt.Printf("Can't create CHop instance: %v\n", err)
 			return
 		}
 
+		if *chopmaxage != 0 {
+			chophop.SetMaxAge("", *chopmaxage, *chopreval)
+		}
+
+		if *chopdirty != 0 {
+			chophop.SetWriteBack(*chopflush, *chopdirty)
+		}
+
 		if *chopdomain != "" {
+			_, err = chophop.JoinDomain(*chopdomain, *proto, *chopaddr, *chopmaddr)
+			if err == nil {
+				err = chophop.SetDomainPolicy(*chopdomain, *chopdpolicy)
+			}
+
+			if err != nil {
+				fmt.Printf("Can't join CHop domain: %v\n", err)
+				return
+			}
+
 			keyprefix = "#/cache/" + *chopdomain + "/"
 		}
 		hopc = chophop
@@ -389,6 +413,10 @@ func main() {
 
 
 	if chophop != nil {
+		if err := chophop.Flush(); err != nil {
+			fmt.Printf("CHop flush error: %v\n", err)
+		}
+
 		fmt.Printf("%s", chophop.Stats())
 	}
 
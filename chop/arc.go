@@ -0,0 +1,147 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// Adaptive Replacement Cache (Megiddo & Modha). The cached entries are
+// split between t1 (seen once recently) and t2 (seen at least twice).
+// The ghost lists b1 and b2 remember the keys recently evicted from t1
+// and t2, and a miss on a ghost key adapts the target size of t1, so the
+// cache resists scans that would flush a plain LRU.
+type arcPolicy struct {
+	c      int // capacity, in entries
+	p      int // target size of t1
+	t1, t2 clist
+	b1, b2 ghostList
+}
+
+// List of keys of evicted entries, the most recent first
+type ghostList struct {
+	l    list.List
+	keys map[string]*list.Element
+}
+
+func newARC(maxelem int) Policy {
+	p := new(arcPolicy)
+	p.c = maxelem
+	if p.c < 1 {
+		p.c = 1
+	}
+
+	p.b1.keys = make(map[string]*list.Element)
+	p.b2.keys = make(map[string]*list.Element)
+
+	return p
+}
+
+func (p *arcPolicy) Name() string { return "arc" }
+
+func (p *arcPolicy) Insert(e *CEntry) {
+	switch {
+	case p.b1.remove(e.key):
+		// recently evicted from t1, t1 should be larger
+		d := 1
+		if p.b1.len() > 0 && p.b2.len() > p.b1.len() {
+			d = p.b2.len() / p.b1.len()
+		}
+
+		p.p += d
+		if p.p > p.c {
+			p.p = p.c
+		}
+
+		p.t2.push(e)
+
+	case p.b2.remove(e.key):
+		// recently evicted from t2, t2 should be larger
+		d := 1
+		if p.b2.len() > 0 && p.b1.len() > p.b2.len() {
+			d = p.b1.len() / p.b2.len()
+		}
+
+		p.p -= d
+		if p.p < 0 {
+			p.p = 0
+		}
+
+		p.t2.push(e)
+
+	default:
+		p.t1.push(e)
+	}
+
+	// keep the ghost lists within the limits
+	if p.t1.n+p.b1.len() > p.c {
+		p.b1.pop()
+	}
+
+	if p.t1.n+p.t2.n+p.b1.len()+p.b2.len() > 2*p.c {
+		p.b2.pop()
+	}
+}
+
+func (p *arcPolicy) Access(e *CEntry) {
+	e.list.remove(e)
+	p.t2.push(e)
+}
+
+func (p *arcPolicy) Remove(e *CEntry) {
+	e.list.remove(e)
+}
+
+func (p *arcPolicy) Victim() (e *CEntry) {
+	if p.t1.n > 0 && (p.t1.n > p.p || p.t2.n == 0) {
+		e = p.t1.pop()
+		p.b1.push(e.key)
+	} else if p.t2.n > 0 {
+		e = p.t2.pop()
+		p.b2.push(e.key)
+	}
+
+	return
+}
+
+func (p *arcPolicy) Stats() string {
+	ret := fmt.Sprintf("ARC Target T1: %d\n", p.p)
+	ret += fmt.Sprintf("ARC T1/T2: %d/%d\n", p.t1.n, p.t2.n)
+	ret += fmt.Sprintf("ARC B1/B2: %d/%d\n", p.b1.len(), p.b2.len())
+
+	return ret
+}
+
+func (g *ghostList) len() int {
+	return g.l.Len()
+}
+
+func (g *ghostList) push(key string) {
+	if el := g.keys[key]; el != nil {
+		g.l.MoveToFront(el)
+		return
+	}
+
+	g.keys[key] = g.l.PushFront(key)
+}
+
+func (g *ghostList) pop() {
+	if el := g.l.Back(); el != nil {
+		delete(g.keys, el.Value.(string))
+		g.l.Remove(el)
+	}
+}
+
+func (g *ghostList) remove(key string) bool {
+	el := g.keys[key]
+	if el == nil {
+		return false
+	}
+
+	delete(g.keys, key)
+	g.l.Remove(el)
+	return true
+}
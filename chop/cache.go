@@ -5,13 +5,14 @@
 package chop
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"hop"
-	"hop/d2hop"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 type CHop struct {
@@ -21,316 +22,533 @@ type CHop struct {
 	maxelem	int		// maximum number of elements that cache is allowed to have
 
 	entries	map[string]*CEntry
-	lru	*CEntry		// least recently used entry
-	mru	*CEntry		// most recently used entry
+	policy	Policy		// eviction policy
 	memsz	uint64		// currently used memory (approximation)
 
-	dhop	*d2hop.D2Hop
+	domains	map[string]*Domain	// consistency domains the cache is member of
+	dgen	uint64			// incremented when domains are joined or left
+	dcond	*sync.Cond		// signaled when dgen changes
+
+	// leases
+	lease	time.Duration	// if not zero, the entries expire after that time
+	igen	uint64		// incremented on every invalidation
+	closed	bool
+	done	chan bool	// closed by Close
+
+	// write-back
+	maxdirty	uint64			// maximum size of dirty values (write-through if zero)
+	finterval	time.Duration		// flush interval
+	fchan		chan bool		// wakes up the flush goroutine
+	pending		map[string]*CEntry	// evicted dirty entries not flushed yet
+	flushing	map[string]int		// keys with flushes in flight
+	fcond		*sync.Cond		// signaled when a flush completes
+	ferrs		map[string]error	// errors from deferred flushes
+	ndirty		int
+	dirtysz		uint64
+
+	// bounded staleness
+	ages	[]maxAge	// maximum age per key prefix, the longest prefix first
+
+	// per-key flags
+	kflags	map[string]*hop.Flags
+	flookup	bool		// read the flags of the keys not created by us
 
 	// stats
 	hits	uint64
-	drops	uint64
-	dsent	uint64		// sent to a domain
-	drecv	uint64		// received for a domain
+	misses	uint64
+	drops	uint64		// evicted by the policy
+	rejects	uint64		// not admitted by the policy
+	invals	uint64		// invalidations received
+	expired	uint64		// entries dropped because their lease expired
+	coalesced	uint64	// Sets of already dirty entries
+	flushes		uint64
+	flusherrs	uint64
+	staleserved	uint64	// older than the maximum age, served while revalidating
+	refreshed	uint64	// older than the maximum age, read from the Hop
+	revalidated	uint64	// refreshed in the background
+	uncached	uint64	// values not cached because of the key's flags
+	stathits	uint64	// Stat calls answered from the cache
 }
 
 type CEntry struct {
 	key	string
 	version	uint64
 	value	[]byte
+	expire	time.Time	// when the lease expires
+	size	uint64		// memory used by the entry
+	fetched	time.Time	// when the value was read from (or written to) the Hop
+	refreshing	bool	// being revalidated in the background
+	stat	*hop.Stat	// metadata, if Stat was called for the current version
+
+	// write-back
+	dirty	bool		// value not written to the Hop yet
+	dgen	uint32		// incremented on every Set of a dirty entry
+	cver	uint64		// last version committed to the Hop
+
+	// used by the eviction policy
+	list	*clist		// list the entry is in
 	lru	*CEntry		// less used entry
 	mru	*CEntry		// more used entry
+	freq	uint32
 }
 
 var Einval = errors.New("invalid cache entry")
 
-func NewCache(hop hop.Hop, maxmem uint64, maxelem int, proto, listenaddr, masteraddr string) (c *CHop, err error) {
+// Creates a new cache for the specified Hop. The policy is the name of the
+// eviction policy ("lru", "lfu", "arc" or "tinylfu"), if empty
+// DefaultPolicy is used.
+func NewCache(hop hop.Hop, maxmem uint64, maxelem int, policy string) (c *CHop, err error) {
 	c = new(CHop)
 	c.hop = hop
 	c.maxmem = maxmem
 	c.maxelem = maxelem
 	c.entries = make(map[string]*CEntry)
-
-	if proto != "" {
-		c.dhop, err = d2hop.NewD2Hop(proto, listenaddr, masteraddr, c)
-		if err != nil {
-			return nil, err
-		}
+	c.domains = make(map[string]*Domain)
+	c.dcond = sync.NewCond(c)
+	c.fcond = sync.NewCond(c)
+	c.done = make(chan bool)
+	c.policy, err = NewPolicy(policy, maxelem)
+	if err != nil {
+		return nil, err
 	}
 
 	return c, nil
 }
 
-func (c *CHop) getEntry(key string) (ver uint64, val []byte) {
+// Enables the lease protocol (see LeaseHop). The cached entries are used
+// only until their lease expires, and the invalidations sent by the server
+// drop the entries before that. If the invalidations can't be received,
+// the lease expiration still limits how stale the entries can be. The
+// lease shouldn't be longer than the one the server uses.
+func (c *CHop) SetLease(lease time.Duration) {
 	c.Lock()
-	e := c.entries[key]
-	if e != nil {
-		c.hits++
-		ver = e.version
-		val = e.value
+	start := c.lease == 0
+	c.lease = lease
+	c.Unlock()
 
-		// move the entry to the MRU spot
-		if e.lru != nil {
-			e.lru.mru = e.mru
-		} else {
-			c.lru = e.mru
-		}
+	if start && lease != 0 {
+		go c.leaseproc()
+	}
+}
 
-		if e.mru != nil {
-			e.mru.lru = e.lru
-		} else {
-			c.mru = e.lru
+// Receives the invalidations from the server
+func (c *CHop) leaseproc() {
+	version := uint64(hop.PastNewest)
+	for {
+		// don't wait for the pending Get after Close
+		f := hop.GetAsync(c.hop, "#/lease", version)
+		select {
+		case <-f.Done():
+		case <-c.done:
+			return
 		}
 
-		e.lru = c.mru
-		e.mru = nil
+		if f.Err != nil {
+			// the leases will expire, try again later
+			c.Lock()
+			lease := c.lease
+			c.Unlock()
+
+			version = hop.PastNewest
+			select {
+			case <-time.After(lease):
+			case <-c.done:
+				return
+			}
 
-		if c.mru != nil {
-			c.mru.mru = e
+			continue
 		}
 
-		c.mru = e
+		c.invalidate(f.Value)
+		version = f.Version + 1
+	}
+}
+
+// Drops the entries in the list of zero-separated key and version pairs
+func (c *CHop) invalidate(val []byte) {
+	if len(val) == 0 {
+		return
+	}
+
+	s := bytes.Split(val, []byte{0})
+	c.Lock()
+	for i := 0; i+1 < len(s); i += 2 {
+		key := string(s[i])
+		ver, _ := strconv.ParseUint(string(s[i+1]), 10, 64)
+		c.igen++
+		c.invals++
+		if e := c.entries[key]; e != nil && !e.dirty && (ver == 0 || e.version < ver) {
+			c.remove(e)
+		}
 	}
 	c.Unlock()
-	return
 }
 
-func (c *CHop) updateEntry(key string, ver uint64, val []byte) {
+// Flushes the dirty entries and stops the lease and flush processing
+func (c *CHop) Close() {
+	c.Flush()
 	c.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		c.dcond.Broadcast()
+	}
+	c.Unlock()
+}
 
-	n := 1					// new entry
-	sz := uint64(len(key) + len(val))	// approximate size
+// Returns the cached value of the key. If the entry is older than maxage
+// and younger than maxage + revalidate, it is still returned, but stale is
+// set to indicate that it needs to be revalidated.
+func (c *CHop) getEntry(key string, maxage, revalidate time.Duration) (ver uint64, val []byte, stale bool) {
+	c.Lock()
 	e := c.entries[key]
-	if e != nil {
-		c.memsz -= uint64(len(key) + len(e.value))
-		n = 0
+	pending := false
+	if e == nil {
+		// evicted, but not written yet
+		e = c.pending[key]
+		pending = e != nil
+	}
+
+	if e != nil && !e.dirty && c.lease != 0 && time.Now().After(e.expire) {
+		c.remove(e)
+		c.expired++
+		e = nil
+	}
 
-		c.lruremove(e)
+	if e != nil && !e.dirty && maxage != 0 {
+		age := time.Since(e.fetched)
+		if age > maxage+revalidate {
+			c.refreshed++
+			e = nil
+		} else if age > maxage {
+			c.staleserved++
+			stale = !e.refreshing && !pending
+			e.refreshing = true
+		}
 	}
 
-	// remove an entry if we are over the element number limit
-	if len(c.entries) + n > c.maxelem {
-		c.removeLRU()
+	if e != nil {
+		c.hits++
+		ver = e.version
+		val = e.value
+		if !pending {
+			c.policy.Access(e)
+		}
+	} else {
+		c.misses++
 	}
+	c.Unlock()
+	return
+}
+
+// Returns the values that need to be passed to updateEntry for the
+// operations started now
+func (c *CHop) start() (t time.Time, igen uint64) {
+	c.Lock()
+	t = time.Now()
+	igen = c.igen
+	c.Unlock()
 
-	// remove entries if we are over the memory size limit
-	for c.memsz + sz > c.maxmem {
-		c.removeLRU()
+	return
+}
+
+// Updates the entry with the result of an operation started at time t.
+// If there were invalidations since the operation started, the value
+// might already be stale and it is not cached.
+func (c *CHop) updateEntry(key string, ver uint64, val []byte, t time.Time, igen uint64) {
+	if !c.cacheable(key) {
+		c.removeEntry(key)
+		return
 	}
 
-	if e == nil {
+	c.Lock()
+	if c.igen != igen {
+		if e := c.entries[key]; e != nil && !e.dirty {
+			c.remove(e)
+		}
+
+		c.Unlock()
+		return
+	}
+
+	e := c.entries[key]
+	if e != nil && e.dirty {
+		// the local value is newer
+		c.Unlock()
+		return
+	} else if e != nil {
+		c.memsz -= e.size
+		c.policy.Access(e)
+	} else {
 		e = new(CEntry)
 		e.key = key
 		c.entries[key] = e
+		c.policy.Insert(e)
 	}
 
 	e.version = ver
 	e.value = val
-
-	// put as MRU
-	e.lru = c.mru
-	if c.mru != nil {
-		c.mru.mru = e
-	}
-
-	if c.lru == nil {
-		c.lru = e
+	e.expire = t.Add(c.lease)
+	e.fetched = t
+	e.cver = ver
+	e.size = entrySize(key, val)
+	c.memsz += e.size
+
+	// evict entries while we are over the limits, the policy
+	// may decide not to keep the new entry
+	for len(c.entries) > c.maxelem || c.memsz > c.maxmem {
+		if !c.evict(e) {
+			break
+		}
 	}
 
-	c.mru = e
-	c.memsz += sz
+	flush := len(c.pending) > 0
 	c.Unlock()
+
+	if flush {
+		c.kickFlush()
+	}
 }
 
 func (c *CHop) removeEntry(key string) {
 	c.Lock()
 	e := c.entries[key]
 	if e != nil {
-		delete(c.entries, key)
-		c.lruremove(e)
-		c.memsz -= uint64(len(e.key) + len(e.value))
+		c.remove(e)
+	}
+
+	if e = c.pending[key]; e != nil {
+		// the dirty value is obsolete
+		delete(c.pending, key)
+		c.clean(e)
 	}
 	c.Unlock()
 }
 
 // called with c lock held
-func (c *CHop) removeLRU() {
-	le := c.lru
-	if le == nil {
-		fmt.Printf("LRU empty but %d/%d entries %d/%d mem\n", len(c.entries), c.maxelem, c.memsz, c.maxmem)
-		return
-	}
+func (c *CHop) remove(e *CEntry) {
+	delete(c.entries, e.key)
+	c.policy.Remove(e)
+	c.memsz -= e.size
+	c.clean(e)
+}
 
-	delete(c.entries, le.key)
-	if le.mru != nil {
-		le.mru.lru = nil
+// Removes the entry selected by the policy. Returns false if there are
+// no entries to remove.
+// called with c lock held
+func (c *CHop) evict(ne *CEntry) bool {
+	e := c.policy.Victim()
+	if e == nil {
+		fmt.Printf("%s policy empty but %d/%d entries %d/%d mem\n", c.policy.Name(), len(c.entries), c.maxelem, c.memsz, c.maxmem)
+		return false
 	}
 
-	c.lru = le.mru
-	if c.mru == le {
-		c.mru = nil
-	}
+	delete(c.entries, e.key)
+	c.memsz -= e.size
+	if e.dirty {
+		// keep it until it is written to the Hop
+		if c.pending == nil {
+			c.pending = make(map[string]*CEntry)
+		}
 
-	c.memsz -= uint64(len(le.key) + len(le.value))
-	le.lru = nil
-	le.mru = nil
-	c.drops++
-}
+		if pe := c.pending[e.key]; pe != nil {
+			c.clean(pe)
+		}
 
-// removes an entry from the LRU
-// called with c lock held
-func (c *CHop) lruremove(e *CEntry) {
-	if e.lru != nil {
-		e.lru.mru = e.mru
-	} else {
-		c.lru = e.mru
+		c.pending[e.key] = e
 	}
 
-	if e.mru != nil {
-		e.mru.lru = e.lru
+	if e == ne {
+		c.rejects++
 	} else {
-		c.mru = e.lru
+		c.drops++
 	}
 
-	e.lru = nil
-	e.mru = nil
+	return true
 }
 
 func (c *CHop) Create(key, flags string, value []byte) (ver uint64, err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.Create(key, flags, value)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return 0, Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return 0, err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.Create(dkey, flags, value)
+	}
+
+	f, err := hop.ParseFlags(flags)
+	if err != nil {
+		return 0, err
 	}
 
+	c.flushKey(key)
+	t, igen := c.start()
 	ver, err = c.hop.Create(key, flags, value)
 	if err == nil && ver != 0 {
-		c.updateEntry(key, ver, value)
+		// the caller's value may be reused (e.g. a released message)
+		c.setFlags(key, f)
+		c.updateEntry(key, ver, append([]byte{}, value...), t, igen)
 	}
 
 	return
 }
 
 func (c *CHop) Remove(key string) (err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.Remove(key)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.Remove(dkey)
 	}
 
 	err = c.hop.Remove(key)
 	if err == nil {
 		c.removeEntry(key)
+		c.Lock()
+		delete(c.kflags, key)
+		c.Unlock()
 	}
 
 	return
 }
 
 func (c *CHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.Get(key, version)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return 0, nil, Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return 0, nil, err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.Get(dkey, version)
+	} else if key == "#/domains" || strings.HasPrefix(key, "#/domain/") {
+		return c.getDomainEntry(key, version)
 	}
 
-	ver, val = c.getEntry(key)
+	maxage, revalidate := c.maxAge(key)
+	return c.get(key, version, maxage, revalidate)
+}
+
+func (c *CHop) get(key string, version uint64, maxage, revalidate time.Duration) (ver uint64, val []byte, err error) {
+	ver, val, stale := c.getEntry(key, maxage, revalidate)
 	if ver != 0 && (version == hop.Any || ver > version) {
+		if stale {
+			go c.revalidate(key)
+		}
+
 		return
 	}
 
+	c.flushKey(key)
+	t, igen := c.start()
 	ver, val, err = c.hop.Get(key, version)
 	if err == nil && ver != 0 {
-		c.updateEntry(key, ver, val)
+		c.updateEntry(key, ver, val, t, igen)
+	}
+
+	return
+}
+
+// The metadata is answered from the cache if the entry is cached and fresh,
+// and Stat was already called for its current version.
+func (c *CHop) Stat(key string) (st *hop.Stat, err error) {
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return d.Stat(dkey)
+	}
+
+	c.flushKey(key)
+	maxage, _ := c.maxAge(key)
+	now := time.Now()
+	c.Lock()
+	e := c.entries[key]
+	if e != nil && e.stat != nil && e.stat.Version == e.version &&
+		(c.lease == 0 || now.Before(e.expire)) &&
+		(maxage == 0 || now.Sub(e.fetched) <= maxage) {
+		st = new(hop.Stat)
+		*st = *e.stat
+		c.stathits++
+	}
+	c.Unlock()
+
+	if st != nil {
+		return
+	}
+
+	st, err = hop.GetStat(c.hop, key)
+	if err == nil && st != nil {
+		c.Lock()
+		if e := c.entries[key]; e != nil && !e.dirty && e.version == st.Version {
+			e.stat = new(hop.Stat)
+			*e.stat = *st
+		}
+		c.Unlock()
 	}
 
 	return
 }
 
 func (c *CHop) Set(key string, value []byte) (ver uint64, err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.Set(key, value)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return 0, Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return 0, err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.Set(dkey, value)
 	}
 
+	if ver, ok := c.setDirty(key, value); ok {
+		return ver, nil
+	}
+
+	t, igen := c.start()
 	ver, err = c.hop.Set(key, value)
 	if err == nil && ver != 0 {
-		c.updateEntry(key, ver, value)
+		c.updateEntry(key, ver, append([]byte{}, value...), t, igen)
 	}
 
 	return
 }
 
 func (c *CHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.TestSet(key, oldversion, oldvalue, value)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return 0, nil, Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return 0, nil, err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.TestSet(dkey, oldversion, oldvalue, value)
 	}
 
+	c.flushKey(key)
+	t, igen := c.start()
 	ver, val, err = c.hop.TestSet(key, oldversion, oldvalue, value)
 	if err == nil && ver != 0 {
-		c.updateEntry(key, ver, val)
+		c.updateEntry(key, ver, val, t, igen)
 	}
 
 	return
 }
 
 func (c *CHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
-	if c.dhop!=nil && strings.HasPrefix(key, "#/cache/") {
-		key = "#/chop/" + key[8:]
-		atomic.AddUint64(&c.dsent, 1)
-		return c.dhop.Atomic(key, op, values)
-	} else if strings.HasPrefix(key, "#/chop/") {
-		key = key[7:]
-		if n := strings.Index(key, "/"); n >= 0 {
-			key = key[n+1:]
-		} else {
-			return 0, nil, Einval
+	if strings.HasPrefix(key, "#/cache/") {
+		d, dkey, err := c.domainKey(key)
+		if err != nil {
+			return 0, nil, err
 		}
-		atomic.AddUint64(&c.drecv, 1)
+
+		return d.Atomic(dkey, op, values)
 	}
 
+	c.flushKey(key)
+	t, igen := c.start()
 	ver, vals, err = c.hop.Atomic(key, op, values)
 	if err != nil || ver == 0 {
 		return
@@ -344,19 +562,36 @@ func (c *CHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals
 	// try to update the cached entry from the values returnes by known ops
 	switch op {
 	case hop.Add, hop.Sub, hop.BitSet, hop.BitClear, hop.Append, hop.Remove, hop.Replace:
-		c.updateEntry(key, ver, vals[0])
+		c.updateEntry(key, ver, vals[0], t, igen)
 	}
 
 	return
 }
 
 func (c *CHop) Stats() (ret string) {
+	c.Lock()
+	defer c.Unlock()
+
+	ret += fmt.Sprintf("Cache Policy: %s\n", c.policy.Name())
 	ret += fmt.Sprintf("Cache Elements: %d\n", len(c.entries))
 	ret += fmt.Sprintf("Cache Size: %d\n", c.memsz)
 	ret += fmt.Sprintf("Cache Hits: %d\n", c.hits)
+	ret += fmt.Sprintf("Cache Misses: %d\n", c.misses)
 	ret += fmt.Sprintf("Cache Drops: %d\n", c.drops)
-	ret += fmt.Sprintf("Cache Domain Sent: %d\n", c.dsent)
-	ret += fmt.Sprintf("Cache Domain Recv: %d\n", c.drecv)
+	ret += fmt.Sprintf("Cache Rejects: %d\n", c.rejects)
+	ret += fmt.Sprintf("Cache Invalidations: %d\n", c.invals)
+	ret += fmt.Sprintf("Cache Expired: %d\n", c.expired)
+	ret += c.wbackStats()
+	ret += c.staleStats()
+	if c.stathits != 0 {
+		ret += fmt.Sprintf("Cache Stat Hits: %d\n", c.stathits)
+	}
+
+	if c.uncached != 0 {
+		ret += fmt.Sprintf("Cache Uncacheable: %d\n", c.uncached)
+	}
+	ret += c.domainStats()
+	ret += c.policy.Stats()
 
 	return
 }
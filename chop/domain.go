@@ -0,0 +1,424 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"hop"
+	"hop/d2hop"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Consistency domains
+//
+// A group of ranks can create a consistency domain. The CHop caches of the
+// members are joined in a D2Hop, and each key accessed through the domain
+// is owned by exactly one member. The operations on #/cache/<domain>/<key>
+// are forwarded to the owner of the key, which performs them on <key>
+// through its own cache. As all members see the same cached copy, the
+// consistency within the domain is strong, while the clients outside of the
+// domain can still access the keys directly with relaxed consistency.
+//
+// The domain's policy controls how the members use their own caches:
+//
+//	strong	all operations go to the owner (default)
+//	local	reads are served from the local cache if the key is cached,
+//		modifications go to the owner and update the local cache
+//
+// The policy is a per-member setting, it is not propagated to the other
+// members.
+//
+// Virtual entries:
+//
+//	#/domains		zero-separated list of the domains the cache is member of
+//	#/domain/<name>		policy, members and traffic of the domain
+
+const (
+	DomainStrong = "strong"
+	DomainLocal  = "local"
+)
+
+type Domain struct {
+	c      *CHop
+	name   string
+	prefix string // prefix of the keys forwarded to the owner
+	policy string
+	dhop   *d2hop.D2Hop
+	srv    domainSrv
+
+	sent uint64 // operations sent to the owners
+	recv uint64 // operations received from the other members
+}
+
+// The Hop that the D2Hop of the domain serves. It receives the operations
+// forwarded by the other members.
+type domainSrv struct {
+	d *Domain
+}
+
+var Enodomain = errors.New("unknown consistency domain")
+var Edomainexist = errors.New("already member of the domain")
+
+// Creates a new consistency domain. The cache listens on listenaddr for
+// the other members.
+func (c *CHop) CreateDomain(name, proto, listenaddr string) (*Domain, error) {
+	return c.JoinDomain(name, proto, listenaddr, "")
+}
+
+// Joins the consistency domain that was created by the member listening
+// on masteraddr. If listenaddr is empty, the cache doesn't own any keys,
+// it only forwards the operations to the other members.
+func (c *CHop) JoinDomain(name, proto, listenaddr, masteraddr string) (d *Domain, err error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, Einval
+	}
+
+	d = new(Domain)
+	d.c = c
+	d.name = name
+	d.prefix = "#/chop/" + name + "/"
+	d.policy = DomainStrong
+	d.srv.d = d
+
+	c.Lock()
+	if c.domains[name] != nil {
+		c.Unlock()
+		return nil, Edomainexist
+	}
+
+	c.domains[name] = d
+	c.dgen++
+	c.dcond.Broadcast()
+	c.Unlock()
+
+	d.dhop, err = d2hop.NewD2Hop(proto, listenaddr, masteraddr, &d.srv, nil)
+	if err != nil {
+		c.Lock()
+		delete(c.domains, name)
+		c.Unlock()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Leaves the consistency domain
+func (c *CHop) LeaveDomain(name string) error {
+	c.Lock()
+	d := c.domains[name]
+	if d == nil {
+		c.Unlock()
+		return Enodomain
+	}
+
+	delete(c.domains, name)
+	c.dgen++
+	c.dcond.Broadcast()
+	c.Unlock()
+
+	d.dhop.Close()
+	return nil
+}
+
+func (c *CHop) Domain(name string) *Domain {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.domains[name]
+}
+
+func (c *CHop) SetDomainPolicy(name, policy string) error {
+	switch policy {
+	case DomainStrong, DomainLocal:
+	default:
+		return errors.New(fmt.Sprintf("unknown domain policy: %s", policy))
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	d := c.domains[name]
+	if d == nil {
+		return Enodomain
+	}
+
+	d.policy = policy
+	return nil
+}
+
+// Splits #/cache/<domain>/<key> into the domain and the key
+func (c *CHop) domainKey(key string) (d *Domain, dkey string, err error) {
+	key = key[len("#/cache/"):]
+	n := strings.Index(key, "/")
+	if n < 0 {
+		return nil, "", Einval
+	}
+
+	c.Lock()
+	d = c.domains[key[0:n]]
+	c.Unlock()
+
+	if d == nil {
+		return nil, "", Enodomain
+	}
+
+	return d, key[n+1:], nil
+}
+
+// The entries change when the domains are joined or left
+func (c *CHop) getDomainEntry(key string, version uint64) (ver uint64, val []byte, err error) {
+	var names []string
+
+	c.Lock()
+	ver = hop.Lowest + c.dgen
+	switch version {
+	case hop.PastNewest:
+		version = ver + 1
+	case hop.Newest, hop.Any:
+		version = ver
+	}
+
+	for !c.closed && ver < version {
+		c.dcond.Wait()
+		ver = hop.Lowest + c.dgen
+	}
+
+	if c.closed && ver < version {
+		c.Unlock()
+		return 0, nil, hop.Eremoved
+	}
+
+	for name, _ := range c.domains {
+		names = append(names, name)
+	}
+	c.Unlock()
+
+	if key == "#/domains" {
+		sort.Strings(names)
+		return ver, []byte(strings.Join(names, "\000")), nil
+	}
+
+	d, _, err := c.domainKey("#/cache/" + key[len("#/domain/"):] + "/")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	members, err := d.Members()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c.Lock()
+	policy := d.policy
+	c.Unlock()
+
+	s := fmt.Sprintf("policy %s\n", policy)
+	s += fmt.Sprintf("members %s\n", strings.Join(members, " "))
+	s += fmt.Sprintf("sent %d\n", atomic.LoadUint64(&d.sent))
+	s += fmt.Sprintf("recv %d\n", atomic.LoadUint64(&d.recv))
+
+	return ver, []byte(s), nil
+}
+
+// used by Stats
+func (c *CHop) domainStats() (ret string) {
+	var names []string
+
+	for name, _ := range c.domains {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		d := c.domains[name]
+		ret += fmt.Sprintf("Cache Domain %s Sent: %d\n", name, atomic.LoadUint64(&d.sent))
+		ret += fmt.Sprintf("Cache Domain %s Recv: %d\n", name, atomic.LoadUint64(&d.recv))
+	}
+
+	return
+}
+
+func (d *Domain) Name() string {
+	return d.name
+}
+
+// Returns the addresses of the members that own keys
+func (d *Domain) Members() (members []string, err error) {
+	_, conf, err := d.dhop.Get("#/conf", hop.Any)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first line is the master, the rest are the servers
+	lines := strings.Split(string(conf), "\n")
+	for _, l := range lines[1:] {
+		if n := strings.Index(l, " "); n > 0 {
+			members = append(members, l[0:n])
+		}
+	}
+
+	return
+}
+
+func (d *Domain) local() bool {
+	d.c.Lock()
+	defer d.c.Unlock()
+
+	return d.policy == DomainLocal
+}
+
+// Domain implements hop.Hop, the operations on it are performed on the keys
+// within the domain.
+func (d *Domain) Create(key, flags string, value []byte) (ver uint64, err error) {
+	atomic.AddUint64(&d.sent, 1)
+	t, igen := d.c.start()
+	ver, err = d.dhop.Create(d.prefix+key, flags, value)
+	if err == nil && ver != 0 && d.local() {
+		d.c.updateEntry(key, ver, append([]byte{}, value...), t, igen)
+	}
+
+	return
+}
+
+func (d *Domain) Remove(key string) (err error) {
+	atomic.AddUint64(&d.sent, 1)
+	err = d.dhop.Remove(d.prefix + key)
+	if err == nil && d.local() {
+		d.c.removeEntry(key)
+	}
+
+	return
+}
+
+func (d *Domain) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	local := d.local()
+	if local && version == hop.Any {
+		if ver, val, _ = d.c.getEntry(key, 0, 0); ver != 0 {
+			return
+		}
+	}
+
+	atomic.AddUint64(&d.sent, 1)
+	t, igen := d.c.start()
+	ver, val, err = d.dhop.Get(d.prefix+key, version)
+	if err == nil && ver != 0 && local {
+		d.c.updateEntry(key, ver, val, t, igen)
+	}
+
+	return
+}
+
+func (d *Domain) Stat(key string) (st *hop.Stat, err error) {
+	atomic.AddUint64(&d.sent, 1)
+	return hop.GetStat(d.dhop, d.prefix+key)
+}
+
+func (d *Domain) Set(key string, value []byte) (ver uint64, err error) {
+	atomic.AddUint64(&d.sent, 1)
+	t, igen := d.c.start()
+	ver, err = d.dhop.Set(d.prefix+key, value)
+	if err == nil && ver != 0 && d.local() {
+		d.c.updateEntry(key, ver, append([]byte{}, value...), t, igen)
+	}
+
+	return
+}
+
+func (d *Domain) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	atomic.AddUint64(&d.sent, 1)
+	ver, val, err = d.dhop.TestSet(d.prefix+key, oldversion, oldvalue, value)
+	if err == nil && d.local() {
+		d.c.removeEntry(key)
+	}
+
+	return
+}
+
+func (d *Domain) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	atomic.AddUint64(&d.sent, 1)
+	ver, vals, err = d.dhop.Atomic(d.prefix+key, op, values)
+	if err == nil && d.local() {
+		d.c.removeEntry(key)
+	}
+
+	return
+}
+
+// Strips the domain prefix from the forwarded keys. The keys without the
+// prefix (the D2Hop's own requests) go to the cached Hop.
+func (s *domainSrv) key(key string) (string, error) {
+	d := s.d
+	if !strings.HasPrefix(key, d.prefix) {
+		return key, nil
+	}
+
+	key = key[len(d.prefix):]
+	if strings.HasPrefix(key, "#/cache/") {
+		// don't allow forwarding loops
+		return "", Einval
+	}
+
+	atomic.AddUint64(&d.recv, 1)
+	return key, nil
+}
+
+func (s *domainSrv) Create(key, flags string, value []byte) (ver uint64, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Create(key, flags, value)
+}
+
+func (s *domainSrv) Remove(key string) (err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Remove(key)
+}
+
+func (s *domainSrv) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Get(key, version)
+}
+
+func (s *domainSrv) Stat(key string) (st *hop.Stat, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Stat(key)
+}
+
+func (s *domainSrv) Set(key string, value []byte) (ver uint64, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Set(key, value)
+}
+
+func (s *domainSrv) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.TestSet(key, oldversion, oldvalue, value)
+}
+
+func (s *domainSrv) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	if key, err = s.key(key); err != nil {
+		return
+	}
+
+	return s.d.c.Atomic(key, op, values)
+}
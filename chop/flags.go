@@ -0,0 +1,89 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"hop"
+	"strings"
+)
+
+// Per-key flags (see hop.Flags)
+//
+// CHop knows the flags of the keys created through it. If flag lookup is
+// enabled, it also reads the #/flags/ entry of the other keys the first
+// time they are read from the Hop. The flags are honoured as follows:
+//
+//	cache=no		the value is never cached
+//	cache=<duration>	the maximum age of the cached value, overrides
+//				the one set by SetMaxAge
+//	consistency=strong	the value is cached only if leases are
+//				enabled, and is never written back
+//
+// The other flags don't affect CHop.
+
+// Enables reading the flags of the keys that were not created through
+// the cache.
+func (c *CHop) SetFlagLookup(lookup bool) {
+	c.Lock()
+	c.flookup = lookup
+	c.Unlock()
+}
+
+// Returns the flags of the key, or nil if they are not known
+func (c *CHop) keyFlags(key string) (f *hop.Flags) {
+	c.Lock()
+	f, ok := c.kflags[key]
+	lookup := c.flookup && !ok && !strings.HasPrefix(key, "#/")
+	c.Unlock()
+
+	if !lookup {
+		return
+	}
+
+	f, _ = hop.GetFlags(c.hop, key)
+	c.setFlags(key, f)
+	return
+}
+
+func (c *CHop) setFlags(key string, f *hop.Flags) {
+	c.Lock()
+	if c.kflags == nil || len(c.kflags) >= 2*c.maxelem {
+		// the flags are just a hint, start over
+		c.kflags = make(map[string]*hop.Flags)
+	}
+
+	c.kflags[key] = f
+	c.Unlock()
+}
+
+// Checks if the value of the key may be cached
+func (c *CHop) cacheable(key string) bool {
+	// the list of versions changes with each modification
+	if strings.HasPrefix(key, hop.VersionsPrefix) {
+		return false
+	}
+
+	f := c.keyFlags(key)
+	if f == nil {
+		return true
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if f.Cache == hop.CacheNo || (f.Consistency == hop.Strong && c.lease == 0) {
+		c.uncached++
+		return false
+	}
+
+	return true
+}
+
+// Checks if the key's value may be written back
+// called with c lock held
+func (c *CHop) writeBack(key string) bool {
+	f := c.kflags[key]
+	return f == nil || (f.Cache != hop.CacheNo && f.Consistency != hop.Strong)
+}
@@ -0,0 +1,346 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"fmt"
+	"hop"
+	"hop/rmt/hopsrv"
+	"sync"
+	"time"
+)
+
+// LeaseHop is used on the server side to keep the CHop caches of the
+// clients consistent. It wraps the Hop served by a hopsrv.Srv, and has to
+// be passed to Srv.Start instead of the Hop. Every value a client connection
+// reads or writes gives that connection a lease on the key. When the key is
+// modified or removed by a connection, all other connections that hold an
+// unexpired lease on it are sent an invalidation.
+//
+// The invalidations are delivered through the #/lease entry. Reading it
+// blocks until there are pending invalidations for the connection (or
+// returns immediately if version is Any) and returns them as a list of
+// zero-separated key and version pairs. The version is the new version of
+// the entry, or zero if the entry was removed. The list is cleared once it
+// is read.
+type LeaseHop struct {
+	sync.Mutex
+	hop   hop.Hop
+	lease time.Duration
+
+	// for each key, the connections that hold lease and their expiration
+	keys  map[string]map[*LeaseConn]time.Time
+	conns map[*hopsrv.Conn]*LeaseConn
+}
+
+// LeaseConn represents a client connection to the LeaseHop
+type LeaseConn struct {
+	hop.Entry // Version changes when new invalidations are added
+
+	lh     *LeaseHop
+	conn   *hopsrv.Conn
+	inval  []byte // pending invalidations
+	closed bool
+}
+
+var DefaultLease = 10 * time.Second
+
+func NewLeaseHop(h hop.Hop, lease time.Duration) *LeaseHop {
+	lh := new(LeaseHop)
+	lh.hop = h
+	lh.lease = lease
+	lh.keys = make(map[string]map[*LeaseConn]time.Time)
+	lh.conns = make(map[*hopsrv.Conn]*LeaseConn)
+
+	go lh.expireproc()
+	return lh
+}
+
+func (lh *LeaseHop) ConnOpened(c *hopsrv.Conn) {
+	lc := new(LeaseConn)
+	lc.lh = lh
+	lc.conn = c
+	lc.L = lc.RLocker()
+	lc.Version = hop.Lowest
+	c.SetOps(lc)
+
+	lh.Lock()
+	lh.conns[c] = lc
+	lh.Unlock()
+}
+
+func (lh *LeaseHop) ConnClosed(c *hopsrv.Conn) {
+	lh.Lock()
+	lc := lh.conns[c]
+	delete(lh.conns, c)
+	if lc != nil {
+		for key, conns := range lh.keys {
+			delete(conns, lc)
+			if len(conns) == 0 {
+				delete(lh.keys, key)
+			}
+		}
+	}
+	lh.Unlock()
+
+	if lc != nil {
+		// wake up the pending #/lease reads
+		lc.Lock()
+		lc.closed = true
+		lc.Unlock()
+		lc.Broadcast()
+	}
+}
+
+// LeaseHop can also be used directly, the modifications it makes
+// invalidate the leases of all connections
+func (lh *LeaseHop) Create(key, flags string, value []byte) (ver uint64, err error) {
+	ver, err = lh.hop.Create(key, flags, value)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, nil)
+	}
+
+	return
+}
+
+func (lh *LeaseHop) Remove(key string) (err error) {
+	err = lh.hop.Remove(key)
+	if err == nil {
+		lh.invalidate(key, 0, nil)
+	}
+
+	return
+}
+
+func (lh *LeaseHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	return lh.hop.Get(key, version)
+}
+
+func (lh *LeaseHop) Stat(key string) (st *hop.Stat, err error) {
+	return hop.GetStat(lh.hop, key)
+}
+
+func (lh *LeaseHop) Set(key string, value []byte) (ver uint64, err error) {
+	ver, err = lh.hop.Set(key, value)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, nil)
+	}
+
+	return
+}
+
+func (lh *LeaseHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	ver, val, err = lh.hop.TestSet(key, oldversion, oldvalue, value)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, nil)
+	}
+
+	return
+}
+
+func (lh *LeaseHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	ver, vals, err = lh.hop.Atomic(key, op, values)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, nil)
+	}
+
+	return
+}
+
+// Gives the connection a lease on the key
+func (lh *LeaseHop) grant(key string, lc *LeaseConn) {
+	lh.Lock()
+	conns := lh.keys[key]
+	if conns == nil {
+		conns = make(map[*LeaseConn]time.Time)
+		lh.keys[key] = conns
+	}
+
+	conns[lc] = time.Now().Add(lh.lease)
+	lh.Unlock()
+}
+
+// Sends invalidations for the key to all connections except the one that
+// modified it, which keeps its lease
+func (lh *LeaseHop) invalidate(key string, ver uint64, from *LeaseConn) {
+	var lcs []*LeaseConn
+
+	now := time.Now()
+	lh.Lock()
+	conns := lh.keys[key]
+	for lc, exp := range conns {
+		if lc == from {
+			continue
+		}
+
+		if now.Before(exp) {
+			lcs = append(lcs, lc)
+		}
+
+		delete(conns, lc)
+	}
+
+	if len(conns) == 0 {
+		delete(lh.keys, key)
+	}
+	lh.Unlock()
+
+	for _, lc := range lcs {
+		lc.Lock()
+		lc.inval = append(lc.inval, []byte(key)...)
+		lc.inval = append(lc.inval, 0)
+		lc.inval = append(lc.inval, []byte(fmt.Sprintf("%d", ver))...)
+		lc.inval = append(lc.inval, 0)
+		lc.IncreaseVersion()
+		lc.Unlock()
+		lc.Modified()
+	}
+}
+
+// Removes the expired leases
+func (lh *LeaseHop) expireproc() {
+	for {
+		time.Sleep(lh.lease)
+		now := time.Now()
+		lh.Lock()
+		for key, conns := range lh.keys {
+			for lc, exp := range conns {
+				if now.After(exp) {
+					delete(conns, lc)
+				}
+			}
+
+			if len(conns) == 0 {
+				delete(lh.keys, key)
+			}
+		}
+		lh.Unlock()
+	}
+}
+
+func (lc *LeaseConn) Create(key, flags string, value []byte) (ver uint64, err error) {
+	return lc.CreateAs("", key, flags, value)
+}
+
+func (lc *LeaseConn) CreateAs(ident, key, flags string, value []byte) (ver uint64, err error) {
+	// the lease is granted before the operation, so the modifications
+	// made after it are sent to the connection
+	lh := lc.lh
+	lh.grant(key, lc)
+	if cop, ok := lh.hop.(hop.CreateAsHop); ok {
+		ver, err = cop.CreateAs(ident, key, flags, value)
+	} else {
+		ver, err = lh.hop.Create(key, flags, value)
+	}
+
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, lc)
+	}
+
+	return
+}
+
+func (lc *LeaseConn) Remove(key string) (err error) {
+	lh := lc.lh
+	err = lh.hop.Remove(key)
+	if err == nil {
+		lh.invalidate(key, 0, lc)
+	}
+
+	return
+}
+
+func (lc *LeaseConn) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key == "#/lease" {
+		return lc.getInval(version)
+	}
+
+	lh := lc.lh
+	t := time.Now()
+	lh.grant(key, lc)
+	ver, val, err = lh.hop.Get(key, version)
+	if err == nil && ver != 0 && time.Since(t) >= lh.lease {
+		// the lease may have expired while the Get was waiting
+		lh.grant(key, lc)
+		ver, val, err = lh.hop.Get(key, hop.Any)
+	}
+
+	return
+}
+
+func (lc *LeaseConn) Stat(key string) (st *hop.Stat, err error) {
+	return hop.GetStat(lc.lh.hop, key)
+}
+
+func (lc *LeaseConn) Set(key string, value []byte) (ver uint64, err error) {
+	lh := lc.lh
+	lh.grant(key, lc)
+	ver, err = lh.hop.Set(key, value)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, lc)
+	}
+
+	return
+}
+
+func (lc *LeaseConn) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	lh := lc.lh
+	lh.grant(key, lc)
+	ver, val, err = lh.hop.TestSet(key, oldversion, oldvalue, value)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, lc)
+	}
+
+	return
+}
+
+func (lc *LeaseConn) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	lh := lc.lh
+	lh.grant(key, lc)
+	ver, vals, err = lh.hop.Atomic(key, op, values)
+	if err == nil && ver != 0 {
+		lh.invalidate(key, ver, lc)
+	}
+
+	return
+}
+
+// Waits for invalidations for the connection
+func (lc *LeaseConn) getInval(version uint64) (ver uint64, val []byte, err error) {
+	lc.Lock()
+	switch version {
+	case hop.Any, hop.Newest:
+		version = lc.Version
+	case hop.PastNewest:
+		version = lc.Version + 1
+	}
+
+	for !lc.closed && lc.Version < version {
+		lc.Unlock()
+		lc.RLock()
+		if !lc.closed && lc.Version < version {
+			lc.Wait()
+		}
+		lc.RUnlock()
+		lc.Lock()
+	}
+
+	if lc.closed {
+		lc.Unlock()
+		return 0, nil, hop.Eremoved
+	}
+
+	ver = lc.Version
+	val = lc.inval
+	lc.inval = nil
+	lc.Unlock()
+
+	if len(val) > 0 {
+		// remove the trailing zero
+		val = val[0 : len(val)-1]
+	}
+
+	return
+}
@@ -0,0 +1,237 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// Policy decides which entries are evicted from the cache. All methods
+// are called with the CHop lock held. When the cache is over its limits,
+// CHop calls Victim until it is back within the limits. The entry returned
+// by Victim can be the one that was just inserted, in which case the
+// policy didn't admit it in the cache.
+type Policy interface {
+	Name() string
+
+	// A new entry was added to the cache
+	Insert(e *CEntry)
+
+	// The entry was read or its value was updated
+	Access(e *CEntry)
+
+	// The entry was removed from the cache (not as a result of Victim)
+	Remove(e *CEntry)
+
+	// Selects an entry to evict and removes it from the policy's
+	// structures. Returns nil if there are no entries.
+	Victim() *CEntry
+
+	// Policy-specific statistics, one value per line
+	Stats() string
+}
+
+// Approximation of the memory used by each entry in addition to its key and
+// value: the CEntry itself and its slot in the entries map.
+const EntryOverhead = uint64(unsafe.Sizeof(CEntry{})) + 48
+
+var DefaultPolicy = "lru"
+
+var policies = make(map[string]func(maxelem int) Policy)
+
+// Registers a new eviction policy. The newpolicy function is called for
+// each CHop that uses the policy with the maximum number of elements the
+// cache can have.
+func AddPolicy(name string, newpolicy func(maxelem int) Policy) error {
+	if policies[name] != nil {
+		return errors.New(fmt.Sprintf("policy %s already registered", name))
+	}
+
+	policies[name] = newpolicy
+	return nil
+}
+
+func NewPolicy(name string, maxelem int) (Policy, error) {
+	if name == "" {
+		name = DefaultPolicy
+	}
+
+	newpolicy := policies[name]
+	if newpolicy == nil {
+		return nil, errors.New(fmt.Sprintf("unknown cache policy: %s", name))
+	}
+
+	return newpolicy(maxelem), nil
+}
+
+func entrySize(key string, val []byte) uint64 {
+	return uint64(len(key)+len(val)) + EntryOverhead
+}
+
+// Doubly-linked list of entries, the most recently used entry first.
+// Each entry can be in at most one list at a time.
+type clist struct {
+	lru *CEntry // least recently used entry
+	mru *CEntry // most recently used entry
+	n   int
+}
+
+func (l *clist) push(e *CEntry) {
+	e.lru = l.mru
+	e.mru = nil
+	if l.mru != nil {
+		l.mru.mru = e
+	} else {
+		l.lru = e
+	}
+
+	l.mru = e
+	e.list = l
+	l.n++
+}
+
+func (l *clist) remove(e *CEntry) {
+	if e.lru != nil {
+		e.lru.mru = e.mru
+	} else {
+		l.lru = e.mru
+	}
+
+	if e.mru != nil {
+		e.mru.lru = e.lru
+	} else {
+		l.mru = e.lru
+	}
+
+	e.lru = nil
+	e.mru = nil
+	e.list = nil
+	l.n--
+}
+
+// moves the entry to the MRU spot
+func (l *clist) touch(e *CEntry) {
+	l.remove(e)
+	l.push(e)
+}
+
+// removes and returns the LRU entry
+func (l *clist) pop() *CEntry {
+	e := l.lru
+	if e != nil {
+		l.remove(e)
+	}
+
+	return e
+}
+
+// Least recently used
+type lruPolicy struct {
+	l clist
+}
+
+func newLRU(maxelem int) Policy {
+	return new(lruPolicy)
+}
+
+func (p *lruPolicy) Name() string     { return "lru" }
+func (p *lruPolicy) Insert(e *CEntry) { p.l.push(e) }
+func (p *lruPolicy) Access(e *CEntry) { p.l.touch(e) }
+func (p *lruPolicy) Remove(e *CEntry) { p.l.remove(e) }
+func (p *lruPolicy) Victim() *CEntry  { return p.l.pop() }
+func (p *lruPolicy) Stats() string    { return "" }
+
+// Least frequently used. The entries with the same number of accesses are
+// kept in LRU order, the least recently used one is evicted first.
+type lfuPolicy struct {
+	freqs   map[uint32]*clist
+	minfreq uint32
+}
+
+func newLFU(maxelem int) Policy {
+	p := new(lfuPolicy)
+	p.freqs = make(map[uint32]*clist)
+
+	return p
+}
+
+func (p *lfuPolicy) Name() string { return "lfu" }
+
+func (p *lfuPolicy) Insert(e *CEntry) {
+	e.freq = 1
+	p.add(e)
+	p.minfreq = 1
+}
+
+func (p *lfuPolicy) Access(e *CEntry) {
+	p.del(e)
+	if e.freq < ^uint32(0) {
+		e.freq++
+	}
+
+	p.add(e)
+}
+
+func (p *lfuPolicy) Remove(e *CEntry) {
+	p.del(e)
+}
+
+func (p *lfuPolicy) Victim() *CEntry {
+	if len(p.freqs) == 0 {
+		return nil
+	}
+
+	l := p.freqs[p.minfreq]
+	if l == nil {
+		// find the new minimum
+		first := true
+		for f, _ := range p.freqs {
+			if first || f < p.minfreq {
+				p.minfreq = f
+				first = false
+			}
+		}
+
+		l = p.freqs[p.minfreq]
+	}
+
+	e := l.lru
+	p.del(e)
+	return e
+}
+
+func (p *lfuPolicy) Stats() string {
+	return fmt.Sprintf("LFU Minimum Frequency: %d\n", p.minfreq)
+}
+
+func (p *lfuPolicy) add(e *CEntry) {
+	l := p.freqs[e.freq]
+	if l == nil {
+		l = new(clist)
+		p.freqs[e.freq] = l
+	}
+
+	l.push(e)
+}
+
+func (p *lfuPolicy) del(e *CEntry) {
+	l := e.list
+	l.remove(e)
+	if l.n == 0 {
+		delete(p.freqs, e.freq)
+		if p.minfreq == e.freq {
+			p.minfreq++
+		}
+	}
+}
+
+func init() {
+	AddPolicy("lru", newLRU)
+	AddPolicy("lfu", newLFU)
+	AddPolicy("arc", newARC)
+	AddPolicy("tinylfu", newTinyLFU)
+}
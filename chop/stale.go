@@ -0,0 +1,124 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"fmt"
+	"hop"
+	"strings"
+	"time"
+)
+
+// Bounded staleness
+//
+// Every cached entry records when its value was read from the Hop. Get
+// with version hop.Any returns the cached value only if it isn't older than
+// the maximum age, otherwise the value is read from the Hop again. The
+// maximum age can be set for all keys with the same prefix (SetMaxAge), or
+// for a single call (GetMaxAge). The cache=<duration> flag of the key
+// (see hop.Flags) overrides the prefix setting. If the maximum age is zero, the cached
+// value is used regardless of its age.
+//
+// Stale-while-revalidate: if revalidate is not zero, an entry that is older
+// than the maximum age, but not older than the maximum age plus revalidate,
+// is still returned, and a new value is read from the Hop in the background.
+//
+// Dirty entries (see SetWriteBack) never become stale.
+
+type maxAge struct {
+	prefix     string
+	maxage     time.Duration
+	revalidate time.Duration
+}
+
+// Sets the maximum age of the cached values of the keys that start with the
+// prefix. If more than one prefix matches a key, the longest one is used.
+// If maxage is zero, the setting for the prefix is removed.
+func (c *CHop) SetMaxAge(prefix string, maxage, revalidate time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, a := range c.ages {
+		if a.prefix == prefix {
+			c.ages = append(c.ages[0:i], c.ages[i+1:]...)
+			break
+		}
+	}
+
+	if maxage == 0 {
+		return
+	}
+
+	n := 0
+	for n < len(c.ages) && len(c.ages[n].prefix) >= len(prefix) {
+		n++
+	}
+
+	c.ages = append(c.ages, maxAge{})
+	copy(c.ages[n+1:], c.ages[n:])
+	c.ages[n] = maxAge{prefix, maxage, revalidate}
+}
+
+// Same as Get, but uses the specified maximum age instead of the one set
+// for the key's prefix.
+func (c *CHop) GetMaxAge(key string, version uint64, maxage, revalidate time.Duration) (ver uint64, val []byte, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return c.Get(key, version)
+	}
+
+	return c.get(key, version, maxage, revalidate)
+}
+
+// Returns the maximum age for the key
+func (c *CHop) maxAge(key string) (maxage, revalidate time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if f := c.kflags[key]; f != nil && f.MaxAge != 0 {
+		return f.MaxAge, 0
+	}
+
+	for _, a := range c.ages {
+		if strings.HasPrefix(key, a.prefix) {
+			return a.maxage, a.revalidate
+		}
+	}
+
+	return 0, 0
+}
+
+// Reads the current value of the stale entry from the Hop
+func (c *CHop) revalidate(key string) {
+	t, igen := c.start()
+	ver, val, err := c.hop.Get(key, hop.Any)
+	if err == nil && ver != 0 {
+		c.updateEntry(key, ver, val, t, igen)
+	} else if err == nil {
+		c.removeEntry(key)
+	}
+
+	c.Lock()
+	if e := c.entries[key]; e != nil {
+		e.refreshing = false
+	}
+
+	if err == nil {
+		c.revalidated++
+	}
+	c.Unlock()
+}
+
+// used by Stats
+func (c *CHop) staleStats() (ret string) {
+	if len(c.ages) == 0 && c.staleserved == 0 && c.refreshed == 0 {
+		return
+	}
+
+	ret += fmt.Sprintf("Cache Stale Served: %d\n", c.staleserved)
+	ret += fmt.Sprintf("Cache Refreshed: %d\n", c.refreshed)
+	ret += fmt.Sprintf("Cache Revalidated: %d\n", c.revalidated)
+
+	return
+}
@@ -0,0 +1,200 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// W-TinyLFU (Einziger, Friedman & Manes). New entries go to a small LRU
+// window. When an entry leaves the window, it is admitted to the main cache
+// only if its estimated access frequency is higher than the frequency of
+// the entry the main cache would evict. The main cache is a segmented LRU
+// with probation and protected segments. The frequencies are estimated by
+// a count-min sketch that is halved periodically, so old popularity fades.
+type tinyLFUPolicy struct {
+	wcap   int // window capacity
+	mcap   int // main cache capacity
+	pcap   int // protected segment capacity
+	window clist
+	probat clist
+	protec clist
+	sketch cmSketch
+
+	admitted uint64
+	rejected uint64
+}
+
+const maxSketchWidth = 1 << 22
+
+// Count-min sketch with 4 rows of 4-bit counters (stored in bytes)
+type cmSketch struct {
+	width   uint64 // power of two
+	rows    [4][]uint8
+	adds    int
+	maxadds int
+}
+
+func newTinyLFU(maxelem int) Policy {
+	if maxelem < 1 {
+		maxelem = 1
+	}
+
+	p := new(tinyLFUPolicy)
+	p.wcap = maxelem / 100
+	if p.wcap < 1 {
+		p.wcap = 1
+	}
+
+	p.mcap = maxelem - p.wcap
+	p.pcap = p.mcap * 8 / 10
+	p.sketch.init(maxelem)
+
+	return p
+}
+
+func (p *tinyLFUPolicy) Name() string { return "tinylfu" }
+
+func (p *tinyLFUPolicy) Insert(e *CEntry) {
+	p.sketch.add(e.key)
+	p.window.push(e)
+}
+
+func (p *tinyLFUPolicy) Access(e *CEntry) {
+	p.sketch.add(e.key)
+	switch e.list {
+	case &p.window, &p.protec:
+		e.list.touch(e)
+
+	case &p.probat:
+		// promote to the protected segment
+		p.probat.remove(e)
+		p.protec.push(e)
+		if p.protec.n > p.pcap {
+			if d := p.protec.pop(); d != nil {
+				p.probat.push(d)
+			}
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(e *CEntry) {
+	e.list.remove(e)
+}
+
+func (p *tinyLFUPolicy) Victim() *CEntry {
+	for p.window.n > p.wcap {
+		cand := p.window.pop()
+		if p.probat.n+p.protec.n < p.mcap {
+			// there is space in the main cache
+			p.probat.push(cand)
+			continue
+		}
+
+		victim := p.probat.lru
+		if victim == nil {
+			victim = p.protec.lru
+		}
+
+		if victim == nil {
+			// no main cache (maxelem is 1)
+			return cand
+		}
+
+		if p.sketch.estimate(cand.key) > p.sketch.estimate(victim.key) {
+			p.admitted++
+			victim.list.remove(victim)
+			p.probat.push(cand)
+			return victim
+		}
+
+		p.rejected++
+		return cand
+	}
+
+	if e := p.probat.pop(); e != nil {
+		return e
+	}
+
+	if e := p.protec.pop(); e != nil {
+		return e
+	}
+
+	return p.window.pop()
+}
+
+func (p *tinyLFUPolicy) Stats() string {
+	ret := fmt.Sprintf("TinyLFU Window/Probation/Protected: %d/%d/%d\n", p.window.n, p.probat.n, p.protec.n)
+	ret += fmt.Sprintf("TinyLFU Admitted: %d\n", p.admitted)
+	ret += fmt.Sprintf("TinyLFU Rejected: %d\n", p.rejected)
+
+	return ret
+}
+
+// The sketch is sized for maxelem, but not larger than maxSketchWidth
+// counters per row (16MB), the estimates are less accurate for the caches
+// with more elements
+func (s *cmSketch) init(maxelem int) {
+	s.width = 64
+	for s.width < maxSketchWidth && s.width/4 < uint64(maxelem) {
+		s.width <<= 1
+	}
+
+	for i, _ := range s.rows {
+		s.rows[i] = make([]uint8, s.width)
+	}
+
+	if uint64(maxelem) > s.width/4 {
+		maxelem = int(s.width / 4)
+	}
+
+	s.maxadds = maxelem * 10
+}
+
+func (s *cmSketch) index(h uint64, row int) uint64 {
+	// derive the row hashes from the two halves of the key hash
+	return (h + uint64(row)*(h>>32|1)) & (s.width - 1)
+}
+
+func (s *cmSketch) add(key string) {
+	h := keyHash(key)
+	for i, _ := range s.rows {
+		c := &s.rows[i][s.index(h, i)]
+		if *c < 15 {
+			*c++
+		}
+	}
+
+	s.adds++
+	if s.adds >= s.maxadds {
+		// age the counters
+		for i, _ := range s.rows {
+			for j, _ := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+
+		s.adds /= 2
+	}
+}
+
+func (s *cmSketch) estimate(key string) (n uint8) {
+	h := keyHash(key)
+	n = 15
+	for i, _ := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < n {
+			n = c
+		}
+	}
+
+	return
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -0,0 +1,344 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Write-back mode
+//
+// In write-back mode, Set on an entry that is in the cache only updates
+// the cached value and marks the entry dirty. Repeated Sets of a dirty
+// entry are coalesced, only the last value is written to the Hop. The dirty
+// entries are flushed when the flush interval expires, when the size of the
+// dirty values goes over the limit, when a dirty entry is evicted from the
+// cache, and when Flush is called. Set on an entry that is not cached, as
+// well as all other operations, are still written through. Before Create,
+// TestSet, Atomic, and Get of a version newer than the cached one, the
+// dirty value of the key is flushed.
+//
+// Versions: the version returned by Set of a dirty entry is provisional,
+// it is the last version committed to the Hop plus one, and it doesn't
+// change while the entry stays dirty. Once the entry is flushed, it gets
+// the committed version returned by the Hop. That version is equal to the
+// provisional one, unless somebody else modified the entry in the meantime,
+// in which case it is higher.
+//
+// Errors: if a deferred flush fails, the entry is removed from the cache,
+// so the following operations see the value in the Hop, and the error is
+// returned by the next call to Flush. If the entry was set again while it
+// was being flushed, it stays dirty and the new value is flushed later.
+//
+// The writes through the cache wait for the flush of the key that is in
+// flight, so the old value can't be written over the new one.
+
+// Error returned by Flush. Contains the errors for each of the keys that
+// couldn't be written.
+type FlushError struct {
+	Errs map[string]error
+}
+
+var Enoentry = errors.New("entry doesn't exist")
+
+// Enables write-back mode if maxdirty is not zero, otherwise flushes all
+// dirty entries and switches to write-through mode. If interval is not zero,
+// the dirty entries are flushed periodically.
+func (c *CHop) SetWriteBack(interval time.Duration, maxdirty uint64) error {
+	c.Lock()
+	c.maxdirty = maxdirty
+	c.finterval = interval
+	start := c.fchan == nil && maxdirty != 0
+	if start {
+		c.fchan = make(chan bool, 1)
+	}
+	c.Unlock()
+
+	if start {
+		go c.flushproc()
+	}
+
+	if maxdirty == 0 {
+		return c.Flush()
+	}
+
+	return nil
+}
+
+// Writes all dirty entries to the Hop. Returns the errors from this flush
+// as well as the deferred flushes since the last call to Flush.
+func (c *CHop) Flush() (err error) {
+	var es []*CEntry
+
+	c.Lock()
+	for _, e := range c.entries {
+		if e.dirty {
+			es = append(es, e)
+		}
+	}
+
+	for _, e := range c.pending {
+		es = append(es, e)
+	}
+	c.Unlock()
+
+	for _, e := range es {
+		c.flushEntry(e)
+	}
+
+	c.Lock()
+	if len(c.ferrs) > 0 {
+		err = &FlushError{c.ferrs}
+		c.ferrs = nil
+	}
+	c.Unlock()
+
+	return
+}
+
+// Flushes the key if it is dirty
+func (c *CHop) flushKey(key string) {
+	c.Lock()
+	e := c.entries[key]
+	if e == nil || !e.dirty {
+		e = c.pending[key]
+	}
+	c.Unlock()
+
+	if e != nil {
+		c.flushEntry(e)
+	}
+
+	c.Lock()
+	c.waitFlush(key)
+	c.Unlock()
+}
+
+// Waits for the flushes of the key that are in flight
+// called with c lock held
+func (c *CHop) waitFlush(key string) {
+	for c.flushing[key] > 0 {
+		c.fcond.Wait()
+	}
+}
+
+// Writes the dirty value of the entry to the Hop
+func (c *CHop) flushEntry(e *CEntry) {
+	c.Lock()
+	if !e.dirty {
+		c.Unlock()
+		return
+	}
+
+	key := e.key
+	val := e.value
+	gen := e.dgen
+	if c.flushing == nil {
+		c.flushing = make(map[string]int)
+	}
+
+	c.flushing[key]++
+	c.Unlock()
+
+	t, igen := c.start()
+	ver, err := c.hop.Set(key, val)
+	if err == nil && ver == 0 {
+		err = Enoentry
+	}
+
+	c.Lock()
+	c.flushes++
+	if c.flushing[key]--; c.flushing[key] == 0 {
+		delete(c.flushing, key)
+	}
+
+	c.fcond.Broadcast()
+	if c.pending[key] == e && e.dgen == gen {
+		delete(c.pending, key)
+	}
+
+	if err != nil && e.dgen != gen {
+		// modified while we were flushing it, the new value stays dirty
+		// and is flushed again
+		c.flusherrs++
+	} else if err != nil {
+		c.flusherrs++
+		if c.ferrs == nil {
+			c.ferrs = make(map[string]error)
+		}
+
+		c.ferrs[key] = err
+		if c.entries[key] == e {
+			c.remove(e)
+		} else {
+			c.clean(e)
+		}
+	} else if e.dgen == gen {
+		c.clean(e)
+		e.version = ver
+		e.cver = ver
+		e.expire = t.Add(c.lease)
+		e.fetched = t
+		if c.igen != igen && c.entries[key] == e {
+			// the value might be stale
+			c.remove(e)
+		}
+	} else {
+		// modified while we were flushing it
+		e.cver = ver
+		e.version = ver + 1
+	}
+	c.Unlock()
+}
+
+// Tries to store the value in the cached entry without writing it to the
+// Hop. Returns false if the value needs to be written through, after the
+// flush of the key in flight, if any, completes.
+func (c *CHop) setDirty(key string, value []byte) (ver uint64, ok bool) {
+	c.Lock()
+	if pe := c.pending[key]; pe != nil {
+		// superseded by the new value
+		delete(c.pending, key)
+		c.clean(pe)
+	}
+
+	e := c.entries[key]
+	if c.maxdirty == 0 || e == nil || e.version == 0 || !c.writeBack(key) {
+		c.waitFlush(key)
+		c.Unlock()
+		return 0, false
+	}
+
+	val := make([]byte, len(value))
+	copy(val, value)
+	if e.dirty {
+		c.coalesced++
+		c.dirtysz -= uint64(len(e.value))
+	} else {
+		e.dirty = true
+		e.cver = e.version
+		c.ndirty++
+	}
+
+	c.memsz -= e.size
+	e.dgen++
+	e.value = val
+	e.version = e.cver + 1
+	e.size = entrySize(key, val)
+	c.memsz += e.size
+	c.dirtysz += uint64(len(val))
+	c.policy.Access(e)
+	ver = e.version
+
+	for len(c.entries) > c.maxelem || c.memsz > c.maxmem {
+		if !c.evict(e) {
+			break
+		}
+	}
+
+	flush := c.dirtysz > c.maxdirty || len(c.pending) > 0
+	c.Unlock()
+
+	if flush {
+		c.kickFlush()
+	}
+
+	return ver, true
+}
+
+// Marks the entry as not dirty
+// called with c lock held
+func (c *CHop) clean(e *CEntry) {
+	if e.dirty {
+		e.dirty = false
+		c.ndirty--
+		c.dirtysz -= uint64(len(e.value))
+	}
+}
+
+// Asks the flush goroutine to flush all dirty entries
+func (c *CHop) kickFlush() {
+	select {
+	case c.fchan <- true:
+	default:
+	}
+}
+
+func (c *CHop) flushproc() {
+	for {
+		c.Lock()
+		interval := c.finterval
+		c.Unlock()
+
+		var tchan <-chan time.Time
+		if interval != 0 {
+			tchan = time.After(interval)
+		}
+
+		select {
+		case <-c.fchan:
+		case <-tchan:
+		case <-c.done:
+			return
+		}
+
+		c.flushDirty()
+	}
+}
+
+// Flushes the dirty entries, keeps the errors for the next call to Flush
+func (c *CHop) flushDirty() {
+	var es []*CEntry
+
+	c.Lock()
+	for _, e := range c.pending {
+		es = append(es, e)
+	}
+
+	for _, e := range c.entries {
+		if e.dirty {
+			es = append(es, e)
+		}
+	}
+	c.Unlock()
+
+	for _, e := range es {
+		c.flushEntry(e)
+	}
+}
+
+func (e *FlushError) Error() string {
+	var keys []string
+
+	for k, _ := range e.Errs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	s := fmt.Sprintf("write-back failed for %d keys:", len(keys))
+	for _, k := range keys {
+		s += fmt.Sprintf(" %s: %v;", k, e.Errs[k])
+	}
+
+	return s
+}
+
+// used by Stats
+func (c *CHop) wbackStats() (ret string) {
+	if c.maxdirty == 0 && c.flushes == 0 {
+		return
+	}
+
+	ret += fmt.Sprintf("Cache Dirty: %d\n", c.ndirty)
+	ret += fmt.Sprintf("Cache Dirty Size: %d\n", c.dirtysz)
+	ret += fmt.Sprintf("Cache Coalesced: %d\n", c.coalesced)
+	ret += fmt.Sprintf("Cache Flushes: %d\n", c.flushes)
+	ret += fmt.Sprintf("Cache Flush Errors: %d\n", c.flusherrs)
+
+	return
+}
@@ -0,0 +1,124 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chop
+
+import (
+	"bytes"
+	"hop"
+	"hop/shop"
+	"testing"
+	"time"
+)
+
+// SHop that blocks the Sets of the value until the gate is closed
+type gateHop struct {
+	*shop.SHop
+	value   []byte
+	started chan bool
+	gate    chan bool
+}
+
+func (h *gateHop) Set(key string, value []byte) (uint64, error) {
+	if bytes.Equal(value, h.value) {
+		h.started <- true
+		<-h.gate
+	}
+
+	return h.SHop.Set(key, value)
+}
+
+func newWriteBack(t *testing.T, h hop.Hop, maxelem int) *CHop {
+	c, err := NewCache(h, 1<<20, maxelem, "lru")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetWriteBack(0, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestWriteBackCoalesce(t *testing.T) {
+	h := shop.NewSHop()
+	h.Create("a", "", []byte("0"))
+	c := newWriteBack(t, h, 16)
+	defer c.Close()
+
+	c.Get("a", hop.Any)
+	for i := 1; i <= 5; i++ {
+		ver, err := c.Set("a", []byte{byte('0' + i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ver != 2 {
+			t.Fatalf("provisional version %d, expected 2", ver)
+		}
+	}
+
+	if _, val, _ := h.Get("a", hop.Any); string(val) != "0" {
+		t.Fatalf("written through: %q", val)
+	}
+
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ver, val, _ := h.Get("a", hop.Any)
+	if ver != 2 || string(val) != "5" {
+		t.Fatalf("after flush: version %d value %q", ver, val)
+	}
+}
+
+// An evicted dirty entry is being flushed when the key is set again. The
+// new value is written through and must not be overwritten by the flush.
+func TestWriteBackFlushInFlight(t *testing.T) {
+	h := &gateHop{SHop: shop.NewSHop(), value: []byte("old"), started: make(chan bool, 1), gate: make(chan bool)}
+	h.SHop.Create("a", "", []byte("0"))
+	h.SHop.Create("b", "", []byte("0"))
+	c := newWriteBack(t, h, 1)
+	defer c.Close()
+
+	c.Get("a", hop.Any)
+	if _, err := c.Set("a", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// evicts a, it waits in the pending entries
+	c.Get("b", hop.Any)
+	fdone := make(chan bool)
+	go func() {
+		c.Flush()
+		fdone <- true
+	}()
+
+	<-h.started
+
+	done := make(chan error)
+	go func() {
+		_, err := c.Set("a", []byte("new"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		close(h.gate)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		close(h.gate)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-fdone
+	if _, val, _ := h.SHop.Get("a", hop.Any); string(val) != "new" {
+		t.Fatalf("value %q, expected \"new\"", val)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chord
+
+import (
+	"hop"
+	"strings"
+)
+
+// Returns the node that stores the key, or nil if the key is one of the
+// local entries and the operation needs to go through the synchronous path.
+func (s *Chord) asyncNode(key string) *Node {
+	if strings.HasPrefix(key, "#/") {
+		return nil
+	}
+
+	return s.getNode(key)
+}
+
+// Checks if the node's connection was closed when the operation fails
+func (s *Chord) check(nd *Node, f *hop.Future) *hop.Future {
+	f.Then(func(f *hop.Future) {
+		if f.Err != nil {
+			// may close the connection, can't run on its receive goroutine
+			go s.checkClosed(nd)
+		}
+	})
+
+	return f
+}
+
+func (s *Chord) CreateAsync(key, flags string, value []byte) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, err := s.Create(key, flags, value)
+			return ver, nil, nil, err
+		})
+	}
+
+	return s.check(nd, hop.CreateAsync(nd.clnt, key, flags, value))
+}
+
+func (s *Chord) RemoveAsync(key string) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			return 0, nil, nil, s.Remove(key)
+		})
+	}
+
+	return s.check(nd, hop.RemoveAsync(nd.clnt, key))
+}
+
+func (s *Chord) GetAsync(key string, version uint64) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, val, err := s.Get(key, version)
+			return ver, val, nil, err
+		})
+	}
+
+	return s.check(nd, hop.GetAsync(nd.clnt, key, version))
+}
+
+func (s *Chord) SetAsync(key string, value []byte) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, err := s.Set(key, value)
+			return ver, nil, nil, err
+		})
+	}
+
+	return s.check(nd, hop.SetAsync(nd.clnt, key, value))
+}
+
+func (s *Chord) TestSetAsync(key string, oldversion uint64, oldvalue, value []byte) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, val, err := s.TestSet(key, oldversion, oldvalue, value)
+			return ver, val, nil, err
+		})
+	}
+
+	return s.check(nd, hop.TestSetAsync(nd.clnt, key, oldversion, oldvalue, value))
+}
+
+func (s *Chord) AtomicAsync(key string, op uint16, values [][]byte) *hop.Future {
+	nd := s.asyncNode(key)
+	if nd == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, vals, err := s.Atomic(key, op, values)
+			return ver, nil, vals, err
+		})
+	}
+
+	return s.check(nd, hop.AtomicAsync(nd.clnt, key, op, values))
+}
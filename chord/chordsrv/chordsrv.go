@@ -12,7 +12,10 @@ import (
 	"hop/rmt/hopclnt"
 	"hop/shop"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +24,7 @@ var addr = flag.String("addr", ":5004", "network address")
 var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
 var maddr = flag.String("maddr", "", "master address (master if empty)")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
@@ -36,9 +40,11 @@ func main() {
 
 	s.SetLogger(hop.NewLogger(*logsz))
 	s.SetDebugLevel(*debug)
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	<-sigs
+	log.Println("shutting down")
+	if err := s.Shutdown(*drain); err != nil {
+		log.Println(fmt.Sprintf("Error: %s", err))
 	}
-
-	return
 }
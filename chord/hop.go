@@ -46,8 +46,16 @@ func (s *Chord) Remove(key string) (err error) {
 	return
 }
 
+// The keys are not combined from all nodes, the #/keys entries fail
+// instead of returning the keys of the node that owns the entry name
+var Ekeys = errors.New("listing the keys of a Chord ring is not supported")
+
 func (s *Chord) Get(key string, version uint64) (ver uint64, val []byte, err error) {
 	if strings.HasPrefix(key, "#/") {
+		if key == "#/keys" || key == "#/keynum" || strings.HasPrefix(key, "#/keys:") {
+			return 0, nil, Ekeys
+		}
+
 /*		if strings.HasPrefix(key, "#/keys:") {
 			return s.keysentry.Get(key, version)
 		} else */ if strings.HasPrefix(key, "#/chord/successor:") {
@@ -247,19 +255,27 @@ func (e *PredEntry) Get(key string, version uint64) (ver uint64, val []byte, err
 }
 
 func (e *PredEntry) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
-	srv := e.s
-
 	if op!=PredAndNotify {
 		return 0, nil, errors.New("invalid atomic operation")
 	}
 
-	ver = hop.Lowest
-	vals = make([][]byte, 1)
-	val := string(values[0])
-	nd, err := srv.newNode(val)
+	pred, err := e.notify(string(values[0]))
 	if err != nil {
 		return 0, nil, err
 	}
+
+	return hop.Lowest, [][]byte{[]byte(pred)}, nil
+}
+
+// Tells the node that the node described by val might be its predecessor.
+// Returns the description of the predecessor before the call.
+func (e *PredEntry) notify(val string) (predval string, err error) {
+	srv := e.s
+
+	nd, err := srv.newNode(val)
+	if err != nil {
+		return "", err
+	}
 	
 	srv.Lock()
 	modified := false
@@ -305,15 +321,11 @@ func (e *PredEntry) Atomic(key string, op uint16, values [][]byte) (ver uint64,
 	}
 	srv.Unlock()
 
-	ver = hop.Lowest
-	vals = make([][]byte, 1)
 	if pred!=nil {
-		vals[0] = []byte(pred.String())
-	} else {
-		vals[0] = []byte{}
+		predval = pred.String()
 	}
 
-//	fmt.Printf("AtomicSet: %s return %s\n", val, string(vals[0]))
+//	fmt.Printf("AtomicSet: %s return %s\n", val, predval)
 	return
 }
 
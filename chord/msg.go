@@ -0,0 +1,236 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package chord
+
+import (
+	"fmt"
+	"hop"
+	"hop/rmt"
+	"hop/rmt/hopclnt"
+)
+
+// Chord messages
+//
+//	Tprednotify node[s]
+//	Rprednotify predecessor[s]
+//
+// Same as the PredAndNotify atomic operation on #/chord/predecessor, used
+// if the server supports it.
+//
+//	Thandoff key[s] flags[s] version[8] value[n]
+//	Rhandoff version[8]
+//
+// Stores the entry in the node's Hop, even if the node doesn't own the
+// key. Sent by the nodes that leave the ring to their successors.
+const (
+	Tprednotify = rmt.Textfirst + iota*2
+	Thandoff
+)
+
+const (
+	Rprednotify = Tprednotify + 1
+	Rhandoff    = Thandoff + 1
+)
+
+const prednotifyName = "chord.prednotify"
+const handoffName = "chord.handoff"
+
+func init() {
+	err := rmt.AddMsgType(Tprednotify, &rmt.MsgType{
+		Name:    prednotifyName,
+		UnpackT: unpackNode,
+		UnpackR: unpackNode,
+		StringT: func(m *rmt.Msg) string { return fmt.Sprintf("Tprednotify tag %d node '%s'", m.Tag, m.Ext) },
+		StringR: func(m *rmt.Msg) string { return fmt.Sprintf("Rprednotify tag %d predecessor '%s'", m.Tag, m.Ext) },
+		Serve:   servePredNotify,
+	})
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+
+	err = rmt.AddMsgType(Thandoff, &rmt.MsgType{
+		Name:    handoffName,
+		UnpackT: unpackThandoff,
+		UnpackR: unpackRhandoff,
+		StringT: func(m *rmt.Msg) string {
+			return fmt.Sprintf("Thandoff tag %d key '%s' flags '%s' version %d datalen %d", m.Tag, m.Key, m.Flags, m.Version, len(m.Value))
+		},
+		StringR: func(m *rmt.Msg) string { return fmt.Sprintf("Rhandoff tag %d version %d", m.Tag, m.Version) },
+		Serve:   serveHandoff,
+	})
+
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func packNode(m *rmt.Msg, mtype uint16, node string) error {
+	p, err := rmt.PackHeader(m, 2+len(node), mtype)
+	if err != nil {
+		return err
+	}
+
+	m.Ext = node
+	hop.Pstr(node, p)
+	return nil
+}
+
+func unpackNode(m *rmt.Msg, body []byte) error {
+	node, p := hop.Gstr(body)
+	if p == nil || len(p) > 0 {
+		return &rmt.Error{Edescr: "invalid size", Ecode: rmt.EINVAL}
+	}
+
+	m.Ext = node
+	return nil
+}
+
+func servePredNotify(ops hop.Hop, tc, rc *rmt.Msg) error {
+	s, ok := ops.(*Chord)
+	if !ok || !s.isServer() {
+		return &rmt.Error{Edescr: "not a chord server", Ecode: rmt.EINVAL}
+	}
+
+	pred, err := s.predentry.notify(tc.Ext.(string))
+	if err != nil {
+		return err
+	}
+
+	return packNode(rc, Rprednotify, pred)
+}
+
+// Tells the node that node self might be its predecessor and returns its
+// predecessor
+func (nd *Node) predAndNotify(self string) (pred string, err error) {
+	if clnt, ok := nd.clnt.(*hopclnt.Clnt); ok && clnt.Version().HasFeature(prednotifyName) {
+		var rc *rmt.Msg
+
+		c := clnt.Connection()
+		tc := c.GetOutbound()
+		if err = packNode(tc, Tprednotify, self); err != nil {
+			c.ReleaseOutbound(tc)
+			return
+		}
+
+		rc, err = clnt.Rpc(tc)
+		if rc != nil {
+			defer c.ReleaseInbound(rc)
+		}
+
+		if err == nil {
+			pred = rc.Ext.(string)
+		}
+
+		return
+	}
+
+	// the server doesn't support Tprednotify
+	_, vals, err := nd.clnt.Atomic("#/chord/predecessor", PredAndNotify, [][]byte{[]byte(self)})
+	if err == nil && len(vals) > 0 {
+		pred = string(vals[0])
+	}
+
+	return
+}
+
+func packThandoff(m *rmt.Msg, key, flags string, version uint64, value []byte) error {
+	p, err := rmt.PackHeader(m, 2+len(key)+2+len(flags)+8+4+len(value), Thandoff)
+	if err != nil {
+		return err
+	}
+
+	m.Key, m.Flags, m.Version, m.Value = key, flags, version, value
+	p = hop.Pstr(key, p)
+	p = hop.Pstr(flags, p)
+	p = hop.Pint64(version, p)
+	hop.Pblob(value, p)
+	return nil
+}
+
+func unpackThandoff(m *rmt.Msg, body []byte) error {
+	m.Key, body = hop.Gstr(body)
+	m.Flags, body = hop.Gstr(body)
+	if body == nil || len(body) < 8+4 {
+		return &rmt.Error{Edescr: "invalid size", Ecode: rmt.EINVAL}
+	}
+
+	m.Version, body = hop.Gint64(body)
+	m.Value, body = hop.Gblob(body)
+	if body == nil || len(body) > 0 {
+		return &rmt.Error{Edescr: "invalid size", Ecode: rmt.EINVAL}
+	}
+
+	return nil
+}
+
+func packRhandoff(m *rmt.Msg, version uint64) error {
+	p, err := rmt.PackHeader(m, 8, Rhandoff)
+	if err != nil {
+		return err
+	}
+
+	m.Version = version
+	hop.Pint64(version, p)
+	return nil
+}
+
+func unpackRhandoff(m *rmt.Msg, body []byte) error {
+	if len(body) != 8 {
+		return &rmt.Error{Edescr: "invalid size", Ecode: rmt.EINVAL}
+	}
+
+	m.Version, _ = hop.Gint64(body)
+	return nil
+}
+
+func serveHandoff(ops hop.Hop, tc, rc *rmt.Msg) error {
+	s, ok := ops.(*Chord)
+	if !ok || !s.isServer() {
+		return &rmt.Error{Edescr: "not a chord server", Ecode: rmt.EINVAL}
+	}
+
+	var err error
+
+	// keep the version if the Hop can, the existing entries are newer
+	ver := tc.Version
+	vh, ok := s.hop.(hop.VersionCreateHop)
+	if ok {
+		err = vh.CreateVersion(tc.Key, tc.Flags, ver, tc.Value)
+	} else {
+		ver, err = s.hop.Create(tc.Key, tc.Flags, tc.Value)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return packRhandoff(rc, ver)
+}
+
+// Stores the entry in the node's Hop. Fails with hop.Eexist if the entry
+// exists.
+func (nd *Node) handoff(key, flags string, version uint64, value []byte) (err error) {
+	var rc *rmt.Msg
+
+	clnt, ok := nd.clnt.(*hopclnt.Clnt)
+	if !ok || !clnt.Version().HasFeature(handoffName) {
+		return &rmt.Error{Edescr: "handoff not supported by " + nd.addr, Ecode: rmt.ENOSYS}
+	}
+
+	c := clnt.Connection()
+	tc := c.GetOutbound()
+	if err = packThandoff(tc, key, flags, version, value); err != nil {
+		c.ReleaseOutbound(tc)
+		return
+	}
+
+	rc, err = clnt.Rpc(tc)
+	if rc != nil {
+		c.ReleaseInbound(rc)
+	}
+
+	return
+}
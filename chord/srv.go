@@ -223,6 +223,11 @@ func (s *Chord) getNode(key string) *Node {
 	return nd
 }
 
+// Returns the address of the node that stores the key
+func (s *Chord) Owner(key string) string {
+	return s.getNode(key).addr
+}
+
 // From the Chord paper:
 // n.find_successor(id)
 // 	if (key belongs to (n, n.successor])
@@ -462,16 +467,7 @@ func (s *Chord) updateNotify(pred, succ *Node) (newpred, newsucc *Node, again bo
 	var nd *Node
 
 	if s.isServer() {
-		_, vals, err := succ.clnt.Atomic("#/chord/predecessor", PredAndNotify,
-			[][]byte{[]byte(s.self.String())})
-
-		if err == nil {
-			if vals==nil || len(vals[0]) == 0 {
-				return
-			}
-
-			ndval = string(vals[0])
-		}
+		ndval, err = succ.predAndNotify(s.self.String())
 	} else {
 		var val []byte
 
@@ -726,6 +722,10 @@ func (s *Chord) Connection() rmt.Conn {
 func (s *Chord) Close() {
 	s.Lock()
 	for _, c := range s.finger {
+		if c == nil {
+			continue
+		}
+
 		if rhop, ok := c.clnt.(rmt.RemoteHop); ok {
 			rhop.Close()
 		}
@@ -733,7 +733,67 @@ func (s *Chord) Close() {
 	s.closed = true
 	s.Unlock()
 
-	// TODO: stop listening?
+	if s.srv != nil {
+		s.srv.Shutdown(0)
+	}
+}
+
+// Shuts the node down and leaves the ring. Stops accepting requests and
+// waits up to timeout for the requests in flight, the blocked Gets fail
+// with hopsrv.Eshutdown. Then hands the node's entries off to its
+// successor, which owns their keys after the node is gone, and closes the
+// connections so the other nodes repair the ring.
+func (s *Chord) Shutdown(timeout time.Duration) (err error) {
+	if !s.isServer() {
+		s.Close()
+		return
+	}
+
+	s.srv.Stop()
+	err = s.srv.Wait(timeout)
+
+	s.RLock()
+	succ := s.finger[0]
+	s.RUnlock()
+	if succ != nil && succ != &s.self {
+		if e := s.handoff(succ); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	s.Close()
+	return
+}
+
+// Copies the node's entries to the successor, skipping the entries the
+// successor already has
+func (s *Chord) handoff(succ *Node) (err error) {
+	_, keys, err := s.hop.Get("#/keys", hop.Any)
+	if err != nil {
+		return
+	}
+
+	for _, k := range strings.Split(string(keys), "\x00") {
+		if k == "" || strings.HasPrefix(k, "#/") {
+			continue
+		}
+
+		ver, val, e := s.hop.Get(k, hop.Any)
+		if e != nil || ver == 0 {
+			continue
+		}
+
+		flags := ""
+		if st, e := hop.GetStat(s.hop, k); e == nil && st != nil {
+			flags = st.Flags
+		}
+
+		if e = succ.handoff(k, flags, ver, val); e != nil && !rmt.IsError(e, hop.Eexist) {
+			err = e
+		}
+	}
+
+	return
 }
 
 func (s *Chord) Closed() bool {
@@ -0,0 +1,123 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package d2hop
+
+import (
+	"hop"
+	"strings"
+	"time"
+)
+
+// Returns the connection to the remote server that owns the key, or nil if
+// the operation needs to go through the synchronous path: the local
+// entries, and the keys stored on this server that may need replication.
+func (s *D2Hop) asyncServer(key string) *Conn {
+	if strings.HasPrefix(key, "#/") {
+		return nil
+	}
+
+	c := s.getServer(key)
+	if c == nil || c == s.selfconn || c.clnt == nil {
+		return nil
+	}
+
+	return c
+}
+
+// Updates the server's alive time when the operation succeeds
+func touch(c *Conn, f *hop.Future) *hop.Future {
+	f.Then(func(f *hop.Future) {
+		if f.Err == nil {
+			c.alive = time.Now()
+		}
+	})
+
+	return f
+}
+
+func (s *D2Hop) CreateAsync(key, flags string, value []byte) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, err := s.Create(key, flags, value)
+			return ver, nil, nil, err
+		})
+	}
+
+	return touch(c, hop.CreateAsync(c.clnt, key, flags, value))
+}
+
+func (s *D2Hop) RemoveAsync(key string) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			return 0, nil, nil, s.Remove(key)
+		})
+	}
+
+	return touch(c, hop.RemoveAsync(c.clnt, key))
+}
+
+func (s *D2Hop) GetAsync(key string, version uint64) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, val, err := s.Get(key, version)
+			return ver, val, nil, err
+		})
+	}
+
+	f := hop.NewFuture()
+	touch(c, hop.GetAsync(c.clnt, key, version)).Then(func(gf *hop.Future) {
+		if !unreachable(gf.Err) {
+			f.Complete(gf.Version, gf.Value, nil, gf.Err)
+			return
+		}
+
+		// the replicas are read synchronously, not from the callback
+		go func() {
+			ver, val, err := s.getReplica(c, key, version, gf.Err)
+			f.Complete(ver, val, nil, err)
+		}()
+	})
+
+	return f
+}
+
+func (s *D2Hop) SetAsync(key string, value []byte) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, err := s.Set(key, value)
+			return ver, nil, nil, err
+		})
+	}
+
+	return touch(c, hop.SetAsync(c.clnt, key, value))
+}
+
+func (s *D2Hop) TestSetAsync(key string, oldversion uint64, oldvalue, value []byte) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, val, err := s.TestSet(key, oldversion, oldvalue, value)
+			return ver, val, nil, err
+		})
+	}
+
+	return touch(c, hop.TestSetAsync(c.clnt, key, oldversion, oldvalue, value))
+}
+
+func (s *D2Hop) AtomicAsync(key string, op uint16, values [][]byte) *hop.Future {
+	c := s.asyncServer(key)
+	if c == nil {
+		return hop.GoFuture(func() (uint64, []byte, [][]byte, error) {
+			ver, vals, err := s.Atomic(key, op, values)
+			return ver, nil, vals, err
+		})
+	}
+
+	return touch(c, hop.AtomicAsync(c.clnt, key, op, values))
+}
@@ -229,7 +229,7 @@ func main() {
 		h = shop.NewSHop()
 	}
 
-	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, h)
+	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, h, nil)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		return
@@ -12,7 +12,10 @@ import (
 	"hop/rmt/hopclnt"
 	"hop/shop"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -21,14 +24,21 @@ var addr = flag.String("addr", ":5004", "network address")
 var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
 var maddr = flag.String("maddr", "", "master address (master if empty)")
+var journal = flag.Uint64("journal", 0, "keep a journal of the modifications of up to that many bytes")
+var journalage = flag.Duration("journalage", 0, "maximum age of the journal records")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	hopclnt.DefaultDebuglevel = *debug
 
-	shop := shop.NewSHop()
-	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, shop)
+	h := hop.Hop(shop.NewSHop())
+	if *journal != 0 || *journalage != 0 {
+		h = hop.NewJHop(h, *journal, *journalage)
+	}
+
+	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, h, nil)
 	if err != nil {
 		log.Println(fmt.Sprintf("Error: %s", err))
 		return
@@ -36,9 +46,11 @@ func main() {
 
 	s.SetLogger(hop.NewLogger(*logsz))
 	s.SetDebugLevel(*debug)
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	<-sigs
+	log.Println("shutting down")
+	if err := s.Shutdown(*drain); err != nil {
+		log.Println(fmt.Sprintf("Error: %s", err))
 	}
-
-	return
 }
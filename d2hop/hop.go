@@ -25,19 +25,45 @@ type StackEntry LocalEntry
 
 func (c *Conn) Create(key, flags string, value []byte) (version uint64, err error) {
 	c.alive = time.Now()
+	if c.srv.isServer() && strings.HasPrefix(key, replicaPrefix) {
+		return c.srv.hop.Create(key[len(replicaPrefix):], flags, value)
+	} else if c.srv.isServer() && strings.HasPrefix(key, handoffPrefix) {
+		return c.srv.createHandoff(key[len(handoffPrefix):], flags, value)
+	}
+
 	return c.srv.Create(key, flags, value)
 }
 
 func (c *Conn) Remove(key string) (err error) {
 	c.alive = time.Now()
+	if c.srv.isServer() && strings.HasPrefix(key, replicaPrefix) {
+		return c.srv.hop.Remove(key[len(replicaPrefix):])
+	}
+
 	return c.srv.Remove(key)
 }
 
 func (c *Conn) Get(key string, version uint64) (ver uint64, val []byte, err error) {
 	c.alive = time.Now()
+	if c.srv.isServer() && strings.HasPrefix(key, replicaPrefix) {
+		return c.srv.hop.Get(key[len(replicaPrefix):], version)
+	} else if c.srv.isServer() && strings.HasPrefix(key, "#/journal") {
+		// the journal of this server's Hop (see hop.JHop)
+		return c.srv.hop.Get(key, version)
+	}
+
 	return c.srv.Get(key, version)
 }
 
+func (c *Conn) Stat(key string) (st *hop.Stat, err error) {
+	c.alive = time.Now()
+	if c.srv.isServer() && strings.HasPrefix(key, replicaPrefix) {
+		return hop.GetStat(c.srv.hop, key[len(replicaPrefix):])
+	}
+
+	return c.srv.Stat(key)
+}
+
 func (c *Conn) Set(key string, value []byte) (ver uint64, err error) {
 	c.alive = time.Now()
 	if c.srv.isServer() && key == "#/ctl" {
@@ -45,6 +71,8 @@ func (c *Conn) Set(key string, value []byte) (ver uint64, err error) {
 		err = c.srv.ctl(c, string(value))
 		ver = hop.Lowest
 		return
+	} else if c.srv.isServer() && strings.HasPrefix(key, replicaPrefix) {
+		return c.srv.hop.Set(key[len(replicaPrefix):], value)
 	}
 
 	return c.srv.Set(key, value)
@@ -65,15 +93,28 @@ func (s *D2Hop) Create(key, flags string, value []byte) (version uint64, err err
 	version, err = c.clnt.Create(key, flags, value)
 	if err == nil {
 		c.alive = time.Now()
+		if c == s.selfconn && version != 0 {
+			s.replicate(key, flags, true)
+		}
 	}
 	return
 }
 
 func (s *D2Hop) Remove(key string) (err error) {
+	var flags *hop.Flags
+
 	c := s.getServer(key)
+	if c == s.selfconn {
+		// the flags are gone after the entry is removed
+		flags, _ = hop.GetFlags(s.hop, key)
+	}
+
 	err = c.clnt.Remove(key)
 	if err == nil {
 		c.alive = time.Now()
+		if flags != nil && flags.Replicas > 1 {
+			s.removeReplicas(key, flags.Replicas)
+		}
 	}
 	return
 }
@@ -95,6 +136,17 @@ func (s *D2Hop) Get(key string, version uint64) (ver uint64, val []byte, err err
 
 	c := s.getServer(key)
 	ver, val, err = c.clnt.Get(key, version)
+	if err == nil {
+		c.alive = time.Now()
+	} else if c != s.selfconn && unreachable(err) {
+		return s.getReplica(c, key, version, err)
+	}
+	return
+}
+
+func (s *D2Hop) Stat(key string) (st *hop.Stat, err error) {
+	c := s.getServer(key)
+	st, err = hop.GetStat(c.clnt, key)
 	if err == nil {
 		c.alive = time.Now()
 	}
@@ -105,7 +157,7 @@ func (s *D2Hop) Set(key string, value []byte) (ver uint64, err error) {
 	if strings.HasPrefix(key, "#/") {
 		// first try the local entries
 		ver, err = s.lents.Set(key, value)
-		if err == nil || err != hop.Enoent {
+		if (err == nil && ver != 0) || (err != nil && err != hop.Enoent) {
 			return
 		}
 	}
@@ -114,6 +166,9 @@ func (s *D2Hop) Set(key string, value []byte) (ver uint64, err error) {
 	ver, err = c.clnt.Set(key, value)
 	if err == nil {
 		c.alive = time.Now()
+		if c == s.selfconn && ver != 0 {
+			s.replicate(key, "", false)
+		}
 	}
 	return
 }
@@ -122,7 +177,7 @@ func (s *D2Hop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 	if strings.HasPrefix(key, "#/") {
 		// first try the local entries
 		ver, val, err = s.lents.TestSet(key, oldversion, oldvalue, value)
-		if err == nil || err != hop.Enoent {
+		if (err == nil && ver != 0) || (err != nil && err != hop.Enoent) {
 			return
 		}
 	}
@@ -131,6 +186,9 @@ func (s *D2Hop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 	ver, val, err = c.clnt.TestSet(key, oldversion, oldvalue, value)
 	if err == nil {
 		c.alive = time.Now()
+		if c == s.selfconn && ver != 0 {
+			s.replicate(key, "", false)
+		}
 	}
 	return
 }
@@ -139,7 +197,7 @@ func (s *D2Hop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals
 	if strings.HasPrefix(key, "#/") {
 		// first try the local entries
 		ver, vals, err = s.lents.Atomic(key, op, values)
-		if err == nil || err != hop.Enoent {
+		if (err == nil && ver != 0) || (err != nil && err != hop.Enoent) {
 			return
 		}
 	}
@@ -148,6 +206,9 @@ func (s *D2Hop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals
 	ver, vals, err = c.clnt.Atomic(key, op, values)
 	if err == nil {
 		c.alive = time.Now()
+		if c == s.selfconn && ver != 0 {
+			s.replicate(key, "", false)
+		}
 	}
 	return
 }
@@ -173,7 +234,7 @@ func (e *ConfEntry) Atomic(key string, op uint16, values [][]byte) (ver uint64,
 		s.masterAddServer(string(value))
 
 	case hop.Remove:
-		err = s.masterRemoveServer(string(value))
+		err = s.masterRemoveServer(string(value), false)
 
 	default:
 		return 0, nil, hop.Eperm
@@ -0,0 +1,149 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package d2hop
+
+import (
+	"hop"
+	"hop/rmt"
+	"strings"
+	"time"
+)
+
+// Replication
+//
+// If an entry is created with the replicas=<n> flag (see hop.Flags), the
+// server that owns the key keeps copies of the entry on the n-1 servers
+// that follow it in the routing table. After each modification, the owner
+// sends the new value to the replicas. The copies are sent with the
+// #/replica/ prefix, which makes the receiving server store them in its
+// local Hop instead of routing them. The reads are served by the owner,
+// or by the first replica that has the entry if the owner can't be
+// reached. The replicas are updated on a best-effort basis, the errors are
+// ignored, so a value read from a replica may be stale.
+
+const replicaPrefix = "#/replica/"
+
+// The entries handed off by a leaving server are created with the key
+// handoffPrefix + version/key
+const handoffPrefix = "#/handoff/"
+
+// Returns the key that is used to select the server
+func routeKey(key string) string {
+	if strings.HasPrefix(key, hop.FlagsPrefix) {
+		return key[len(hop.FlagsPrefix):]
+	}
+
+	return hop.HistoryKey(key)
+}
+
+// Returns up to n servers that follow this server in the routing table
+func (s *D2Hop) replicas(n int) (rs []*Conn) {
+	return s.followers(s.selfconn, n)
+}
+
+// Returns up to n servers (all if n is negative) that follow the server
+// of the connection in the routing table
+func (s *D2Hop) followers(c *Conn, n int) (rs []*Conn) {
+	s.RLock()
+	defer s.RUnlock()
+
+	idx := -1
+	for i, r := range s.routes {
+		if r.conn == c {
+			idx = i
+			break
+		}
+	}
+
+	if idx < 0 {
+		return
+	}
+
+	seen := map[*Conn]bool{c: true}
+	for i := 1; i < len(s.routes) && (n < 0 || len(rs) < n); i++ {
+		c := s.routes[(idx+i)%len(s.routes)].conn
+		if c != nil && !seen[c] {
+			seen[c] = true
+			rs = append(rs, c)
+		}
+	}
+
+	return
+}
+
+// Sends the current value of the entry to its replicas. If create is true,
+// the entry was just created with the specified flags, otherwise the flags
+// are read from the local Hop.
+func (s *D2Hop) replicate(key, flags string, create bool) {
+	var f *hop.Flags
+	var err error
+
+	if create {
+		f, err = hop.ParseFlags(flags)
+	} else {
+		f, err = hop.GetFlags(s.hop, key)
+	}
+
+	if err != nil || f.Replicas < 2 {
+		return
+	}
+
+	ver, val, err := s.hop.Get(key, hop.Any)
+	if err != nil || ver == 0 {
+		return
+	}
+
+	for _, c := range s.replicas(f.Replicas - 1) {
+		rkey := replicaPrefix + key
+		if !create {
+			if ver, err := c.clnt.Set(rkey, val); err == nil && ver != 0 {
+				continue
+			}
+		}
+
+		// the replica doesn't have the entry yet
+		c.clnt.Create(rkey, f.String(), val)
+	}
+}
+
+// Returns true if the error didn't come from the server, i.e. the server
+// couldn't be reached
+func unreachable(err error) bool {
+	_, ok := err.(*rmt.Error)
+	return err != nil && !ok
+}
+
+// Reads the entry from the replicas after its owner couldn't be reached.
+// The replicas are the servers that follow the owner, so the search stops
+// at the first server that doesn't have the entry. Returns the error from
+// the owner if no replica has the entry.
+func (s *D2Hop) getReplica(owner *Conn, key string, version uint64, oerr error) (ver uint64, val []byte, err error) {
+	for _, c := range s.followers(owner, -1) {
+		if c == s.selfconn {
+			ver, val, err = s.hop.Get(key, version)
+		} else if c.clnt != nil {
+			ver, val, err = c.clnt.Get(replicaPrefix+key, version)
+		} else {
+			continue
+		}
+
+		if err == nil && ver != 0 {
+			c.alive = time.Now()
+			return
+		}
+
+		if !unreachable(err) {
+			break
+		}
+	}
+
+	return 0, nil, oerr
+}
+
+func (s *D2Hop) removeReplicas(key string, n int) {
+	for _, c := range s.replicas(n - 1) {
+		c.clnt.Remove(replicaPrefix + key)
+	}
+}
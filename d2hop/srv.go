@@ -5,6 +5,7 @@
 package d2hop
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"hop"
@@ -13,6 +14,7 @@ import (
 	"hop/rmt/hopsrv"
 	"hop/shop"
 	"math"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -91,7 +93,7 @@ func NewD2Hop(proto, listenaddr, masteraddr string, hop hop.Hop, hashes []Hash)
 }
 
 func Connect(proto, addr string) (*D2Hop, error) {
-	return NewD2Hop(proto, "", addr, nil)
+	return NewD2Hop(proto, "", addr, nil, nil)
 }
 
 func (s *D2Hop) startServer() error {
@@ -251,7 +253,7 @@ func (s *D2Hop) isMaster() bool {
 }
 
 func (s *D2Hop) getServer(key string) *Conn {
-	hash := s.keyhash.Hash(key)
+	hash := s.keyhash.Hash(routeKey(key))
 
 	s.RLock()
 	defer s.RUnlock()
@@ -260,6 +262,15 @@ func (s *D2Hop) getServer(key string) *Conn {
 	return r.conn
 }
 
+// Returns the address of the server that owns the key
+func (s *D2Hop) Owner(key string) string {
+	hash := s.keyhash.Hash(routeKey(key))
+
+	s.RLock()
+	defer s.RUnlock()
+	return s.routes.Search(hash).addr
+}
+
 func (s *D2Hop) masterAddServer(addr string) {
 	var r Range
 
@@ -275,8 +286,13 @@ func (s *D2Hop) masterAddServer(addr string) {
 	s.confentry.SetLocked([]byte(confstr))
 }
 
-func (s *D2Hop) masterRemoveServer(addr string) error {
+// Removes the server from the configuration. If leave is true, the server
+// is leaving the cluster: its ranges are added to the neighboring ones, so
+// the ranges of the other servers don't move, and the server closes the
+// connection after it hands its entries off.
+func (s *D2Hop) masterRemoveServer(addr string, leave bool) error {
 	var routes RangeList
+	var confstr string
 
 	s.Lock()
 	h := s.srvmap[addr]
@@ -294,28 +310,53 @@ func (s *D2Hop) masterRemoveServer(addr string) error {
 		}
 	}
 
-	for i, _ := range s.conf.routes {
-		r := &s.conf.routes[i]
-		if r.addr != addr {
-			routes = append(routes, *r)
+	if leave {
+		routes = leaveRoutes(s.conf.routes, addr)
+	} else {
+		for _, r := range s.conf.routes {
+			if r.addr != addr {
+				routes = append(routes, r)
+			}
 		}
 	}
 
 	s.conf.routes = routes
 	s.conf.srvnum--
 	delete(s.srvmap, addr)
-	confstr := s.masterUpdateConf()
+	if leave {
+		confstr = s.masterConfString()
+	} else {
+		confstr = s.masterUpdateConf()
+	}
 	s.Unlock()
 
 	// tell everybody waiting that there is new configuration
 	s.confentry.SetLocked([]byte(confstr))
-	if rhop, ok := h.clnt.(rmt.RemoteHop); ok {
+	if rhop, ok := h.clnt.(rmt.RemoteHop); ok && !leave {
 		rhop.Close()
 	}
 
 	return nil
 }
 
+// Returns the routes after the server leaves. Its ranges are merged into
+// the preceding ranges, so the keys of the other servers don't move.
+func leaveRoutes(routes RangeList, addr string) (nroutes RangeList) {
+	for _, r := range routes {
+		if r.addr != addr {
+			nroutes = append(nroutes, r)
+		} else if len(nroutes) > 0 {
+			nroutes[len(nroutes)-1].end = r.end
+		}
+	}
+
+	if len(nroutes) > 0 {
+		nroutes[0].start = 0
+	}
+
+	return
+}
+
 // called with s lock held
 func (s *D2Hop) masterUpdateConf() string {
 	conf := s.conf
@@ -327,9 +368,15 @@ func (s *D2Hop) masterUpdateConf() string {
 	}
 
 	conf.routes[len(conf.routes)-1].end = math.MaxUint32
+	return s.masterConfString()
+}
+
+// called with s lock held
+func (s *D2Hop) masterConfString() string {
+	conf := s.conf
 	s.routes = conf.routes
 
-	c := fmt.Sprintf("%s %d\n", s.addr, n)
+	c := fmt.Sprintf("%s %d\n", s.addr, len(conf.routes))
 	for _, r := range conf.routes {
 		c += fmt.Sprintf("%s %d:%d\n", r.addr, r.start, r.end)
 	}
@@ -530,7 +577,7 @@ func (s *D2Hop) ConnClosed(c *hopsrv.Conn) {
 	s.RUnlock()
 
 	if addr != "" {
-		s.masterRemoveServer(addr)
+		s.masterRemoveServer(addr, false)
 	}
 
 }
@@ -552,6 +599,12 @@ func (s *D2Hop) ctl(c *Conn, cmd string) error {
 		s.Unlock()
 
 		return nil
+	} else if strings.HasPrefix(cmd, "leave ") {
+		if !s.isMaster() {
+			return errors.New("not the master")
+		}
+
+		return s.masterRemoveServer(cmd[6:], true)
 	} else {
 		return errors.New("unknown command")
 	}
@@ -584,5 +637,114 @@ func (s *D2Hop) Close() {
 	s.closed = true
 	s.Unlock()
 
-	// TODO: stop listening?
+	if s.srv != nil {
+		s.srv.Shutdown(0)
+	}
+}
+
+// Shuts the server down. Stops accepting requests and waits up to timeout
+// for the requests in flight, the blocked Gets fail with hopsrv.Eshutdown.
+// A server other than the master then copies its entries to the servers
+// its ranges are merged into, and leaves the cluster. Shutting the master
+// down stops the cluster.
+func (s *D2Hop) Shutdown(timeout time.Duration) (err error) {
+	if !s.isServer() {
+		s.Close()
+		return
+	}
+
+	// the ranges the server owns before it leaves
+	s.RLock()
+	routes := s.routes
+	s.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+	s.srv.Stop()
+	err = s.srv.Wait(deadline.Sub(time.Now()))
+	if !s.isMaster() {
+		// the keys are handed off before the master publishes the new
+		// configuration, so the clients can't modify them on the new
+		// owners in the meantime
+		if e := s.handoff(routes, leaveRoutes(routes, s.addr)); e != nil && err == nil {
+			err = e
+		}
+
+		if _, e := s.master.Set("#/ctl", []byte("leave "+s.addr)); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	s.Close()
+	return
+}
+
+// Copies the entries the server owns in routes to their owners in
+// nroutes. The entries that already exist on the new owner are skipped.
+func (s *D2Hop) handoff(routes, nroutes RangeList) (err error) {
+	_, keys, err := s.hop.Get("#/keys", hop.Any)
+	if err != nil {
+		return
+	}
+
+	for _, k := range bytes.Split(keys, []byte{0}) {
+		key := string(k)
+		if key == "" || strings.HasPrefix(key, "#/") {
+			continue
+		}
+
+		hash := s.keyhash.Hash(routeKey(key))
+		if routes.Search(hash).addr != s.addr {
+			// a replica, the owner keeps it
+			continue
+		}
+
+		s.RLock()
+		c := s.srvmap[nroutes.Search(hash).addr]
+		s.RUnlock()
+		if c == nil || c.clnt == nil {
+			err = errors.New("no connection to the new owner of " + key)
+			continue
+		}
+
+		ver, val, e := s.hop.Get(key, hop.Any)
+		if e != nil || ver == 0 {
+			continue
+		}
+
+		flags := ""
+		if st, e := hop.GetStat(s.hop, key); e == nil && st != nil {
+			flags = st.Flags
+		}
+
+		// stored directly in the owner's Hop, keeping the version
+		_, e = c.clnt.Create(fmt.Sprintf("%s%d/%s", handoffPrefix, ver, key), flags, val)
+		if e != nil && !rmt.IsError(e, hop.Eexist) {
+			err = e
+		}
+	}
+
+	return
+}
+
+// Creates the entry handed off by a leaving server. The key is
+// version/key. If the Hop can't create entries with a version, the
+// version starts again.
+func (s *D2Hop) createHandoff(key, flags string, value []byte) (ver uint64, err error) {
+	n := strings.Index(key, "/")
+	if n < 0 {
+		return 0, hop.Eperm
+	}
+
+	ver, err = strconv.ParseUint(key[0:n], 10, 64)
+	if err != nil {
+		return 0, hop.Eperm
+	}
+
+	key = key[n+1:]
+	if vh, ok := s.hop.(hop.VersionCreateHop); ok {
+		err = vh.CreateVersion(key, flags, ver, value)
+		return
+	}
+
+	return s.hop.Create(key, flags, value)
 }
@@ -0,0 +1,551 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package erasure implements a Hop that stores the values Reed-Solomon
+// encoded in k data and m parity shards, so they survive the loss of up to
+// m shards at the storage cost of (k+m)/k.
+//
+// ECHop keeps a small descriptor of the value in the entry itself:
+//
+//	k[1] m[1] size[8] gen[s] k+m * (salt[2] crc32[4])
+//
+// and the shards in the entries
+//
+//	<prefix><key>/<gen>/<index>.<salt>
+//
+// gen is unique for each value, so the shards are never modified. If the
+// underlying Hop implements hop.OwnerHop (D2Hop, Chord), the salts are
+// chosen so the shards of a value land on different servers, as long as
+// there are enough of them. A new value is written to new shards first and
+// published by replacing the descriptor with TestSet, then the shards of
+// the old value are removed.
+//
+// The reads fetch the shards in parallel and reconstruct the value if some
+// of them are missing or don't match their checksums. Repair regenerates
+// the lost shards. The #/ entries are passed to the underlying Hop as they
+// are, so the key listings include the shard entries.
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hop"
+	"hop/rmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ECHop struct {
+	h      hop.Hop
+	rs     *RS
+	prefix string
+}
+
+// Descriptor of an encoded value
+type desc struct {
+	k, m  int
+	size  uint64
+	gen   string
+	salts []uint16
+	crcs  []uint32
+}
+
+var Elost = errors.New("too many shards lost")
+var Edesc = errors.New("invalid erasure code descriptor")
+var Econflict = errors.New("value modified concurrently")
+
+// maximum number of salts tried to find a server for a shard
+const maxSalt = 64
+
+var genlock sync.Mutex
+var genrand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Creates a Hop that stores the values of h encoded in k data and m parity
+// shards. The shard entries are created with the prefix.
+func NewECHop(h hop.Hop, k, m int, prefix string) (*ECHop, error) {
+	rs, err := NewRS(k, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECHop{h, rs, prefix}, nil
+}
+
+func newGen() string {
+	genlock.Lock()
+	r := genrand.Uint32()
+	genlock.Unlock()
+
+	return fmt.Sprintf("%x%08x", time.Now().UnixNano(), r)
+}
+
+func (e *ECHop) shardKey(key string, d *desc, idx int) string {
+	return fmt.Sprintf("%s%s/%s/%d.%d", e.prefix, key, d.gen, idx, d.salts[idx])
+}
+
+func (d *desc) pack() []byte {
+	buf := make([]byte, 1+1+8+2+len(d.gen)+len(d.salts)*(2+4))
+	p := hop.Pint8(uint8(d.k), buf)
+	p = hop.Pint8(uint8(d.m), p)
+	p = hop.Pint64(d.size, p)
+	p = hop.Pstr(d.gen, p)
+	for i := range d.salts {
+		p = hop.Pint16(d.salts[i], p)
+		p = hop.Pint32(d.crcs[i], p)
+	}
+
+	return buf
+}
+
+func unpackDesc(buf []byte) (d *desc, err error) {
+	var k, m uint8
+
+	if len(buf) < 1+1+8+2 {
+		return nil, Edesc
+	}
+
+	d = new(desc)
+	k, buf = hop.Gint8(buf)
+	m, buf = hop.Gint8(buf)
+	d.k, d.m = int(k), int(m)
+	d.size, buf = hop.Gint64(buf)
+	d.gen, buf = hop.Gstr(buf)
+	if buf == nil || len(buf) != (d.k+d.m)*(2+4) {
+		return nil, Edesc
+	}
+
+	d.salts = make([]uint16, d.k+d.m)
+	d.crcs = make([]uint32, d.k+d.m)
+	for i := range d.salts {
+		d.salts[i], buf = hop.Gint16(buf)
+		d.crcs[i], buf = hop.Gint32(buf)
+	}
+
+	return
+}
+
+// Chooses the salts of the shard keys so the shards are spread evenly
+// across the servers: each shard goes to a server without shards if the
+// salts reach one, otherwise to the least loaded one
+func (e *ECHop) place(key string, d *desc) {
+	n := e.rs.k + e.rs.m
+	d.salts = make([]uint16, n)
+	oh, ok := e.h.(hop.OwnerHop)
+	if !ok {
+		return
+	}
+
+	count := make(map[string]int)
+	for i := 0; i < n; i++ {
+		var best uint16
+		var bowner string
+
+		bcount := -1
+		for salt := uint16(0); salt < maxSalt; salt++ {
+			d.salts[i] = salt
+			owner := oh.Owner(e.shardKey(key, d, i))
+			c, ok := count[owner]
+			if bcount < 0 || c < bcount {
+				best, bowner, bcount = salt, owner, c
+			}
+
+			if !ok {
+				break
+			}
+		}
+
+		d.salts[i] = best
+		count[bowner]++
+	}
+}
+
+// Encodes the value and creates its shards in parallel. Returns the
+// descriptor of the value.
+func (e *ECHop) writeShards(key string, value []byte) (d *desc, err error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	d = &desc{k: e.rs.k, m: e.rs.m, size: uint64(len(value)), gen: newGen()}
+	e.place(key, d)
+	shards := e.rs.Split(value)
+	d.crcs = make([]uint32, len(shards))
+	for i, s := range shards {
+		d.crcs[i] = crc32.ChecksumIEEE(s)
+	}
+
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err1 := e.h.Create(e.shardKey(key, d, i), "", shards[i]); err1 != nil {
+				lock.Lock()
+				err = err1
+				lock.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	if err != nil {
+		e.removeShards(key, d)
+		return nil, err
+	}
+
+	return
+}
+
+// Reads the shards in parallel. The shards that can't be read (e.g. their
+// server is down) and the ones with invalid checksums are nil. Returns an
+// error only if fewer than k shards are usable and some of the reads
+// failed with something other than Enoent.
+func (e *ECHop) readShards(key string, d *desc) (shards [][]byte, err error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	n := 0
+	shards = make([][]byte, d.k+d.m)
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ver, val, err1 := e.h.Get(e.shardKey(key, d, i), hop.Any)
+			lock.Lock()
+			defer lock.Unlock()
+			if err1 != nil {
+				if err == nil && !rmt.IsError(err1, hop.Enoent) {
+					err = err1
+				}
+			} else if ver != 0 && crc32.ChecksumIEEE(val) == d.crcs[i] {
+				shards[i] = val
+				n++
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	if n >= d.k {
+		err = nil
+	}
+
+	return
+}
+
+// Removes the shards of the value, ignoring the errors
+func (e *ECHop) removeShards(key string, d *desc) {
+	var wg sync.WaitGroup
+
+	for i := range d.salts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e.h.Remove(e.shardKey(key, d, i))
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func (e *ECHop) decode(key string, d *desc) (val []byte, err error) {
+	if d.k != e.rs.k || d.m != e.rs.m {
+		// encoded by ECHop with different parameters
+		rs, err := NewRS(d.k, d.m)
+		if err != nil {
+			return nil, err
+		}
+
+		return (&ECHop{e.h, rs, e.prefix}).decode(key, d)
+	}
+
+	shards, err := e.readShards(key, d)
+	if err != nil {
+		return
+	}
+
+	if err = e.rs.Reconstruct(shards); err == Eshards {
+		return nil, Elost
+	} else if err != nil {
+		return
+	}
+
+	return e.rs.Join(shards, d.size)
+}
+
+// Replaces the descriptor with version ver and value oldval with the new
+// one. Not all Hops report the failed TestSet the same way, so checks if
+// the descriptor is ours.
+func (e *ECHop) publish(key string, ver uint64, oldval []byte, d *desc) (nver uint64, err error) {
+	val := d.pack()
+	if _, _, err = e.h.TestSet(key, ver, oldval, val); err != nil {
+		return
+	}
+
+	nver, nval, err := e.h.Get(key, hop.Any)
+	if err != nil {
+		return
+	}
+
+	if nver == 0 || !bytes.Equal(nval, val) {
+		return 0, Econflict
+	}
+
+	return
+}
+
+func (e *ECHop) Create(key, flags string, value []byte) (ver uint64, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.Create(key, flags, value)
+	}
+
+	d, err := e.writeShards(key, value)
+	if err != nil {
+		return
+	}
+
+	if ver, err = e.h.Create(key, flags, d.pack()); err != nil {
+		e.removeShards(key, d)
+	}
+
+	return
+}
+
+func (e *ECHop) Remove(key string) (err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.Remove(key)
+	}
+
+	ver, val, err := e.h.Get(key, hop.Any)
+	if err != nil {
+		return
+	}
+
+	if err = e.h.Remove(key); err != nil {
+		return
+	}
+
+	if ver != 0 {
+		if d, err := unpackDesc(val); err == nil {
+			e.removeShards(key, d)
+		}
+	}
+
+	return
+}
+
+func (e *ECHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.Get(key, version)
+	}
+
+	for {
+		var dval []byte
+		var d *desc
+
+		ver, dval, err = e.h.Get(key, version)
+		if err != nil || ver == 0 {
+			return
+		}
+
+		if d, err = unpackDesc(dval); err != nil {
+			return 0, nil, err
+		}
+
+		val, err = e.decode(key, d)
+		if err != Elost {
+			return
+		}
+
+		// the shards may have been replaced by a new value
+		if nver, _, nerr := e.h.Get(key, hop.Any); nerr != nil || nver == ver {
+			return 0, nil, err
+		}
+
+		version = hop.Any
+	}
+}
+
+// Returns the metadata of the descriptor entry, with the size of the value
+func (e *ECHop) Stat(key string) (st *hop.Stat, err error) {
+	st, err = hop.GetStat(e.h, key)
+	if err != nil || st == nil || strings.HasPrefix(key, "#/") {
+		return
+	}
+
+	_, val, err := e.h.Get(key, hop.Any)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := unpackDesc(val)
+	if err != nil {
+		return nil, err
+	}
+
+	st.Size = d.size
+	return
+}
+
+func (e *ECHop) Set(key string, value []byte) (ver uint64, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.Set(key, value)
+	}
+
+	d, err := e.writeShards(key, value)
+	if err != nil {
+		return
+	}
+
+	for {
+		var oldval []byte
+
+		ver, oldval, err = e.h.Get(key, hop.Any)
+		if err != nil || ver == 0 {
+			e.removeShards(key, d)
+			return 0, err
+		}
+
+		ver, err = e.publish(key, ver, oldval, d)
+		if err == Econflict {
+			// somebody else set it, replace their value. If they
+			// replaced our descriptor, they removed our shards, so
+			// write them again with a new gen.
+			e.removeShards(key, d)
+			if d, err = e.writeShards(key, value); err != nil {
+				return 0, err
+			}
+
+			continue
+		} else if err != nil {
+			e.removeShards(key, d)
+			return
+		}
+
+		if od, err := unpackDesc(oldval); err == nil {
+			e.removeShards(key, od)
+		}
+
+		return
+	}
+}
+
+// Compares the version and the decoded value. If they match, returns the
+// new version. Otherwise returns zero version and no value.
+func (e *ECHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.TestSet(key, oldversion, oldvalue, value)
+	}
+
+	ver, dval, err := e.h.Get(key, hop.Any)
+	if err != nil || ver == 0 {
+		return 0, nil, err
+	}
+
+	if oldversion != hop.Any && oldversion != ver {
+		return 0, nil, nil
+	}
+
+	od, err := unpackDesc(dval)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if oldvalue != nil {
+		cur, err := e.decode(key, od)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if !bytes.Equal(cur, oldvalue) {
+			return 0, nil, nil
+		}
+	}
+
+	d, err := e.writeShards(key, value)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ver, err = e.publish(key, ver, dval, d)
+	if err != nil {
+		e.removeShards(key, d)
+		if err == Econflict {
+			err = nil
+		}
+
+		return 0, nil, err
+	}
+
+	e.removeShards(key, od)
+	return ver, value, nil
+}
+
+func (e *ECHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return e.h.Atomic(key, op, values)
+	}
+
+	return 0, nil, hop.Eperm
+}
+
+// Regenerates the shards of the value that are missing or don't match
+// their checksums. Returns the number of the regenerated shards.
+func (e *ECHop) Repair(key string) (n int, err error) {
+	ver, dval, err := e.h.Get(key, hop.Any)
+	if err != nil || ver == 0 {
+		return 0, err
+	}
+
+	d, err := unpackDesc(dval)
+	if err != nil {
+		return
+	}
+
+	rs := e.rs
+	if d.k != rs.k || d.m != rs.m {
+		if rs, err = NewRS(d.k, d.m); err != nil {
+			return
+		}
+	}
+
+	shards, err := e.readShards(key, d)
+	if err != nil {
+		return
+	}
+
+	var lost []int
+	for i, s := range shards {
+		if s == nil {
+			lost = append(lost, i)
+		}
+	}
+
+	if len(lost) == 0 {
+		return
+	}
+
+	if err = rs.Reconstruct(shards); err == Eshards {
+		return 0, Elost
+	} else if err != nil {
+		return
+	}
+
+	for _, i := range lost {
+		skey := e.shardKey(key, d, i)
+		sver, err := e.h.Set(skey, shards[i])
+		if err == nil && sver == 0 {
+			_, err = e.h.Create(skey, "", shards[i])
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return
+}
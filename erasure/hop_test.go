@@ -0,0 +1,132 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package erasure
+
+import (
+	"bytes"
+	"errors"
+	"hop"
+	"hop/shop"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var Eunreachable = errors.New("server unreachable")
+
+// SHop that fails the Gets of the shards with the selected indexes, and
+// can run a function after the first successful TestSet of a key
+type testHop struct {
+	*shop.SHop
+	sync.Mutex
+	down    map[string]bool // shard index suffixes, e.g. "/2."
+	onset   func()
+	testset int
+}
+
+func newTestHop() *testHop {
+	return &testHop{SHop: shop.NewSHop(), down: make(map[string]bool)}
+}
+
+func (h *testHop) Get(key string, version uint64) (uint64, []byte, error) {
+	h.Lock()
+	for idx := range h.down {
+		if strings.Contains(key, idx) {
+			h.Unlock()
+			return 0, nil, Eunreachable
+		}
+	}
+	h.Unlock()
+
+	return h.SHop.Get(key, version)
+}
+
+func (h *testHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (uint64, []byte, error) {
+	ver, val, err := h.SHop.TestSet(key, oldversion, oldvalue, value)
+	h.Lock()
+	h.testset++
+	f := h.onset
+	if h.testset == 1 {
+		h.onset = nil
+	} else {
+		f = nil
+	}
+	h.Unlock()
+
+	if f != nil {
+		f()
+	}
+
+	return ver, val, err
+}
+
+func testValue(n int) []byte {
+	val := make([]byte, n)
+	for i := range val {
+		val[i] = byte(i * 7)
+	}
+
+	return val
+}
+
+func TestUnreachableShards(t *testing.T) {
+	h := newTestHop()
+	e, err := NewECHop(h, 4, 2, "#ec/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val := testValue(1000)
+	if _, err := e.Create("k", "", val); err != nil {
+		t.Fatal(err)
+	}
+
+	h.down["/1."] = true
+	h.down["/4."] = true
+	_, v, err := e.Get("k", hop.Any)
+	if err != nil {
+		t.Fatalf("two shards down: %v", err)
+	}
+
+	if !bytes.Equal(v, val) {
+		t.Fatal("two shards down: wrong value")
+	}
+
+	h.down["/0."] = true
+	if _, _, err := e.Get("k", hop.Any); err != Eunreachable {
+		t.Fatalf("three shards down: expected %v, got %v", Eunreachable, err)
+	}
+}
+
+// Another writer replaces our descriptor right after our TestSet and
+// removes our shards
+func TestSetConflict(t *testing.T) {
+	h := newTestHop()
+	e, _ := NewECHop(h, 4, 2, "#ec/")
+	e2, _ := NewECHop(h.SHop, 4, 2, "#ec/")
+	if _, err := e.Create("k", "", testValue(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	h.onset = func() {
+		if _, err := e2.Set("k", testValue(20)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	val := testValue(30)
+	if _, err := e.Set("k", val); err != nil {
+		t.Fatal(err)
+	}
+
+	_, v, err := e.Get("k", hop.Any)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(v, val) {
+		t.Fatalf("expected %d bytes, got %d", len(val), len(v))
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package erasure
+
+import (
+	"errors"
+)
+
+// Reed-Solomon code over GF(2^8) with k data and m parity shards. The
+// encoding matrix is systematic: the first k shards are the data, the
+// parity rows form a Cauchy matrix, so any k of the k+m shards are enough
+// to reconstruct the data.
+type RS struct {
+	k, m   int
+	parity [][]byte // m x k
+}
+
+var Eshards = errors.New("not enough shards")
+var Eparams = errors.New("invalid number of shards")
+
+var gfexp [512]byte
+var gflog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfexp[i] = byte(x)
+		gflog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for i := 255; i < len(gfexp); i++ {
+		gfexp[i] = gfexp[i-255]
+	}
+}
+
+func gfmul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return gfexp[int(gflog[a])+int(gflog[b])]
+}
+
+func gfinv(a byte) byte {
+	return gfexp[255-int(gflog[a])]
+}
+
+// dst ^= c * src
+func gfmuladd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+
+	lc := int(gflog[c])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfexp[lc+int(gflog[s])]
+		}
+	}
+}
+
+func NewRS(k, m int) (*RS, error) {
+	if k < 1 || m < 0 || k+m > 256 {
+		return nil, Eparams
+	}
+
+	rs := &RS{k: k, m: m}
+	rs.parity = make([][]byte, m)
+	for i := 0; i < m; i++ {
+		rs.parity[i] = make([]byte, k)
+		for j := 0; j < k; j++ {
+			// x_i = k + i and y_j = j are distinct, x_i + y_j != 0
+			rs.parity[i][j] = gfinv(byte(k+i) ^ byte(j))
+		}
+	}
+
+	return rs, nil
+}
+
+func (rs *RS) DataShards() int {
+	return rs.k
+}
+
+func (rs *RS) ParityShards() int {
+	return rs.m
+}
+
+// Splits the value in k data shards of equal size, padded with zeros, and
+// computes the m parity shards
+func (rs *RS) Split(val []byte) (shards [][]byte) {
+	sz := (len(val) + rs.k - 1) / rs.k
+	buf := make([]byte, sz*(rs.k+rs.m))
+	copy(buf, val)
+	shards = make([][]byte, rs.k+rs.m)
+	for i := range shards {
+		shards[i] = buf[i*sz : (i+1)*sz]
+	}
+
+	rs.encode(shards)
+	return
+}
+
+// Computes the parity shards from the data shards
+func (rs *RS) encode(shards [][]byte) {
+	for i := 0; i < rs.m; i++ {
+		p := shards[rs.k+i]
+		for n := range p {
+			p[n] = 0
+		}
+
+		for j := 0; j < rs.k; j++ {
+			gfmuladd(p, shards[j], rs.parity[i][j])
+		}
+	}
+}
+
+// Returns the row of the encoding matrix for the shard
+func (rs *RS) row(idx int) []byte {
+	if idx >= rs.k {
+		return rs.parity[idx-rs.k]
+	}
+
+	r := make([]byte, rs.k)
+	r[idx] = 1
+	return r
+}
+
+// Regenerates the missing (nil) shards in place. All present shards must
+// have the same size. Returns Eshards if fewer than k shards are present.
+func (rs *RS) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.k+rs.m {
+		return Eparams
+	}
+
+	var avail []int
+	sz := -1
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+
+		if sz >= 0 && len(s) != sz {
+			return errors.New("shard size mismatch")
+		}
+
+		sz = len(s)
+		if len(avail) < rs.k {
+			avail = append(avail, i)
+		}
+	}
+
+	if len(avail) < rs.k {
+		return Eshards
+	}
+
+	missing := false
+	for i := 0; i < rs.k; i++ {
+		if shards[i] == nil {
+			missing = true
+		}
+	}
+
+	if missing {
+		// invert the rows of the available shards and recover the data
+		mat := make([][]byte, rs.k)
+		for r, idx := range avail {
+			mat[r] = append([]byte(nil), rs.row(idx)...)
+		}
+
+		inv, err := invert(mat)
+		if err != nil {
+			return err
+		}
+
+		for j := 0; j < rs.k; j++ {
+			if shards[j] != nil {
+				continue
+			}
+
+			d := make([]byte, sz)
+			for r, idx := range avail {
+				gfmuladd(d, shards[idx], inv[j][r])
+			}
+
+			shards[j] = d
+		}
+	}
+
+	for i := rs.k; i < rs.k+rs.m; i++ {
+		if shards[i] != nil {
+			continue
+		}
+
+		p := make([]byte, sz)
+		for j := 0; j < rs.k; j++ {
+			gfmuladd(p, shards[j], rs.parity[i-rs.k][j])
+		}
+
+		shards[i] = p
+	}
+
+	return nil
+}
+
+// Joins the data shards and returns the first size bytes
+func (rs *RS) Join(shards [][]byte, size uint64) ([]byte, error) {
+	val := make([]byte, 0, size)
+	for i := 0; i < rs.k && uint64(len(val)) < size; i++ {
+		if shards[i] == nil {
+			return nil, Eshards
+		}
+
+		n := size - uint64(len(val))
+		if n > uint64(len(shards[i])) {
+			n = uint64(len(shards[i]))
+		}
+
+		val = append(val, shards[i][0:n]...)
+	}
+
+	if uint64(len(val)) != size {
+		return nil, errors.New("shards too short")
+	}
+
+	return val, nil
+}
+
+// Gauss-Jordan inversion of a square matrix over GF(2^8)
+func invert(mat [][]byte) (inv [][]byte, err error) {
+	n := len(mat)
+	inv = make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && mat[p][c] == 0 {
+			p++
+		}
+
+		if p == n {
+			return nil, errors.New("singular matrix")
+		}
+
+		mat[c], mat[p] = mat[p], mat[c]
+		inv[c], inv[p] = inv[p], inv[c]
+		if d := mat[c][c]; d != 1 {
+			di := gfinv(d)
+			for j := 0; j < n; j++ {
+				mat[c][j] = gfmul(mat[c][j], di)
+				inv[c][j] = gfmul(inv[c][j], di)
+			}
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || mat[r][c] == 0 {
+				continue
+			}
+
+			f := mat[r][c]
+			gfmuladd(mat[r], mat[c], f)
+			gfmuladd(inv[r], inv[c], f)
+		}
+	}
+
+	return inv, nil
+}
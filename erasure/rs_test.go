@@ -0,0 +1,92 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package erasure
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Any k of the shards reconstruct the others
+func TestReconstruct(t *testing.T) {
+	for _, p := range [][2]int{{1, 1}, {2, 1}, {4, 2}, {5, 3}, {3, 0}} {
+		k, m := p[0], p[1]
+		rs, err := NewRS(k, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		val := testValue(1001)
+		orig := rs.Split(val)
+		n := k + m
+		for mask := 0; mask < 1<<uint(n); mask++ {
+			shards := make([][]byte, n)
+			present := 0
+			for i := range shards {
+				if mask&(1<<uint(i)) != 0 {
+					shards[i] = append([]byte(nil), orig[i]...)
+					present++
+				}
+			}
+
+			err := rs.Reconstruct(shards)
+			if present < k {
+				if err != Eshards {
+					t.Fatalf("%d+%d, shards %b: expected %v, got %v", k, m, mask, Eshards, err)
+				}
+
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%d+%d, shards %b: %v", k, m, mask, err)
+			}
+
+			for i := range shards {
+				if !bytes.Equal(shards[i], orig[i]) {
+					t.Fatalf("%d+%d, shards %b: shard %d differs", k, m, mask, i)
+				}
+			}
+
+			v, err := rs.Join(shards, uint64(len(val)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(v, val) {
+				t.Fatalf("%d+%d, shards %b: wrong value", k, m, mask)
+			}
+		}
+	}
+}
+
+func TestSplitShort(t *testing.T) {
+	rs, _ := NewRS(4, 2)
+	for _, n := range []int{0, 1, 3, 4, 5} {
+		val := testValue(n)
+		shards := rs.Split(val)
+		shards[0], shards[3] = nil, nil
+		if err := rs.Reconstruct(shards); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := rs.Join(shards, uint64(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(v, val) {
+			t.Fatalf("%d bytes: wrong value", n)
+		}
+	}
+}
+
+func TestNewRSParams(t *testing.T) {
+	for _, p := range [][2]int{{0, 1}, {1, -1}, {200, 57}} {
+		if _, err := NewRS(p[0], p[1]); err != Eparams {
+			t.Fatalf("NewRS(%d, %d): expected %v, got %v", p[0], p[1], Eparams, err)
+		}
+	}
+}
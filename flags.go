@@ -0,0 +1,174 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per-key configuration passed as the flags parameter of Create. The flags
+// are a comma-separated list of name=value pairs:
+//
+//	consistency=strong|session|eventual
+//		strong: every read returns the latest value
+//		session: a client sees its own modifications
+//		eventual: reads may return stale values
+//	replicas=<n>
+//		number of copies of the entry (in Hops that distribute keys)
+//	cache=yes|no|<duration>
+//		whether the value may be cached, and for how long
+//	history=<n>|<duration>
+//		keep the values of the last n versions, or of the versions
+//		replaced within the duration (see VersionsPrefix)
+//
+// Other flags are ignored by ParseFlags, but kept in Other and returned by
+// Flags.String, so the Hops can store the flags they don't interpret.
+//
+// The flags are stored with the entry and are returned by Get of the
+// #/flags/<key> virtual entry, in the canonical form returned by
+// Flags.String. The settings that are not specified have the
+// implementation's default behavior. The flags can't be changed after the
+// entry is created.
+type Flags struct {
+	Consistency string        // empty if not specified
+	Replicas    int           // zero if not specified
+	Cache       int           // CacheDefault, CacheNo or CacheYes
+	MaxAge      time.Duration // maximum age of a cached value, if not zero
+	History     int           // number of old versions to keep
+	HistoryAge  time.Duration // how long to keep the old versions
+	Other       []string      // unknown flags, in the original order
+}
+
+const (
+	CacheDefault = iota
+	CacheNo
+	CacheYes
+)
+
+const (
+	Strong   = "strong"
+	Session  = "session"
+	Eventual = "eventual"
+)
+
+// Prefix of the virtual entries that contain the flags of the keys
+const FlagsPrefix = "#/flags/"
+
+var Eflags = errors.New("invalid flags")
+
+func ParseFlags(flags string) (f *Flags, err error) {
+	f = new(Flags)
+	if flags == "" {
+		return
+	}
+
+	for _, s := range strings.Split(flags, ",") {
+		s = strings.TrimSpace(s)
+		n := strings.Index(s, "=")
+		if n < 0 {
+			if s != "" {
+				f.Other = append(f.Other, s)
+			}
+
+			continue
+		}
+
+		name := strings.TrimSpace(s[0:n])
+		val := strings.TrimSpace(s[n+1:])
+		switch name {
+		default:
+			f.Other = append(f.Other, s)
+
+		case "consistency":
+			switch val {
+			case Strong, Session, Eventual:
+				f.Consistency = val
+			default:
+				return nil, Eflags
+			}
+
+		case "replicas":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, Eflags
+			}
+
+			f.Replicas = n
+
+		case "cache":
+			switch val {
+			case "yes":
+				f.Cache = CacheYes
+			case "no":
+				f.Cache = CacheNo
+			default:
+				d, err := time.ParseDuration(val)
+				if err != nil || d <= 0 {
+					return nil, Eflags
+				}
+
+				f.Cache = CacheYes
+				f.MaxAge = d
+			}
+
+		case "history":
+			if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+				f.History = n
+			} else if d, err := time.ParseDuration(val); err == nil && d > 0 {
+				f.HistoryAge = d
+			} else {
+				return nil, Eflags
+			}
+		}
+	}
+
+	return
+}
+
+func (f *Flags) String() string {
+	var s []string
+
+	if f.Consistency != "" {
+		s = append(s, "consistency="+f.Consistency)
+	}
+
+	if f.Replicas != 0 {
+		s = append(s, fmt.Sprintf("replicas=%d", f.Replicas))
+	}
+
+	switch {
+	case f.Cache == CacheNo:
+		s = append(s, "cache=no")
+	case f.MaxAge != 0:
+		s = append(s, "cache="+f.MaxAge.String())
+	case f.Cache == CacheYes:
+		s = append(s, "cache=yes")
+	}
+
+	if f.HistoryAge != 0 {
+		s = append(s, "history="+f.HistoryAge.String())
+	} else if f.History != 0 {
+		s = append(s, fmt.Sprintf("history=%d", f.History))
+	}
+
+	s = append(s, f.Other...)
+	return strings.Join(s, ",")
+}
+
+// Returns the flags of the key. Returns the default flags if the entry
+// doesn't exist, or if the Hop doesn't support the #/flags/ entries (in
+// which case the error is returned too).
+func GetFlags(h GetterHop, key string) (f *Flags, err error) {
+	ver, val, err := h.Get(FlagsPrefix+key, Any)
+	if err != nil || ver == 0 {
+		return new(Flags), err
+	}
+
+	return ParseFlags(string(val))
+}
@@ -0,0 +1,110 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// History
+//
+// The Hops that support history keep the values of the previous versions
+// of an entry. How many are kept is configured per key with the history
+// flag (see Flags), or for the whole Hop. The retained versions are
+// accessed through the virtual entries:
+//
+//	#/versions/<key>	zero-separated list of the retained versions of
+//				the key, the oldest first. The last one is the
+//				current version.
+//	#/version:<v>/<key>	the value of exactly version v of the key.
+//				Returns Enoversion if that version is not
+//				retained.
+//
+// The history of an entry is discarded when the entry is removed.
+
+const (
+	VersionsPrefix = "#/versions/"
+	VersionPrefix  = "#/version:"
+)
+
+var Enoversion = errors.New("version not retained")
+
+// Parses a #/version:<v>/<key> key. Returns false if the key is not in
+// that format.
+func ParseVersionKey(key string) (version uint64, k string, ok bool) {
+	if !strings.HasPrefix(key, VersionPrefix) {
+		return
+	}
+
+	key = key[len(VersionPrefix):]
+	n := strings.Index(key, "/")
+	if n < 0 {
+		return
+	}
+
+	version, err := strconv.ParseUint(key[0:n], 10, 64)
+	if err != nil {
+		return
+	}
+
+	return version, key[n+1:], true
+}
+
+// Returns the key the history virtual entry is for, or the key itself if
+// it isn't one
+func HistoryKey(key string) string {
+	if strings.HasPrefix(key, VersionsPrefix) {
+		return key[len(VersionsPrefix):]
+	} else if _, k, ok := ParseVersionKey(key); ok {
+		return k
+	}
+
+	return key
+}
+
+// Returns the value of exactly the specified version of the key
+func GetExact(h GetterHop, key string, version uint64) (val []byte, err error) {
+	ver, val, err := h.Get(VersionPrefix+strconv.FormatUint(version, 10)+"/"+key, Any)
+	if err == nil && ver == 0 {
+		err = Enoversion
+	}
+
+	return
+}
+
+// Returns the retained versions of the key, the oldest first
+func Versions(h GetterHop, key string) (vers []uint64, err error) {
+	ver, val, err := h.Get(VersionsPrefix+key, Any)
+	if err != nil || ver == 0 {
+		return
+	}
+
+	for _, s := range bytes.Split(val, []byte{0}) {
+		v, err := strconv.ParseUint(string(s), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		vers = append(vers, v)
+	}
+
+	return
+}
+
+// Packs a list of versions in the #/versions/ format
+func PackVersions(vers []uint64) (val []byte) {
+	for i, v := range vers {
+		if i > 0 {
+			val = append(val, 0)
+		}
+
+		val = strconv.AppendUint(val, v, 10)
+	}
+
+	return
+}
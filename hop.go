@@ -4,7 +4,10 @@
 
 package hop
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type Hop interface {
 	// Create add a new entry to the key-value store. The content of the
@@ -62,6 +65,58 @@ type AtomicHop interface {
 	Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error)
 }
 
+// Returns the metadata of the entry without its value. Returns nil if the
+// entry doesn't exist.
+type StatHop interface {
+	Stat(key string) (st *Stat, err error)
+}
+
+// Implemented by the Hops that record which client created the entries.
+// The ident is an implementation dependent identity of the client, the
+// remote servers use the client's address.
+type CreateAsHop interface {
+	CreateAs(ident, key, flags string, value []byte) (ver uint64, err error)
+}
+
+// Implemented by the Hops that can create an entry with the specified
+// version, so the versions of the entries moved between servers keep
+// increasing. Fails with Eexist if the entry exists.
+type VersionCreateHop interface {
+	CreateVersion(key, flags string, version uint64, value []byte) (err error)
+}
+
+// Implemented by the distributed Hops that can tell which server stores
+// the key. Returns the server's address.
+type OwnerHop interface {
+	Owner(key string) string
+}
+
+// Entry metadata. The fields that the Hop doesn't keep track of are left
+// empty.
+type Stat struct {
+	Version uint64
+	Size    uint64    // length of the value
+	Ctime   time.Time // when the entry was created
+	Mtime   time.Time // when the value was last modified
+	Flags   string    // create flags (see Flags)
+	Creator string    // identity of the client that created the entry
+}
+
+// Returns the metadata of the entry. If the Hop doesn't implement StatHop,
+// gets the value and returns its version and size.
+func GetStat(h GetterHop, key string) (st *Stat, err error) {
+	if sh, ok := h.(StatHop); ok {
+		return sh.Stat(key)
+	}
+
+	ver, val, err := h.Get(key, Any)
+	if err != nil || ver == 0 {
+		return nil, err
+	}
+
+	return &Stat{Version: ver, Size: uint64(len(val))}, nil
+}
+
 // Version values
 const (
 	Any        = 0
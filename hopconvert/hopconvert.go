@@ -0,0 +1,195 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Converts the data between the on-disk formats of the Hop backends,
+// preserving the versions of the entries.
+//
+//	hopconvert [-n] [-verify] [-progress n] format:path format:path
+//
+// The supported formats are snapshot (SHop snapshot file), kc (KCHop
+// cabinet) and leveldb (LDHop database). The kc and leveldb formats can be
+// left out by building with the nokc and noleveldb tags. The kc and
+// leveldb formats don't store the entry flags, they are lost when
+// converting from a snapshot.
+//
+// With -n the source is read and checked, but nothing is written. With
+// -verify nothing is written either, the entries in the destination are
+// compared to the ones in the source. The records that are too short to
+// contain a version are reported as corrupted and skipped.
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type Reader interface {
+	// Calls visit for each entry. Version zero marks a corrupted record.
+	Visit(visit func(key string, version uint64, flags string, value []byte) error) error
+
+	// Returns the entry, zero version if it doesn't exist
+	Get(key string) (version uint64, value []byte, err error)
+	Close() error
+}
+
+type Writer interface {
+	Put(key string, version uint64, flags string, value []byte) error
+	Close() error
+}
+
+type Format struct {
+	Open   func(path string) (Reader, error)
+	Create func(path string) (Writer, error)
+}
+
+var formats = make(map[string]*Format)
+
+var dryrun = flag.Bool("n", false, "dry run, read and check the source only")
+var verify = flag.Bool("verify", false, "compare the destination with the source")
+var progress = flag.Int("progress", 100000, "report progress every n entries (0 disables)")
+
+var Ecorrupt = errors.New("corrupted records found")
+var Emismatch = errors.New("destination doesn't match the source")
+
+func parseArg(arg string) (f *Format, path string, err error) {
+	n := strings.Index(arg, ":")
+	if n < 0 {
+		return nil, "", fmt.Errorf("%s: expected format:path", arg)
+	}
+
+	f = formats[arg[0:n]]
+	if f == nil {
+		return nil, "", fmt.Errorf("%s: unsupported format", arg[0:n])
+	}
+
+	return f, arg[n+1:], nil
+}
+
+type stats struct {
+	entries  int
+	corrupt  int
+	mismatch int
+	bytes    uint64
+}
+
+func (st *stats) report(final bool) {
+	if !final && (*progress == 0 || st.entries%*progress != 0) {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%d entries, %d bytes, %d corrupted", st.entries, st.bytes, st.corrupt)
+	if *verify {
+		fmt.Fprintf(os.Stderr, ", %d mismatched", st.mismatch)
+	}
+
+	fmt.Fprintf(os.Stderr, "\n")
+}
+
+func convert(src Reader, dst Writer, vdst Reader) (st *stats, err error) {
+	st = new(stats)
+	err = src.Visit(func(key string, version uint64, flags string, value []byte) error {
+		if version == 0 {
+			fmt.Fprintf(os.Stderr, "corrupted record: %q (%d bytes)\n", key, len(value))
+			st.corrupt++
+			return nil
+		}
+
+		st.entries++
+		st.bytes += uint64(len(value))
+		switch {
+		case dst != nil:
+			if err := dst.Put(key, version, flags, value); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+
+		case vdst != nil:
+			ver, val, err := vdst.Get(key)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+
+			if ver != version || !bytes.Equal(val, value) {
+				fmt.Fprintf(os.Stderr, "mismatch: %q version %d, destination version %d\n", key, version, ver)
+				st.mismatch++
+			}
+		}
+
+		st.report(false)
+		return nil
+	})
+
+	return
+}
+
+func main() {
+	var dst Writer
+	var vdst Reader
+
+	flag.Parse()
+	if flag.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: hopconvert [options] format:path format:path\n")
+		os.Exit(1)
+	}
+
+	sf, spath, err := parseArg(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	df, dpath, err := parseArg(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case *verify:
+		vdst, err = df.Open(dpath)
+	case !*dryrun:
+		dst, err = df.Create(dpath)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	src, err := sf.Open(spath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	st, err := convert(src, dst, vdst)
+	src.Close()
+	if dst != nil {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if vdst != nil {
+		vdst.Close()
+	}
+
+	st.report(true)
+	switch {
+	case err != nil:
+	case st.corrupt > 0:
+		err = Ecorrupt
+	case st.mismatch > 0:
+		err = Emismatch
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
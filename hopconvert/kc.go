@@ -0,0 +1,63 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !nokc
+// +build !nokc
+
+package main
+
+import (
+	"hop"
+	"hop/kchop"
+	"os"
+)
+
+type kcFile struct {
+	h *kchop.KCHop
+}
+
+func init() {
+	formats["kc"] = &Format{openKC, createKC}
+}
+
+func openKC(path string) (Reader, error) {
+	// don't let the cabinet create a missing file
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	h, err := kchop.NewKCHop(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kcFile{h}, nil
+}
+
+func createKC(path string) (Writer, error) {
+	h, err := kchop.NewKCHop(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kcFile{h}, nil
+}
+
+func (f *kcFile) Visit(visit func(key string, version uint64, flags string, value []byte) error) error {
+	return f.h.VisitEntries(func(key string, version uint64, value []byte) error {
+		return visit(key, version, "", value)
+	})
+}
+
+func (f *kcFile) Get(key string) (version uint64, value []byte, err error) {
+	return f.h.Get(key, hop.Any)
+}
+
+func (f *kcFile) Put(key string, version uint64, flags string, value []byte) error {
+	return f.h.PutEntry(key, version, value)
+}
+
+func (f *kcFile) Close() error {
+	return f.h.Close()
+}
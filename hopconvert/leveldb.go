@@ -0,0 +1,65 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !noleveldb
+// +build !noleveldb
+
+package main
+
+import (
+	"hop"
+	"hop/lvldbhop"
+	"os"
+)
+
+const cacheSize = 50242880
+
+type ldFile struct {
+	h *lvldbhop.LDHop
+}
+
+func init() {
+	formats["leveldb"] = &Format{openLD, createLD}
+}
+
+func openLD(path string) (Reader, error) {
+	// don't let the database create a missing directory
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	h, err := lvldbhop.NewLDHop(path, cacheSize, cacheSize, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ldFile{h}, nil
+}
+
+func createLD(path string) (Writer, error) {
+	h, err := lvldbhop.NewLDHop(path, cacheSize, cacheSize, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ldFile{h}, nil
+}
+
+func (f *ldFile) Visit(visit func(key string, version uint64, flags string, value []byte) error) error {
+	return f.h.VisitEntries(func(key string, version uint64, value []byte) error {
+		return visit(key, version, "", value)
+	})
+}
+
+func (f *ldFile) Get(key string) (version uint64, value []byte, err error) {
+	return f.h.Get(key, hop.Any)
+}
+
+func (f *ldFile) Put(key string, version uint64, flags string, value []byte) error {
+	return f.h.PutEntry(key, version, value)
+}
+
+func (f *ldFile) Close() error {
+	return f.h.Close()
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"hop"
+	"time"
+)
+
+type snapReader struct {
+	s *hop.Snapshot
+}
+
+type snapWriter struct {
+	s    *hop.Snapshot
+	path string
+}
+
+func init() {
+	formats["snapshot"] = &Format{openSnapshot, createSnapshot}
+}
+
+func openSnapshot(path string) (Reader, error) {
+	s, err := hop.LoadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapReader{s}, nil
+}
+
+func (r *snapReader) Visit(visit func(key string, version uint64, flags string, value []byte) error) (err error) {
+	r.s.VisitEntries(func(key string, e *hop.SnapEntry) {
+		if err == nil {
+			err = visit(key, e.Version, e.Flags, e.Value)
+		}
+	})
+
+	return
+}
+
+func (r *snapReader) Get(key string) (version uint64, value []byte, err error) {
+	return r.s.Get(key, hop.Any)
+}
+
+func (r *snapReader) Close() error {
+	return nil
+}
+
+func createSnapshot(path string) (Writer, error) {
+	s := new(hop.Snapshot)
+	s.Time = time.Now()
+	return &snapWriter{s, path}, nil
+}
+
+func (w *snapWriter) Put(key string, version uint64, flags string, value []byte) error {
+	w.s.AddEntry(key, &hop.SnapEntry{Version: version, Value: value, Flags: flags})
+	return nil
+}
+
+func (w *snapWriter) Close() error {
+	return w.s.Save(w.path)
+}
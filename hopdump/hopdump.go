@@ -0,0 +1,96 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Dumps the entries of a Hop to an archive (see the archive package).
+//
+//	hopdump [-prefix p1,p2...] [-since prev] [-j workers] archive
+//
+// With -since, only the entries whose version changed since the prev
+// archive was created are dumped.
+
+import (
+	"flag"
+	"fmt"
+	"hop/archive"
+	"os"
+	"strings"
+	"time"
+)
+
+var prefix = flag.String("prefix", "", "comma-separated list of key prefixes to dump")
+var since = flag.String("since", "", "previous archive, dump only the entries changed since")
+var workers = flag.Int("j", 8, "number of parallel readers")
+
+func main() {
+	var prev map[string]uint64
+	var base time.Time
+	var prefixes []string
+
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: hopdump [options] archive\n")
+		os.Exit(1)
+	}
+
+	if *prefix != "" {
+		prefixes = strings.Split(*prefix, ",")
+	}
+
+	if *since != "" {
+		f, err := os.Open(*since)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		r, err := archive.NewReader(f)
+		if err == nil {
+			base = r.Time
+			prev, err = archive.ReadVersions(r)
+		}
+		f.Close()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", *since, err)
+			os.Exit(1)
+		}
+	}
+
+	c, err := Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	f, err := os.Create(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	w, err := archive.NewWriter(f, time.Now(), base)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	st, err := archive.Dump(c, w, prefixes, prev, *workers)
+	if err == nil {
+		err = w.Close()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Remove(flag.Arg(0))
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d entries, %d unchanged, %d removed, %d skipped\n", st.Entries, st.Unchanged, st.Removed, st.Skipped)
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Replicates the entries from one Hop cluster to another (see the repl
+// package).
+//
+//	hoprepl -target addr [-include p1,p2...] [-exclude p1,p2...]
+//		(-journal addr1,addr2... | -scan addr [-interval d])
+//
+// With -journal, the changes are read from the journals of the listed
+// servers (they should run with -journal). With -scan, the source is
+// scanned periodically. The addresses are of any server of the cluster,
+// the servers forward the requests to the ones that hold the keys.
+
+import (
+	"flag"
+	"fmt"
+	"hop/repl"
+	"hop/rmt/hopclnt"
+	"os"
+	"strings"
+	"time"
+)
+
+var proto = flag.String("proto", "tcp", "connection protocol")
+var target = flag.String("target", "", "target address")
+var prefix = flag.String("prefix", "_repl/", "prefix of the replication state entries in the target")
+var include = flag.String("include", "", "comma-separated list of key prefixes to replicate")
+var exclude = flag.String("exclude", "", "comma-separated list of key prefixes not to replicate")
+var journal = flag.String("journal", "", "comma-separated list of the source servers journals to read")
+var scan = flag.String("scan", "", "source address to scan")
+var interval = flag.Duration("interval", 10*time.Second, "scan interval")
+var retry = flag.Duration("retry", 5*time.Second, "retry interval after errors")
+var stats = flag.Duration("stats", 10*time.Second, "statistics report interval")
+
+func list(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+	if *target == "" || (*journal == "") == (*scan == "") {
+		fmt.Fprintf(os.Stderr, "usage: hoprepl -target addr (-journal addrs | -scan addr) [options]\n")
+		os.Exit(1)
+	}
+
+	t, err := hopclnt.Connect(*proto, *target)
+	if err != nil {
+		fatal(err)
+	}
+
+	r := repl.NewReplicator(t, *prefix)
+	for _, p := range list(*include) {
+		r.Include(p)
+	}
+
+	for _, p := range list(*exclude) {
+		r.Exclude(p)
+	}
+
+	for _, addr := range list(*journal) {
+		c, err := hopclnt.Connect(*proto, addr)
+		if err != nil {
+			fatal(err)
+		}
+
+		if err = r.AddSource(repl.NewJournalSource("journal:"+addr, c)); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *scan != "" {
+		c, err := hopclnt.Connect(*proto, *scan)
+		if err != nil {
+			fatal(err)
+		}
+
+		if err = r.AddSource(repl.NewScanSource("scan:"+*scan, c, list(*include), *interval)); err != nil {
+			fatal(err)
+		}
+	}
+
+	r.Start(*retry)
+	for {
+		time.Sleep(*stats)
+		for _, st := range r.Stats() {
+			fmt.Printf("%s: pos %d applied %d skipped %d errors %d behind %d delay %v", st.Name, st.Pos, st.Applied, st.Skipped, st.Errors, st.Behind, st.Delay)
+			if st.Err != nil {
+				fmt.Printf(" last error: %v", st.Err)
+			}
+
+			fmt.Printf("\n")
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// Restores the entries from archives created by hopdump.
+//
+//	hoprestore [-j workers] [-replace] archive...
+//
+// The archives are restored in order, a full dump should be followed by
+// the incremental dumps based on it.
+
+import (
+	"flag"
+	"fmt"
+	"hop/archive"
+	"os"
+)
+
+var workers = flag.Int("j", 8, "number of parallel writers")
+var replace = flag.Bool("replace", false, "set the value of the entries that already exist")
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: hoprestore [options] archive...\n")
+		os.Exit(1)
+	}
+
+	c, err := Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		r, err := archive.NewReader(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			os.Exit(1)
+		}
+
+		st, err := archive.Restore(c, r, *workers, *replace)
+		f.Close()
+		fmt.Printf("%s: %d entries, %d removed, %d errors\n", name, st.Entries, st.Removed, st.Errors)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+}
@@ -12,9 +12,11 @@ import (
 	"flag"
 	"fmt"
 	"hop"
+	"io"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var prompt = flag.String("prompt", "hop> ", "prompt for interactive client")
@@ -48,6 +50,13 @@ func init() {
 	cmds["bitclr"] = &Cmd{cmdbclr, 1, "bitclr key\t«atomic bit clear»"}
 	cmds["sappend"] = &Cmd{cmdsappend, 2, "sappend key value\t«atomically append the specified string to the value for the key»"}
 	cmds["sremove"] = &Cmd{cmdsremove, 2, "sremove key value\t«atomically remove the specified string from the value of the key»"}
+	cmds["stat"] = &Cmd{cmdstat, 1, "stat key\t«print the version, size, times, flags and creator of the entry»"}
+	cmds["flags"] = &Cmd{cmdflags, 1, "flags key\t«print the flags the entry was created with (get #/flags/key)»"}
+	cmds["versions"] = &Cmd{cmdversions, 1, "versions key\t«list the retained versions of the entry (get #/versions/key)»"}
+	cmds["getv"] = &Cmd{cmdgetv, 2, "getv key version\t«gets the value of exactly the specified version (get #/version:version/key)»"}
+	cmds["journal"] = &Cmd{cmdjournal, 0, "journal [seq]\t«print the journal records after seq (get #/journal:seq)»"}
+	cmds["getfile"] = &Cmd{cmdgetfile, 2, "getfile key file\t«write the value of the key to the file, in parts if the value is large»"}
+	cmds["setfile"] = &Cmd{cmdsetfile, 2, "setfile key file\t«set the value of an existing key to the content of the file, in parts»"}
 	cmds["ls"] = &Cmd{cmdls, 0, "ls [regexp]\t«list all keys that match the specified regular expresion (get #/keys:regexp)»"}
 	cmds["help"] = &Cmd{cmdhelp, 0, "help [cmd]\t«print available commands or help on cmd»"}
 	cmds["quit"] = &Cmd{cmdquit, 0, "quit\t«exit»"}
@@ -399,6 +408,166 @@ func cmdsremove(c hop.Hop, s []string) {
 	fmt.Printf("%d: %s", version, barray(vals[0]))
 }
 
+func cmdstat(c hop.Hop, s []string) {
+	st, err := hop.GetStat(c, s[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	if st == nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", hop.Enoent)
+		return
+	}
+
+	fmt.Printf("version: %d\n", st.Version)
+	fmt.Printf("size: %d\n", st.Size)
+	if !st.Ctime.IsZero() {
+		fmt.Printf("created: %v\n", st.Ctime)
+	}
+
+	if !st.Mtime.IsZero() {
+		fmt.Printf("modified: %v\n", st.Mtime)
+	}
+
+	fmt.Printf("flags: %s\n", st.Flags)
+	fmt.Printf("creator: %s\n", st.Creator)
+}
+
+// Implemented by the clients that know how large the parts can be
+type streamHop interface {
+	GetStream(key string, version uint64, w io.Writer) (ver uint64, n int64, err error)
+	SetStream(key string, r io.Reader) (ver uint64, n int64, err error)
+}
+
+const streamChunk = 1024 * 1024
+
+func cmdgetfile(c hop.Hop, s []string) {
+	var ver uint64
+	var n int64
+
+	f, err := os.Create(s[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	if sc, ok := c.(streamHop); ok {
+		ver, n, err = sc.GetStream(s[1], hop.Any, f)
+	} else {
+		ver, n, err = hop.GetStream(c, s[1], hop.Any, f, streamChunk)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && ver == 0 {
+		err = hop.Enoent
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	} else {
+		fmt.Printf("%d: %d bytes\n", ver, n)
+	}
+}
+
+func cmdsetfile(c hop.Hop, s []string) {
+	var ver uint64
+	var n int64
+
+	f, err := os.Open(s[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	defer f.Close()
+	if sc, ok := c.(streamHop); ok {
+		ver, n, err = sc.SetStream(s[1], f)
+	} else {
+		ver, n, err = hop.SetStream(c, s[1], f, streamChunk)
+	}
+
+	if err == nil && ver == 0 {
+		err = hop.Enoent
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	} else {
+		fmt.Printf("%d: %d bytes\n", ver, n)
+	}
+}
+
+func cmdflags(c hop.Hop, s []string) {
+	f, err := hop.GetFlags(c, s[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("%s\n", f)
+}
+
+func cmdversions(c hop.Hop, s []string) {
+	vers, err := hop.Versions(c, s[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	for _, v := range vers {
+		fmt.Printf("%d\n", v)
+	}
+}
+
+func cmdgetv(c hop.Hop, s []string) {
+	version, err := strconv.ParseUint(s[2], 0, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid version\n")
+		return
+	}
+
+	val, err := hop.GetExact(c, s[1], version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	fmt.Printf("%d: %s\n", version, barray(val))
+}
+
+func cmdjournal(c hop.Hop, s []string) {
+	seq := uint64(0)
+	if len(s) > 1 {
+		var err error
+
+		seq, err = strconv.ParseUint(s[1], 0, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid sequence number\n")
+			return
+		}
+	}
+
+	recs, err := hop.ReadJournal(c, seq, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return
+	}
+
+	ops := []string{hop.JCreate: "create", hop.JRemove: "remove", hop.JSet: "set", hop.JTestSet: "tas", hop.JAtomic: "atomic"}
+	for _, r := range recs {
+		op := "?"
+		if int(r.Op) < len(ops) {
+			op = ops[r.Op]
+		}
+
+		fmt.Printf("%d %v %s %s %d: %s\n", r.Seq, r.Time.Format(time.RFC3339Nano), op, r.Key, r.Version, barray(r.Value))
+	}
+}
+
 func cmdls(c hop.Hop, s []string) {
 	re := ".*"
 	if len(s) > 1 {
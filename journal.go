@@ -0,0 +1,384 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JHop wraps a Hop and keeps a journal of all modifications made through
+// it. Each modification gets a sequence number, larger than the ones of the
+// modifications before it. The modifications of a key are journaled in the
+// order they were applied. The first sequence number is the time the JHop
+// was created (in nanoseconds), so the numbers keep increasing if the
+// server is restarted, and a consumer that resumes can tell the journal it
+// read from is gone.
+//
+// The journal is read through the virtual entries:
+//
+//	#/journal		first[8] last[8], the sequence numbers of the
+//				oldest and newest retained records
+//	#/journal:<seq>		the records with sequence numbers larger than
+//				seq, at most JournalPage records or
+//				JournalPageSize bytes
+//
+// The version of both entries is the last sequence number. Reading
+// #/journal:<seq> with version larger than the last sequence number blocks
+// until new records are added (use seq+1 to wait for the next record).
+// If records after seq were already discarded, Get returns Etrimmed. Zero
+// seq reads from the oldest retained record.
+//
+// The records are seq[8] time[8] op[1] version[8] key[s] value[n]. The
+// version and value are the ones the entry had after the modification,
+// the Remove records have zero version and no value.
+type JHop struct {
+	hop Hop
+
+	sync.Mutex
+	cond    sync.Cond
+	recs    []*JournalRecord
+	first   uint64 // sequence number of recs[0]
+	next    uint64 // next sequence number
+	size    uint64
+	maxsize uint64
+	maxage  time.Duration
+
+	// per-key ordering of the modifications
+	klocks [64]sync.Mutex
+}
+
+type JournalRecord struct {
+	Seq     uint64
+	Time    time.Time
+	Op      uint8
+	Version uint64
+	Key     string
+	Value   []byte
+}
+
+// journal operations
+const (
+	JCreate = iota + 1
+	JRemove
+	JSet
+	JTestSet
+	JAtomic
+)
+
+const JournalPrefix = "#/journal:"
+
+var JournalPage = 256
+var JournalPageSize = 1024 * 1024
+var Etrimmed = errors.New("journal records discarded")
+var Ejournal = errors.New("invalid journal records")
+
+// Creates a JHop that keeps at most maxsize bytes of records, not older
+// than maxage. Zero values disable the limits.
+func NewJHop(h Hop, maxsize uint64, maxage time.Duration) *JHop {
+	j := new(JHop)
+	j.hop = h
+	j.maxsize = maxsize
+	j.maxage = maxage
+	j.cond.L = &j.Mutex
+	j.next = uint64(time.Now().UnixNano())
+	j.first = j.next
+	return j
+}
+
+func (j *JHop) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &j.klocks[h.Sum32()%uint32(len(j.klocks))]
+}
+
+func (j *JHop) add(op uint8, key string, ver uint64, val []byte) {
+	r := &JournalRecord{Time: time.Now(), Op: op, Version: ver, Key: key}
+	if val != nil {
+		r.Value = make([]byte, len(val))
+		copy(r.Value, val)
+	}
+
+	j.Lock()
+	r.Seq = j.next
+	j.next++
+	j.recs = append(j.recs, r)
+	j.size += r.size()
+	j.trim(r.Time)
+	j.Unlock()
+	j.cond.Broadcast()
+}
+
+// called with j locked
+func (j *JHop) trim(now time.Time) {
+	n := 0
+	for n < len(j.recs) {
+		r := j.recs[n]
+		if (j.maxsize == 0 || j.size <= j.maxsize) && (j.maxage == 0 || now.Sub(r.Time) <= j.maxage) {
+			break
+		}
+
+		j.size -= r.size()
+		n++
+	}
+
+	if n > 0 {
+		j.recs = append([]*JournalRecord(nil), j.recs[n:]...)
+		j.first += uint64(n)
+	}
+}
+
+func (r *JournalRecord) size() uint64 {
+	return uint64(8 + 8 + 1 + 8 + 2 + len(r.Key) + 4 + len(r.Value))
+}
+
+func (j *JHop) Create(key, flags string, value []byte) (ver uint64, err error) {
+	return j.CreateAs("", key, flags, value)
+}
+
+func (j *JHop) CreateAs(ident, key, flags string, value []byte) (ver uint64, err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	if ch, ok := j.hop.(CreateAsHop); ok {
+		ver, err = ch.CreateAs(ident, key, flags, value)
+	} else {
+		ver, err = j.hop.Create(key, flags, value)
+	}
+
+	if err == nil && ver != 0 {
+		j.add(JCreate, key, ver, value)
+	}
+
+	return
+}
+
+// Keeps the version if the wrapped Hop implements VersionCreateHop,
+// otherwise the entry gets the version the Hop assigns
+func (j *JHop) CreateVersion(key, flags string, version uint64, value []byte) (err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	ver := version
+	if vh, ok := j.hop.(VersionCreateHop); ok {
+		err = vh.CreateVersion(key, flags, version, value)
+	} else {
+		ver, err = j.hop.Create(key, flags, value)
+	}
+
+	if err == nil && ver != 0 {
+		j.add(JCreate, key, ver, value)
+	}
+
+	return
+}
+
+func (j *JHop) Remove(key string) (err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	err = j.hop.Remove(key)
+	if err == nil {
+		j.add(JRemove, key, 0, nil)
+	}
+
+	return
+}
+
+func (j *JHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key == "#/journal" {
+		return j.getInfo()
+	} else if strings.HasPrefix(key, JournalPrefix) {
+		seq, err := strconv.ParseUint(key[len(JournalPrefix):], 10, 64)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return j.getRecords(seq, version)
+	}
+
+	return j.hop.Get(key, version)
+}
+
+func (j *JHop) Stat(key string) (st *Stat, err error) {
+	return GetStat(j.hop, key)
+}
+
+func (j *JHop) Set(key string, value []byte) (ver uint64, err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	ver, err = j.hop.Set(key, value)
+	if err == nil && ver != 0 {
+		j.add(JSet, key, ver, value)
+	}
+
+	return
+}
+
+// Some Hops return the current version if the values don't match, so the
+// version before the operation is checked to see if the entry was modified.
+func (j *JHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	pver, _, _ := j.hop.Get(key, Any)
+	ver, val, err = j.hop.TestSet(key, oldversion, oldvalue, value)
+	if err == nil && ver != 0 && ver != pver {
+		j.add(JTestSet, key, ver, value)
+	}
+
+	return
+}
+
+// The result of the atomic operation is read back, so it is journaled even
+// if the operation doesn't return it.
+func (j *JHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	pver, _, _ := j.hop.Get(key, Any)
+	ver, vals, err = j.hop.Atomic(key, op, values)
+	if err == nil && ver != 0 && ver != pver {
+		if nver, nval, gerr := j.hop.Get(key, Any); gerr == nil && nver != 0 {
+			j.add(JAtomic, key, nver, nval)
+		}
+	}
+
+	return
+}
+
+func (j *JHop) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	return GetRange(j.hop, key, version, offset, count)
+}
+
+// The whole value is read back and journaled, as for Atomic
+func (j *JHop) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	l := j.keyLock(key)
+	l.Lock()
+	defer l.Unlock()
+
+	ver, err = SetRange(j.hop, key, offset, data, truncate)
+	if err == nil && ver != 0 {
+		if nver, nval, gerr := j.hop.Get(key, Any); gerr == nil && nver != 0 {
+			j.add(JSet, key, nver, nval)
+		}
+	}
+
+	return
+}
+
+func (j *JHop) getInfo() (ver uint64, val []byte, err error) {
+	j.Lock()
+	first, last := j.first, j.next-1
+	j.Unlock()
+
+	val = make([]byte, 16)
+	Pint64(last, Pint64(first, val))
+	return last, val, nil
+}
+
+func (j *JHop) getRecords(seq, version uint64) (ver uint64, val []byte, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	if version != Any && version != Newest {
+		if version == PastNewest {
+			version = j.next
+		}
+
+		for j.next <= version {
+			j.cond.Wait()
+		}
+	}
+
+	j.trim(time.Now())
+	if seq != 0 && seq+1 < j.first {
+		return 0, nil, Etrimmed
+	}
+
+	idx := 0
+	if seq >= j.first {
+		idx = int(seq - j.first + 1)
+	}
+
+	for n := 0; idx < len(j.recs) && n < JournalPage && len(val) < JournalPageSize; idx, n = idx+1, n+1 {
+		val = append(val, j.recs[idx].pack()...)
+	}
+
+	if val == nil {
+		val = []byte{}
+	}
+
+	return j.next - 1, val, nil
+}
+
+func (r *JournalRecord) pack() []byte {
+	buf := make([]byte, r.size())
+	p := Pint64(r.Seq, buf)
+	p = Pint64(uint64(r.Time.UnixNano()), p)
+	p = Pint8(r.Op, p)
+	p = Pint64(r.Version, p)
+	p = Pstr(r.Key, p)
+	Pblob(r.Value, p)
+	return buf
+}
+
+// Unpacks the records returned by #/journal:<seq>
+func UnpackJournal(val []byte) (recs []*JournalRecord, err error) {
+	for len(val) > 0 {
+		var t uint64
+
+		if len(val) < 8+8+1+8+2 {
+			return nil, Ejournal
+		}
+
+		r := new(JournalRecord)
+		r.Seq, val = Gint64(val)
+		t, val = Gint64(val)
+		r.Time = time.Unix(0, int64(t))
+		r.Op, val = Gint8(val)
+		r.Version, val = Gint64(val)
+		r.Key, val = Gstr(val)
+		if val == nil || len(val) < 4 {
+			return nil, Ejournal
+		}
+
+		r.Value, val = Gblob(val)
+		if val == nil {
+			return nil, Ejournal
+		}
+
+		recs = append(recs, r)
+	}
+
+	return
+}
+
+// Returns the journal records with sequence numbers larger than seq. If
+// wait is true and there are no such records, waits until one is added.
+func ReadJournal(h GetterHop, seq uint64, wait bool) (recs []*JournalRecord, err error) {
+	version := uint64(Any)
+	if wait {
+		version = seq + 1
+	}
+
+	_, val, err := h.Get(JournalPrefix+strconv.FormatUint(seq, 10), version)
+	if err != nil {
+		return
+	}
+
+	return UnpackJournal(val)
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kchop
+
+/*
+#cgo pkg-config: kyotocabinet
+
+#include <stdlib.h>
+#include <kclangc.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"hop"
+	"time"
+	"unsafe"
+)
+
+// History
+//
+// The old versions are kept in a separate tree database (the file name of
+// the Hop with ".hist.kct" appended), so they are ordered by key. For each
+// key the database contains:
+//
+//	<key> 0				history parameters set by the Create
+//					flags: n[8] window[8]
+//	<key> 0 <version in hex>	replaced value: time[8] value
+//
+// The database is opened when SetHistory is called, or when an entry is
+// created with the history flag.
+
+// Sets the history retention for the entries created without the
+// history flag. Zero n and window disable the history.
+func (h *KCHop) SetHistory(n int, window time.Duration) (err error) {
+	h.hlock.Lock()
+	defer h.hlock.Unlock()
+
+	h.histn = n
+	h.histage = window
+	if n == 0 && window == 0 {
+		return
+	}
+
+	return h.openHistory()
+}
+
+// called with hlock held
+func (h *KCHop) openHistory() error {
+	if h.hdb != nil {
+		return nil
+	}
+
+	hdb := C.kcdbnew()
+	cname := C.CString(h.filename + ".hist.kct")
+	defer C.free(unsafe.Pointer(cname))
+	if C.kcdbopen(hdb, cname, C.KCOWRITER|C.KCOCREATE) == 0 {
+		C.kcdbdel(hdb)
+		return fmt.Errorf("can't open the history database: %s.hist.kct", h.filename)
+	}
+
+	h.hdb = hdb
+	return nil
+}
+
+func (h *KCHop) histdb() *C.KCDB {
+	h.hlock.Lock()
+	defer h.hlock.Unlock()
+	return h.hdb
+}
+
+func histPrefix(key string) []byte {
+	return append([]byte(key), 0)
+}
+
+func histKey(key string, version uint64) []byte {
+	return append(histPrefix(key), fmt.Sprintf("%016x", version)...)
+}
+
+// Called by Create for the entries with the history flag
+func (h *KCHop) setKeyHistory(key string, f *hop.Flags) (err error) {
+	h.hlock.Lock()
+	err = h.openHistory()
+	hdb := h.hdb
+	h.hlock.Unlock()
+	if err != nil {
+		return
+	}
+
+	val := make([]byte, 16)
+	hop.Pint64(uint64(f.History), val)
+	hop.Pint64(uint64(f.HistoryAge), val[8:])
+	bkey := histPrefix(key)
+	if C.kcdbset(hdb, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), (*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val))) == 0 {
+		err = h.error()
+	}
+
+	return
+}
+
+// Returns the history parameters for the key
+func (h *KCHop) historyParams(key string) (hdb *C.KCDB, n int, window time.Duration) {
+	h.hlock.Lock()
+	hdb, n, window = h.hdb, h.histn, h.histage
+	h.hlock.Unlock()
+	if hdb == nil {
+		return
+	}
+
+	var vlen C.size_t
+	bkey := histPrefix(key)
+	cval := C.kcdbget(hdb, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), &vlen)
+	if cval != nil {
+		if vlen == 16 {
+			val := C.GoBytes(unsafe.Pointer(cval), 16)
+			un, _ := hop.Gint64(val)
+			uw, _ := hop.Gint64(val[8:])
+			n, window = int(un), time.Duration(uw)
+		}
+
+		C.kcfree(unsafe.Pointer(cval))
+	}
+
+	return
+}
+
+type histRecord struct {
+	key     []byte
+	version uint64
+	t       time.Time
+}
+
+// Returns the history records of the key, the oldest first. If meta is
+// true, the parameters record is included too.
+func (h *KCHop) histRecords(hdb *C.KCDB, key string, meta bool) (recs []histRecord) {
+	prefix := histPrefix(key)
+	cur := C.kcdbcursor(hdb)
+	defer C.kccurdel(cur)
+
+	if C.kccurjumpkey(cur, (*C.char)(unsafe.Pointer(&prefix[0])), C.size_t(len(prefix))) == 0 {
+		return
+	}
+
+	for {
+		var ksz, vsz C.size_t
+		var cval *C.char
+
+		ckey := C.kccurget(cur, &ksz, &cval, &vsz, 1)
+		if ckey == nil {
+			break
+		}
+
+		k := C.GoBytes(unsafe.Pointer(ckey), C.int(ksz))
+		var v []byte
+		if vsz >= 8 {
+			v = C.GoBytes(unsafe.Pointer(cval), 8)
+		}
+		C.kcfree(unsafe.Pointer(ckey))
+
+		if len(k) < len(prefix) || string(k[0:len(prefix)]) != string(prefix) {
+			break
+		}
+
+		if len(k) == len(prefix) {
+			if meta {
+				recs = append(recs, histRecord{k, 0, time.Time{}})
+			}
+
+			continue
+		}
+
+		var r histRecord
+		if _, err := fmt.Sscanf(string(k[len(prefix):]), "%x", &r.version); err != nil || v == nil {
+			continue
+		}
+
+		tm, _ := hop.Gint64(v)
+		r.key = k
+		r.t = time.Unix(0, int64(tm))
+		recs = append(recs, r)
+	}
+
+	return
+}
+
+// Saves the replaced value and removes the versions that shouldn't be
+// retained anymore
+func (h *KCHop) saveHistory(hdb *C.KCDB, key string, n int, window time.Duration, version uint64, value []byte) {
+	now := time.Now()
+	val := make([]byte, 8+len(value))
+	hop.Pint64(uint64(now.UnixNano()), val)
+	copy(val[8:], value)
+	bkey := histKey(key, version)
+	C.kcdbset(hdb, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), (*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val)))
+
+	recs := h.histRecords(hdb, key, false)
+	m := 0
+	if n > 0 && len(recs) > n {
+		m = len(recs) - n
+	}
+
+	for window > 0 && m < len(recs) && now.Sub(recs[m].t) > window {
+		m++
+	}
+
+	for _, r := range recs[0:m] {
+		C.kcdbremove(hdb, (*C.char)(unsafe.Pointer(&r.key[0])), C.size_t(len(r.key)))
+	}
+}
+
+// Removes the history of the key, called when the entry is removed
+func (h *KCHop) removeHistory(key string) {
+	hdb := h.histdb()
+	if hdb == nil {
+		return
+	}
+
+	for _, r := range h.histRecords(hdb, key, true) {
+		C.kcdbremove(hdb, (*C.char)(unsafe.Pointer(&r.key[0])), C.size_t(len(r.key)))
+	}
+}
+
+func (h *KCHop) getVersions(key string) (ver uint64, val []byte, err error) {
+	_, ver, _, err = h.getvalue(key)
+	if err != nil || ver == 0 {
+		return
+	}
+
+	var vers []uint64
+	hdb, _, window := h.historyParams(key)
+	if hdb != nil {
+		now := time.Now()
+		for _, r := range h.histRecords(hdb, key, false) {
+			if window == 0 || now.Sub(r.t) <= window {
+				vers = append(vers, r.version)
+			}
+		}
+	}
+
+	vers = append(vers, ver)
+	return ver, hop.PackVersions(vers), nil
+}
+
+func (h *KCHop) getExact(key string, version uint64) (ver uint64, val []byte, err error) {
+	_, ver, val, err = h.getvalue(key)
+	if err != nil || ver == 0 || ver == version {
+		return
+	}
+
+	hdb, _, window := h.historyParams(key)
+	if hdb == nil {
+		return 0, nil, hop.Enoversion
+	}
+
+	var vlen C.size_t
+	bkey := histKey(key, version)
+	cval := C.kcdbget(hdb, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), &vlen)
+	if cval == nil {
+		return 0, nil, hop.Enoversion
+	}
+
+	hval := C.GoBytes(unsafe.Pointer(cval), C.int(vlen))
+	C.kcfree(unsafe.Pointer(cval))
+	if len(hval) < 8 {
+		return 0, nil, hop.Enoversion
+	}
+
+	tm, _ := hop.Gint64(hval)
+	if window > 0 && time.Since(time.Unix(0, int64(tm))) > window {
+		return 0, nil, hop.Enoversion
+	}
+
+	return version, hval[8:], nil
+}
@@ -11,7 +11,10 @@ import (
 	"hop/d2hop"
 	"hop/rmt/hopclnt"
 	"hop/kchop"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -21,7 +24,10 @@ var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
 var maddr = flag.String("maddr", "", "master address (master if empty)")
 var dbname = flag.String("dbname", "", "Kyoto cabinet database name")
+var histn = flag.Int("history", 0, "number of old versions to keep")
+var histage = flag.Duration("histage", 0, "how long to keep the old versions")
 var sync = flag.Bool("sync", false, "auto sync")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
@@ -34,7 +40,14 @@ func main() {
 		return
 	}
 
-	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, kchop)
+	if *histn != 0 || *histage != 0 {
+		if err := kchop.SetHistory(*histn, *histage); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, kchop, nil)
 	if err != nil {
 		fmt.Printf("Error: %v", err)
 		return
@@ -42,10 +55,22 @@ func main() {
 
 	s.SetLogger(hop.NewLogger(*logsz))
 	s.SetDebugLevel(*debug)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	tick := time.Tick(1000 * time.Millisecond)
 	for {
-		time.Sleep(1000 * time.Millisecond)
-		kchop.Sync()
-	}
+		select {
+		case <-tick:
+			kchop.Sync()
 
-	return
+		case <-sigs:
+			fmt.Printf("shutting down\n")
+			if err := s.Shutdown(*drain); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+
+			kchop.Sync()
+			return
+		}
+	}
 }
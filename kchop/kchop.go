@@ -17,6 +17,12 @@ typedef struct tsetentry {
 	char*		newval;
 	uint32_t	newvalsz;
 	int		err;
+
+	// if keepold is set, the replaced value is copied to prevval
+	int		keepold;
+	uint64_t	prevver;
+	char*		prevval;
+	uint32_t	prevvalsz;
 } tsetentry;
 
 static uint64_t getver(const char *data) {
@@ -66,6 +72,13 @@ fail:
 	if (e->oldver != ver)
 		goto fail;
 
+	if (e->keepold) {
+		e->prevver = ver;
+		e->prevval = malloc(vsiz + 1);
+		e->prevvalsz = vsiz;
+		memcpy(e->prevval, val, vsiz);
+	}
+
 	ver++;
 	if (ver > 0x7FFFFFFFFFFFFFFELL)
 		ver = 1;
@@ -87,6 +100,102 @@ static int testset(KCDB *db, const char *kbuf, size_t ksiz, void *opq) {
 	return kcdbaccept(db, kbuf, ksiz, &tsetvisit, &tsetvisitempty, opq, 1);
 }
 
+typedef struct rangeentry {
+	uint64_t	offset;
+	uint64_t	count;
+	int		truncate;
+	char*		data;		// getrange: the copied part, setrange: the data to write
+	uint64_t	datasz;
+	uint64_t	ver;
+	uint64_t	size;		// size of the value (after setrange)
+	char*		newrec;		// setrange: the new record
+	int		err;
+
+	// if keepold is set, the replaced value is copied to prevval
+	int		keepold;
+	uint64_t	prevver;
+	char*		prevval;
+	uint32_t	prevvalsz;
+} rangeentry;
+
+static const char *getrangevisit(const char *kbuf, size_t ksiz, const char *vbuf, size_t vsiz, size_t *sp, void *opq) {
+	rangeentry *e = (rangeentry *) opq;
+	uint64_t n;
+
+	if (vsiz < 8) {
+		e->err = 1;
+		return KCVISNOP;
+	}
+
+	e->ver = getver(vbuf);
+	e->size = vsiz - 8;
+	if (e->offset < e->size) {
+		n = e->size - e->offset;
+		if (n > e->count)
+			n = e->count;
+
+		e->data = malloc(n + 1);
+		e->datasz = n;
+		memcpy(e->data, &vbuf[8 + e->offset], n);
+	}
+
+	return KCVISNOP;
+}
+
+static const char *setrangevisit(const char *kbuf, size_t ksiz, const char *vbuf, size_t vsiz, size_t *sp, void *opq) {
+	rangeentry *e = (rangeentry *) opq;
+	uint64_t ver, size, nsize, end;
+
+	if (vsiz < 8) {
+		e->err = 1;
+		return KCVISNOP;
+	}
+
+	ver = getver(vbuf);
+	size = vsiz - 8;
+	end = e->offset + e->datasz;
+	nsize = size;
+	if (e->truncate || end > nsize)
+		nsize = end;
+
+	if (e->keepold) {
+		e->prevver = ver;
+		e->prevval = malloc(size + 1);
+		e->prevvalsz = size;
+		memcpy(e->prevval, &vbuf[8], size);
+	}
+
+	e->newrec = malloc(8 + nsize);
+	memcpy(&e->newrec[8], &vbuf[8], size < nsize ? size : nsize);
+	if (e->offset > size)
+		memset(&e->newrec[8 + size], 0, e->offset - size);
+
+	memcpy(&e->newrec[8 + e->offset], e->data, e->datasz);
+	ver++;
+	if (ver > 0x7FFFFFFFFFFFFFFELL)
+		ver = 1;
+
+	putver(e->newrec, ver);
+	e->ver = ver;
+	e->size = nsize;
+	*sp = 8 + nsize;
+	return e->newrec;
+}
+
+static const char *rangevisitempty(const char *kbuf, size_t ksiz, size_t *sp, void *opq) {
+	rangeentry *e = (rangeentry *) opq;
+	e->err = 1;
+	return KCVISNOP;
+}
+
+static int getrange(KCDB *db, const char *kbuf, size_t ksiz, void *opq) {
+	return kcdbaccept(db, kbuf, ksiz, &getrangevisit, &rangevisitempty, opq, 0);
+}
+
+static int setrange(KCDB *db, const char *kbuf, size_t ksiz, void *opq) {
+	return kcdbaccept(db, kbuf, ksiz, &setrangevisit, &rangevisitempty, opq, 1);
+}
+
 */
 import "C"
 
@@ -96,6 +205,7 @@ import (
 	"hop"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -110,6 +220,13 @@ type entry struct {
 type KCHop struct {
 	sync.RWMutex
 	db	*C.KCDB
+	filename string
+
+	// history of the old versions (see history.go)
+	hlock	sync.Mutex
+	hdb	*C.KCDB
+	histn	int
+	histage	time.Duration
 
 	// the entries map contains "interesting" entries, i.e. 
 	// entries with pending operations (non-existing, or future versions)
@@ -125,6 +242,7 @@ var Einval = errors.New("invalid value")
 func NewKCHop(filename string, sync bool) (*KCHop, error) {
 	h := new(KCHop)
 	h.db = C.kcdbnew()
+	h.filename = filename
 
 	cname := C.CString(filename)
 	defer C.free(unsafe.Pointer(cname))
@@ -251,6 +369,11 @@ func (h *KCHop) Create(key, flags string, value []byte) (version uint64, err err
 		return 0, Enil
 	}
 
+	f, err := hop.ParseFlags(flags)
+	if err != nil {
+		return
+	}
+
 	kcval := valueToKcval(hop.Lowest, value)
 	bkey := ([]byte)(key)
 	ckey := (*C.char)(unsafe.Pointer(&bkey[0]))
@@ -260,6 +383,12 @@ func (h *KCHop) Create(key, flags string, value []byte) (version uint64, err err
 		return
 	}
 
+	if f.History != 0 || f.HistoryAge != 0 {
+		if err = h.setKeyHistory(key, f); err != nil {
+			return
+		}
+	}
+
 	h.Lock()
 	e := h.entries[key]
 	if e != nil {
@@ -284,6 +413,7 @@ func (h *KCHop) Remove(key string) (err error) {
 		return
         }
 
+	h.removeHistory(key)
 	h.Lock()
 	e := h.entries[key]
 	if e != nil {
@@ -345,7 +475,24 @@ func (h *KCHop) getvalue(key string) (k string, ver uint64, val []byte, err erro
 	return
 }
 
+// The cabinet keeps only the version and the value of the entries, the rest
+// of the metadata is not available.
+func (h *KCHop) Stat(key string) (st *hop.Stat, err error) {
+	_, ver, val, err := h.getvalue(key)
+	if err != nil || ver == 0 {
+		return nil, err
+	}
+
+	return &hop.Stat{Version: ver, Size: uint64(len(val))}, nil
+}
+
 func (h *KCHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if strings.HasPrefix(key, hop.VersionsPrefix) {
+		return h.getVersions(key[len(hop.VersionsPrefix):])
+	} else if v, k, ok := hop.ParseVersionKey(key); ok {
+		return h.getExact(k, v)
+	}
+
 	key, ver, val, err = h.getvalue(key)
 	if err != nil {
 		return
@@ -432,6 +579,11 @@ func (h *KCHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 	t.oldvalsz = C.uint32_t(len(oldvalue))
 	t.newval = cnewval
 	t.newvalsz = C.uint32_t(len(newval))
+	hdb, histn, histage := h.historyParams(key)
+	if hdb != nil && (histn != 0 || histage != 0) {
+		t.keepold = 1
+	}
+
 	bkey := []byte(key)
 	if C.testset(h.db, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), unsafe.Pointer(&t)) == 0 {
 		err = h.error()
@@ -443,6 +595,11 @@ func (h *KCHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 		return
 	} else {
 		ver = uint64(t.newver)
+		if t.prevval != nil {
+			h.saveHistory(hdb, key, histn, histage, uint64(t.prevver), C.GoBytes(unsafe.Pointer(t.prevval), C.int(t.prevvalsz)))
+			C.free(unsafe.Pointer(t.prevval))
+		}
+
 		if t.newval == cnewval {
 			val = value
 		} else {
@@ -472,6 +629,183 @@ func (h *KCHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 	return
 }
 
+// Only the requested part of the value is copied out of the cabinet. The
+// virtual entries and the calls that wait for a version get the whole
+// value.
+func (h *KCHop) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	var r C.rangeentry
+
+	if strings.HasPrefix(key, "#/") || (version != hop.Any && version != hop.Newest) {
+		ver, val, err = h.Get(key, version)
+		if err != nil || ver == 0 {
+			return 0, 0, nil, err
+		}
+
+		return ver, uint64(len(val)), hop.RangeOf(val, offset, count), nil
+	}
+
+	r.offset = C.uint64_t(offset)
+	r.count = C.uint64_t(count)
+	bkey := []byte(key)
+	if C.getrange(h.db, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), unsafe.Pointer(&r)) == 0 {
+		err = h.error()
+		return
+	}
+
+	if r.err != 0 {
+		// no such entry
+		return
+	}
+
+	ver = uint64(r.ver)
+	size = uint64(r.size)
+	if r.data != nil {
+		val = C.GoBytes(unsafe.Pointer(r.data), C.int(r.datasz))
+		C.free(unsafe.Pointer(r.data))
+	} else {
+		val = []byte{}
+	}
+
+	return
+}
+
+// The new record is built in the cabinet's visitor, the value is not
+// copied to Go.
+func (h *KCHop) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	var r C.rangeentry
+
+	if strings.HasPrefix(key, "#/") {
+		return 0, hop.Eperm
+	}
+
+	r.offset = C.uint64_t(offset)
+	if len(data) > 0 {
+		r.data = (*C.char)(unsafe.Pointer(&data[0]))
+	}
+
+	r.datasz = C.uint64_t(len(data))
+	if truncate {
+		r.truncate = 1
+	}
+
+	hdb, histn, histage := h.historyParams(key)
+	if hdb != nil && (histn != 0 || histage != 0) {
+		r.keepold = 1
+	}
+
+	bkey := []byte(key)
+	res := C.setrange(h.db, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), unsafe.Pointer(&r))
+	if r.newrec != nil {
+		C.free(unsafe.Pointer(r.newrec))
+	}
+
+	if res == 0 {
+		err = h.error()
+		return
+	}
+
+	if r.err != 0 {
+		// no entry, nothing to modify
+		return 0, nil
+	}
+
+	ver = uint64(r.ver)
+	if r.prevval != nil {
+		h.saveHistory(hdb, key, histn, histage, uint64(r.prevver), C.GoBytes(unsafe.Pointer(r.prevval), C.int(r.prevvalsz)))
+		C.free(unsafe.Pointer(r.prevval))
+	}
+
+	// notify waiters, they need the whole value
+	h.RLock()
+	e := h.entries[key]
+	h.RUnlock()
+	if e != nil {
+		_, nver, nval, gerr := h.getvalue(key)
+		e.Lock()
+		if gerr == nil && e.version < nver {
+			e.version = nver
+			e.value = nval
+		}
+		e.Unlock()
+		e.Broadcast()
+	}
+
+	h.keysModified()
+	return
+}
+
 func (s *KCHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
 	return 0, nil, errors.New("not implemented")
 }
+
+// Calls visit for each record in the cabinet, in the cabinet's order. The
+// records that are too short to contain a version are passed with version
+// zero and their raw content as value.
+func (h *KCHop) VisitEntries(visit func(key string, version uint64, value []byte) error) (err error) {
+	cur := C.kcdbcursor(h.db)
+	defer C.kccurdel(cur)
+
+	if C.kccurjump(cur) == 0 {
+		// empty cabinet
+		return nil
+	}
+
+	for {
+		var ksz, vsz C.size_t
+		var cval *C.char
+
+		ckey := C.kccurget(cur, &ksz, &cval, &vsz, 1)
+		if ckey == nil {
+			break
+		}
+
+		key := C.GoStringN(ckey, C.int(ksz))
+		kcval := C.GoBytes(unsafe.Pointer(cval), C.int(vsz))
+		C.kcfree(unsafe.Pointer(ckey))
+
+		ver, val := uint64(0), kcval
+		if len(kcval) >= 8 {
+			ver, val = kcvalToValue(kcval)
+		}
+
+		if err = visit(key, ver, val); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Stores the entry with the specified version, replacing the existing one.
+// Used to load data from other sources.
+func (h *KCHop) PutEntry(key string, version uint64, value []byte) (err error) {
+	if key == "" || strings.HasPrefix(key, "#/") {
+		return hop.Eperm
+	}
+
+	kcval := valueToKcval(version, value)
+	bkey := []byte(key)
+	if C.kcdbset(h.db, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), (*C.char)(unsafe.Pointer(&kcval[0])), C.size_t(len(kcval))) == 0 {
+		return h.error()
+	}
+
+	h.keysModified()
+	return
+}
+
+func (h *KCHop) Close() (err error) {
+	if C.kcdbclose(h.db) == 0 {
+		err = h.error()
+	}
+
+	C.kcdbdel(h.db)
+	h.hlock.Lock()
+	if h.hdb != nil {
+		C.kcdbclose(h.hdb)
+		C.kcdbdel(h.hdb)
+		h.hdb = nil
+	}
+	h.hlock.Unlock()
+
+	return
+}
@@ -11,6 +11,9 @@ import (
 	"hop/rmt"
 	"hop/rmt/hopsrv"
 	"hop/kchop"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -19,9 +22,12 @@ var addr = flag.String("addr", ":5004", "network address")
 var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
 var dbname = flag.String("db", "", "database name")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
 	if *dbname == "" {
 		fmt.Printf("Error: missing database name\n")
 		return
@@ -48,8 +54,10 @@ func main() {
 	}
 
 	fmt.Printf("Listening on %v\n", laddr)
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	<-sigs
+	fmt.Printf("shutting down\n")
+	if err := rmtsrv.Shutdown(*drain); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
 	return
 
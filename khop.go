@@ -24,6 +24,7 @@ import (
 type KHop struct {
 	sync.RWMutex
 	entries map[string]*Entry
+	snaps   []*Snapshot // snapshots being captured (see snapshot.go)
 }
 
 type Entry struct {
@@ -88,6 +89,11 @@ func (h *KHop) FindEntry(key string) (ops interface{}) {
 // If ops is a pointer to a struct that has field of type Entry,
 // that entry is initialized and its value is put in the entries map.
 func (h *KHop) AddEntry(key string, val []byte, ops interface{}) (e *Entry, err error) {
+	return h.AddEntryVersion(key, val, ops, Lowest)
+}
+
+// Same as AddEntry, but the entry starts with the specified version
+func (h *KHop) AddEntryVersion(key string, val []byte, ops interface{}, version uint64) (e *Entry, err error) {
 	var oe *Entry
 
 	e = tryFindEntry(ops)
@@ -97,7 +103,7 @@ func (h *KHop) AddEntry(key string, val []byte, ops interface{}) (e *Entry, err
 	}
 
 	e.L = e.RLocker()
-	e.Version = Lowest
+	e.Version = version
 	e.Value = val
 	e.ops = ops
 
@@ -131,6 +137,13 @@ func (h *KHop) RemoveEntry(key string) (err error) {
 	var e *Entry
 	var ok bool
 
+	h.RLock()
+	e = h.entries[key]
+	h.RUnlock()
+	if e != nil {
+		h.preserve(key, e)
+	}
+
 	h.Lock()
 	if e, ok = h.entries[key]; ok {
 		if e.Version != 0 {
@@ -189,6 +202,10 @@ func (h *KHop) ExportEntries(match func(key string) bool) (es []byte) {
 		}
 
 		if match(key) {
+			for _, s := range h.snaps {
+				s.preserve(key, e)
+			}
+
 			delete(h.entries, key)
 
 			e.Lock()
@@ -245,6 +262,10 @@ func (h *KHop) ImportKeys(es []byte, replace bool) (rejected []string, err error
 			if !replace {
 				rejected = append(rejected, key)
 			} else {
+				for _, s := range h.snaps {
+					s.preserve(key, e)
+				}
+
 				// we need to inform the waiters that the 
 				// entry was removed
 				e.Lock()
@@ -275,6 +296,21 @@ func (h *KHop) Remove(key string) (err error) {
 	return Eperm
 }
 
+// Returns the metadata of the entry. If the entry doesn't implement
+// StatHop, only its version and size are returned.
+func (h *KHop) Stat(key string) (st *Stat, err error) {
+	if sop, ok := h.FindEntry(key).(StatHop); ok {
+		return sop.Stat(key)
+	}
+
+	ver, val, err := h.Get(key, Any)
+	if err != nil || ver == 0 {
+		return nil, err
+	}
+
+	return &Stat{Version: ver, Size: uint64(len(val))}, nil
+}
+
 func (h *KHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
 again:
 	h.RLock()
@@ -384,6 +420,7 @@ func (h *KHop) Set(key string, value []byte) (ver uint64, err error) {
 		return 0, Eperm
 	}
 
+	h.preserve(key, e)
 	ver, err = shop.Set(key, value)
 	if err == nil && ver != oldver {
 		e.Modified()
@@ -414,6 +451,7 @@ func (h *KHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (v
 		return 0, nil, Eperm
 	}
 
+	h.preserve(key, e)
 	ver, val, err = tshop.TestSet(key, oldversion, oldvalue, value)
 	if err == nil && ver != oldver {
 		e.Modified()
@@ -444,6 +482,7 @@ func (h *KHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals
 		return 0, nil, Eperm
 	}
 
+	h.preserve(key, e)
 	ver, vals, err = ashop.Atomic(key, op, values)
 	if err == nil && ver != oldver {
 		e.Modified()
@@ -452,6 +491,53 @@ func (h *KHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals
 	return
 }
 
+// Reads part of the value from the entry if it implements RangeHop.
+// Otherwise, or if the call needs to wait for a version, gets the whole
+// value.
+func (h *KHop) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	if version == Any || version == Newest {
+		if rhop, ok := h.FindEntry(key).(RangeHop); ok {
+			return rhop.GetRange(key, version, offset, count)
+		}
+	}
+
+	return getRange(h, key, version, offset, count)
+}
+
+func (h *KHop) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	h.RLock()
+	e, ok := h.entries[key]
+	if ok && e.Version == 0 {
+		// we only have the fake entry
+		ok = false
+	}
+	h.RUnlock()
+
+	if !ok {
+		return 0, nil
+	}
+
+	e.RLock()
+	oldver := e.Version
+	rhop, ok := e.ops.(RangeHop)
+	_, setok := e.ops.(SetterHop)
+	e.RUnlock()
+
+	if !ok && !setok {
+		return 0, Eperm
+	} else if !ok {
+		return setRange(h, key, offset, data, truncate)
+	}
+
+	h.preserve(key, e)
+	ver, err = rhop.SetRange(key, offset, data, truncate)
+	if err == nil && ver != oldver {
+		e.Modified()
+	}
+
+	return
+}
+
 // should be called with e lock held
 func (e *Entry) IncreaseVersion() {
 	e.Version++
@@ -0,0 +1,286 @@
+// Copyright 2015 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lvldbhop
+
+/*
+#cgo LDFLAGS: -lleveldb
+
+#include <stdlib.h>
+#include <leveldb/c.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"hop"
+	"time"
+	"unsafe"
+)
+
+// History
+//
+// The old versions are kept in a separate database (the file name of the
+// Hop with ".hist" appended). For each key the database contains:
+//
+//	<key> 0				history parameters set by the Create
+//					flags: n[8] window[8]
+//	<key> 0 <version in hex>	replaced value: time[8] value
+//
+// The database is opened when SetHistory is called, or when an entry is
+// created with the history flag.
+
+// Sets the history retention for the entries created without the
+// history flag. Zero n and window disable the history.
+func (h *LDHop) SetHistory(n int, window time.Duration) (err error) {
+	h.hlock.Lock()
+	defer h.hlock.Unlock()
+
+	h.histn = n
+	h.histage = window
+	if n == 0 && window == 0 {
+		return
+	}
+
+	return h.openHistory()
+}
+
+// called with hlock held
+func (h *LDHop) openHistory() error {
+	var cerr *C.char
+
+	if h.hdb != nil {
+		return nil
+	}
+
+	cname := C.CString(h.filename + ".hist")
+	defer C.free(unsafe.Pointer(cname))
+	hdb := C.leveldb_open(h.opts, cname, &cerr)
+	if cerr != nil {
+		err := errors.New(C.GoString(cerr))
+		C.free(unsafe.Pointer(cerr))
+		return err
+	}
+
+	h.hdb = hdb
+	return nil
+}
+
+func (h *LDHop) histdb() *C.leveldb_t {
+	h.hlock.Lock()
+	defer h.hlock.Unlock()
+	return h.hdb
+}
+
+func histPrefix(key string) []byte {
+	return append([]byte(key), 0)
+}
+
+func histKey(key string, version uint64) []byte {
+	return append(histPrefix(key), fmt.Sprintf("%016x", version)...)
+}
+
+func (h *LDHop) histPut(hdb *C.leveldb_t, key, val []byte) (err error) {
+	var cerr *C.char
+
+	C.leveldb_put(hdb, h.wopts, (*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)), (*C.char)(unsafe.Pointer(&val[0])), C.size_t(len(val)), &cerr)
+	if cerr != nil {
+		err = errors.New(C.GoString(cerr))
+		C.free(unsafe.Pointer(cerr))
+	}
+
+	return
+}
+
+func (h *LDHop) histGet(hdb *C.leveldb_t, key []byte) (val []byte) {
+	var vlen C.size_t
+	var cerr *C.char
+
+	cdata := C.leveldb_get(hdb, h.ropts, (*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)), &vlen, &cerr)
+	if cerr != nil {
+		C.free(unsafe.Pointer(cerr))
+		return nil
+	}
+
+	if cdata != nil {
+		val = C.GoBytes(unsafe.Pointer(cdata), C.int(vlen))
+		C.leveldb_free(unsafe.Pointer(cdata))
+	}
+
+	return
+}
+
+func (h *LDHop) histDelete(hdb *C.leveldb_t, key []byte) {
+	var cerr *C.char
+
+	C.leveldb_delete(hdb, h.wopts, (*C.char)(unsafe.Pointer(&key[0])), C.size_t(len(key)), &cerr)
+	if cerr != nil {
+		C.free(unsafe.Pointer(cerr))
+	}
+}
+
+// Called by Create for the entries with the history flag
+func (h *LDHop) setKeyHistory(key string, f *hop.Flags) (err error) {
+	h.hlock.Lock()
+	err = h.openHistory()
+	hdb := h.hdb
+	h.hlock.Unlock()
+	if err != nil {
+		return
+	}
+
+	val := make([]byte, 16)
+	hop.Pint64(uint64(f.History), val)
+	hop.Pint64(uint64(f.HistoryAge), val[8:])
+	return h.histPut(hdb, histPrefix(key), val)
+}
+
+// Returns the history parameters for the key
+func (h *LDHop) historyParams(key string) (hdb *C.leveldb_t, n int, window time.Duration) {
+	h.hlock.Lock()
+	hdb, n, window = h.hdb, h.histn, h.histage
+	h.hlock.Unlock()
+	if hdb == nil {
+		return
+	}
+
+	if val := h.histGet(hdb, histPrefix(key)); len(val) == 16 {
+		un, _ := hop.Gint64(val)
+		uw, _ := hop.Gint64(val[8:])
+		n, window = int(un), time.Duration(uw)
+	}
+
+	return
+}
+
+type histRecord struct {
+	key     []byte
+	version uint64
+	t       time.Time
+}
+
+// Returns the history records of the key, the oldest first. If meta is
+// true, the parameters record is included too.
+func (h *LDHop) histRecords(hdb *C.leveldb_t, key string, meta bool) (recs []histRecord) {
+	prefix := histPrefix(key)
+	it := C.leveldb_create_iterator(hdb, h.ropts)
+	defer C.leveldb_iter_destroy(it)
+
+	C.leveldb_iter_seek(it, (*C.char)(unsafe.Pointer(&prefix[0])), C.size_t(len(prefix)))
+	for ; C.leveldb_iter_valid(it) != 0; C.leveldb_iter_next(it) {
+		var ksz, vsz C.size_t
+
+		k := C.GoBytes(unsafe.Pointer(C.leveldb_iter_key(it, &ksz)), C.int(ksz))
+		if len(k) < len(prefix) || string(k[0:len(prefix)]) != string(prefix) {
+			break
+		}
+
+		if len(k) == len(prefix) {
+			if meta {
+				recs = append(recs, histRecord{k, 0, time.Time{}})
+			}
+
+			continue
+		}
+
+		var r histRecord
+		if _, err := fmt.Sscanf(string(k[len(prefix):]), "%x", &r.version); err != nil {
+			continue
+		}
+
+		cval := C.leveldb_iter_value(it, &vsz)
+		if vsz < 8 {
+			continue
+		}
+
+		tm, _ := hop.Gint64(C.GoBytes(unsafe.Pointer(cval), 8))
+		r.key = k
+		r.t = time.Unix(0, int64(tm))
+		recs = append(recs, r)
+	}
+
+	return
+}
+
+// Saves the replaced value and removes the versions that shouldn't be
+// retained anymore
+func (h *LDHop) saveHistory(hdb *C.leveldb_t, key string, n int, window time.Duration, version uint64, value []byte) {
+	now := time.Now()
+	val := make([]byte, 8+len(value))
+	hop.Pint64(uint64(now.UnixNano()), val)
+	copy(val[8:], value)
+	h.histPut(hdb, histKey(key, version), val)
+
+	recs := h.histRecords(hdb, key, false)
+	m := 0
+	if n > 0 && len(recs) > n {
+		m = len(recs) - n
+	}
+
+	for window > 0 && m < len(recs) && now.Sub(recs[m].t) > window {
+		m++
+	}
+
+	for _, r := range recs[0:m] {
+		h.histDelete(hdb, r.key)
+	}
+}
+
+// Removes the history of the key, called when the entry is removed
+func (h *LDHop) removeHistory(key string) {
+	hdb := h.histdb()
+	if hdb == nil {
+		return
+	}
+
+	for _, r := range h.histRecords(hdb, key, true) {
+		h.histDelete(hdb, r.key)
+	}
+}
+
+func (h *LDHop) getVersions(key string) (ver uint64, val []byte, err error) {
+	_, ver, _, err = h.getvalue(key)
+	if err != nil || ver == 0 {
+		return
+	}
+
+	var vers []uint64
+	hdb, _, window := h.historyParams(key)
+	if hdb != nil {
+		now := time.Now()
+		for _, r := range h.histRecords(hdb, key, false) {
+			if window == 0 || now.Sub(r.t) <= window {
+				vers = append(vers, r.version)
+			}
+		}
+	}
+
+	vers = append(vers, ver)
+	return ver, hop.PackVersions(vers), nil
+}
+
+func (h *LDHop) getExact(key string, version uint64) (ver uint64, val []byte, err error) {
+	_, ver, val, err = h.getvalue(key)
+	if err != nil || ver == 0 || ver == version {
+		return
+	}
+
+	hdb, _, window := h.historyParams(key)
+	if hdb == nil {
+		return 0, nil, hop.Enoversion
+	}
+
+	hval := h.histGet(hdb, histKey(key, version))
+	if len(hval) < 8 {
+		return 0, nil, hop.Enoversion
+	}
+
+	tm, _ := hop.Gint64(hval)
+	if window > 0 && time.Since(time.Unix(0, int64(tm))) > window {
+		return 0, nil, hop.Enoversion
+	}
+
+	return version, hval[8:], nil
+}
@@ -11,7 +11,10 @@ import (
 	"hop/d2hop"
 	"hop/rmt/hopclnt"
 	"hop/lvldbhop"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +24,9 @@ var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
 var maddr = flag.String("maddr", "", "master address (master if empty)")
 var dbname = flag.String("dbname", "", "Leveldb database name")
+var histn = flag.Int("history", 0, "number of old versions to keep")
+var histage = flag.Duration("histage", 0, "how long to keep the old versions")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
@@ -33,7 +39,14 @@ func main() {
 		return
 	}
 
-	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, ldhop)
+	if *histn != 0 || *histage != 0 {
+		if err := ldhop.SetHistory(*histn, *histage); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+
+	s, err := d2hop.NewD2Hop(*proto, *addr, *maddr, ldhop, nil)
 	if err != nil {
 		fmt.Printf("Error: %v", err)
 		return
@@ -41,9 +54,11 @@ func main() {
 
 	s.SetLogger(hop.NewLogger(*logsz))
 	s.SetDebugLevel(*debug)
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	<-sigs
+	fmt.Printf("shutting down\n")
+	if err := s.Shutdown(*drain); err != nil {
+		fmt.Printf("Error: %v\n", err)
 	}
-
-	return
 }
@@ -22,6 +22,7 @@ import (
 	"hop"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -36,6 +37,7 @@ type entry struct {
 type LDHop struct {
 	sync.RWMutex
 	db	*C.leveldb_t
+	filename string
 	opts	*C.leveldb_options_t
 	cmp	*C.leveldb_comparator_t
 	flt	*C.leveldb_filterpolicy_t
@@ -44,6 +46,12 @@ type LDHop struct {
 	wopts	*C.leveldb_writeoptions_t
 	ropts	*C.leveldb_readoptions_t
 
+	// history of the old versions (see history.go)
+	hlock	sync.Mutex
+	hdb	*C.leveldb_t
+	histn	int
+	histage	time.Duration
+
 	// the entries map contains "interesting" entries, i.e. 
 	// entries with pending operations (non-existing, or future versions)
 	entries	map[string] *entry
@@ -59,6 +67,7 @@ func NewLDHop(filename string, cachesz uint64, wbufsz uint64, bloomsz int) (*LDH
 	var err *C.char
 
 	h := new(LDHop)
+	h.filename = filename
 	h.opts = C.leveldb_options_create()
 	C.leveldb_options_set_create_if_missing(h.opts, 1);
 
@@ -186,6 +195,11 @@ func (h *LDHop) Create(key, flags string, value []byte) (version uint64, err err
 		return 0, Enil
 	}
 
+	f, err := hop.ParseFlags(flags)
+	if err != nil {
+		return
+	}
+
 	ckey := C.CString(key)
 	defer C.free(unsafe.Pointer(ckey))
 	cvalue := valueToLdval(hop.Lowest, value)
@@ -196,6 +210,12 @@ func (h *LDHop) Create(key, flags string, value []byte) (version uint64, err err
 		return
 	}
 
+	if f.History != 0 || f.HistoryAge != 0 {
+		if err = h.setKeyHistory(key, f); err != nil {
+			return
+		}
+	}
+
 	h.Lock()
 	e := h.entries[key]
 	if e != nil {
@@ -225,6 +245,7 @@ func (h *LDHop) Remove(key string) (err error) {
 		return
 	}
 
+	h.removeHistory(key)
 	h.Lock()
 	e := h.entries[key]
 	if e != nil {
@@ -289,7 +310,24 @@ func (h *LDHop) getvalue(key string) (k string, ver uint64, val []byte, err erro
 	return
 }
 
+// The database keeps only the version and the value of the entries, the
+// rest of the metadata is not available.
+func (h *LDHop) Stat(key string) (st *hop.Stat, err error) {
+	_, ver, val, err := h.getvalue(key)
+	if err != nil || ver == 0 {
+		return nil, err
+	}
+
+	return &hop.Stat{Version: ver, Size: uint64(len(val))}, nil
+}
+
 func (h *LDHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if strings.HasPrefix(key, hop.VersionsPrefix) {
+		return h.getVersions(key[len(hop.VersionsPrefix):])
+	} else if v, k, ok := hop.ParseVersionKey(key); ok {
+		return h.getExact(k, v)
+	}
+
 	key, ver, val, err = h.getvalue(key)
 	if err != nil {
 		return
@@ -357,12 +395,46 @@ func (h *LDHop) Set(key string, value []byte) (ver uint64, err error) {
 }
 
 func (h *LDHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
-	var cerr *C.char
-
 	if value == nil {
 		return 0, nil, Enil
 	}
 
+	return h.modify(key, func(curver uint64, curval []byte) ([]byte, error) {
+		if oldversion == hop.Any {
+			oldversion = curver
+		} else if oldversion < hop.Lowest || oldversion > hop.Highest {
+			return nil, errors.New("invalid version")
+		}
+
+		if oldversion != curver {
+			return nil, nil
+		}
+
+		if oldvalue != nil {
+			if len(oldvalue) != len(curval) {
+				return nil, nil
+			}
+
+			for i, s := range oldvalue {
+				if s != curval[i] {
+					return nil, nil
+				}
+			}
+		}
+
+		return value, nil
+	})
+}
+
+// Reads the current version and value of the entry and replaces the value
+// with the one returned by update, unless it is nil. Returns the version
+// of the entry and its value before the update.
+func (h *LDHop) modify(key string, update func(curver uint64, curval []byte) ([]byte, error)) (ver uint64, val []byte, err error) {
+	var cerr *C.char
+	var prevver uint64
+	var value []byte
+
+	hdb, histn, histage := h.historyParams(key)
 	h.Lock()
 	e := h.entries[key]
 	if e == nil {
@@ -384,30 +456,11 @@ func (h *LDHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 	changed := false
 	ver = e.version
 	val = e.value
-
-	if oldversion == hop.Any {
-		oldversion = e.version
-	} else if oldversion < hop.Lowest || oldversion > hop.Highest {
-		err = errors.New("invalid version")
+	if value, err = update(e.version, e.value); err != nil || value == nil {
 		goto done
 	}
 
-        if oldversion != e.version {
-                goto done
-        }
-
-        if oldvalue != nil {
-                if len(oldvalue) != len(e.value) {
-                        goto done
-                }
-
-                for i, s := range oldvalue {
-                        if s != e.value[i] {
-                                goto done
-                        }
-                }
-        }
-
+        prevver = e.version
         e.IncreaseVersion()
         ver = e.version
 
@@ -422,6 +475,10 @@ func (h *LDHop)	TestSet(key string, oldversion uint64, oldvalue, value []byte) (
 			goto done
 		}
 
+		if hdb != nil && (histn != 0 || histage != 0) {
+			h.saveHistory(hdb, key, histn, histage, prevver, val)
+		}
+
 		_, e.value = ldvalToValue(cvalue)		// save one slice allocation
 		changed = true
 	}
@@ -453,6 +510,134 @@ done:
 	return
 }
 
+// LevelDB can't read part of a value, so the whole value is read from the
+// database, but only the requested part is copied.
+func (h *LDHop) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	var vlen C.size_t
+	var cerr *C.char
+
+	if strings.HasPrefix(key, "#/") || (version != hop.Any && version != hop.Newest) {
+		ver, val, err = h.Get(key, version)
+		if err != nil || ver == 0 {
+			return 0, 0, nil, err
+		}
+
+		return ver, uint64(len(val)), hop.RangeOf(val, offset, count), nil
+	}
+
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	cdata := C.leveldb_get(h.db, h.ropts, ckey, C.strlen(ckey), &vlen, &cerr)
+	if cerr != nil {
+		err = errors.New(C.GoString(cerr))
+		C.free(unsafe.Pointer(cerr))
+		return
+	}
+
+	if cdata == nil {
+		return
+	}
+
+	defer C.leveldb_free(unsafe.Pointer(cdata))
+	if vlen < 8 {
+		return 0, 0, nil, Einval
+	}
+
+	hdr := C.GoBytes(unsafe.Pointer(cdata), 8)
+	ver, _ = hop.Gint64(hdr)
+	size = uint64(vlen) - 8
+	if offset >= size {
+		return ver, size, []byte{}, nil
+	}
+
+	if count > size-offset {
+		count = size - offset
+	}
+
+	val = C.GoBytes(unsafe.Pointer(uintptr(unsafe.Pointer(cdata))+uintptr(8+offset)), C.int(count))
+	return
+}
+
+// The value is read, modified and written back whole, under the entry's
+// lock.
+func (h *LDHop) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	if strings.HasPrefix(key, "#/") {
+		return 0, hop.Eperm
+	}
+
+	ver, _, err = h.modify(key, func(curver uint64, curval []byte) ([]byte, error) {
+		if curver == 0 {
+			return nil, nil
+		}
+
+		return hop.Splice(curval, offset, data, truncate, false), nil
+	})
+
+	return
+}
+
 func (s *LDHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
 	return 0, nil, errors.New("not implemented")
 }
+
+// Calls visit for each record in the database, ordered by key. The records
+// that are too short to contain a version are passed with version zero and
+// their raw content as value.
+func (h *LDHop) VisitEntries(visit func(key string, version uint64, value []byte) error) (err error) {
+	it := C.leveldb_create_iterator(h.db, h.ropts)
+	defer C.leveldb_iter_destroy(it)
+
+	for C.leveldb_iter_seek_to_first(it); C.leveldb_iter_valid(it) != 0; C.leveldb_iter_next(it) {
+		var ksz, vsz C.size_t
+
+		ckey := C.leveldb_iter_key(it, &ksz)
+		key := C.GoStringN(ckey, C.int(ksz))
+		cval := C.leveldb_iter_value(it, &vsz)
+		ldval := C.GoBytes(unsafe.Pointer(cval), C.int(vsz))
+
+		ver, val := uint64(0), ldval
+		if len(ldval) >= 8 {
+			ver, val = ldvalToValue(ldval)
+		}
+
+		if err = visit(key, ver, val); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Stores the entry with the specified version, replacing the existing one.
+// Used to load data from other sources.
+func (h *LDHop) PutEntry(key string, version uint64, value []byte) (err error) {
+	var cerr *C.char
+
+	if key == "" || strings.HasPrefix(key, "#/") {
+		return hop.Eperm
+	}
+
+	bkey := []byte(key)
+	ldval := valueToLdval(version, value)
+	C.leveldb_put(h.db, h.wopts, (*C.char)(unsafe.Pointer(&bkey[0])), C.size_t(len(bkey)), (*C.char)(unsafe.Pointer(&ldval[0])), C.size_t(len(ldval)), &cerr)
+	if cerr != nil {
+		err = errors.New(C.GoString(cerr))
+		C.free(unsafe.Pointer(cerr))
+		return
+	}
+
+	h.keysModified()
+	return
+}
+
+func (h *LDHop) Close() error {
+	C.leveldb_close(h.db)
+	h.hlock.Lock()
+	if h.hdb != nil {
+		C.leveldb_close(h.hdb)
+		h.hdb = nil
+	}
+	h.hlock.Unlock()
+
+	return nil
+}
@@ -5,18 +5,63 @@
 package hop
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // MHop is a Hop implementation that allows redirection to other Hop
 // implmenentations based on the key prefix.
+//
+// The special entries #/keys, #/keys:<regexp> and #/keynum are not routed
+// to a single Hop. MHop reads them from the default Hop and from all
+// mounted Hops and combines the results. If a Hop was mounted with
+// cutprefix, the mount's prefix is prepended to the key names it reports
+// so the names in the combined list can be used with MHop directly. The
+// version of a combined entry is the sum of the versions of the entries
+// it was built from, so it increases when any of the Hops changes.
 
 type MHop struct {
 	dflt  interface{}
 	root  *mnode
 	minid int
 	maxid int
+
+	watches watchSet
+}
+
+// The pending Gets of the entries the combined entries are built from
+type watchSet struct {
+	sync.Mutex
+	watches map[mwkey]*mwatch
+}
+
+// A pending Get of the entry of one of the Hops, shared by the waitAll
+// calls that wait for the same version
+type mwkey struct {
+	hop     GetterHop
+	key     string
+	version uint64
+}
+
+type mwatch struct {
+	subs []mwsub
+}
+
+type mwsub struct {
+	idx int
+	c   chan *mresult
+}
+
+type mresult struct {
+	idx int
+	ver uint64
+	val []byte
+	err error
 }
 
 type mnode struct {
@@ -50,6 +95,11 @@ func (m *MHop) AddAfter(pattern string, exact bool, cutprefix bool, hop interfac
 	return m.add(m.maxid, pattern, exact, cutprefix, hop)
 }
 
+// Adds an overlay mount (see OHop) with upper and lower Hops for the pattern.
+func (m *MHop) AddOverlay(pattern string, exact bool, cutprefix bool, upper Hop, lower GetterHop) error {
+	return m.AddAfter(pattern, exact, cutprefix, NewOHop(upper, lower))
+}
+
 func (m *MHop) Create(key, flags string, value []byte) (ver uint64, err error) {
 	hop, nkey := m.find(key)
 
@@ -71,6 +121,26 @@ func (m *MHop) Remove(key string) (err error) {
 }
 
 func (m *MHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key == "#/keys" || key == "#/keynum" || strings.HasPrefix(key, "#/keys:") {
+		return m.getAll(key, version)
+	} else if strings.HasPrefix(key, FlagsPrefix) {
+		// route by the key the flags are for
+		hop, nkey := m.find(key[len(FlagsPrefix):])
+		if ghop, ok := hop.(GetterHop); ok {
+			return ghop.Get(FlagsPrefix+nkey, version)
+		}
+
+		return 0, nil, Eperm
+	} else if hkey := HistoryKey(key); hkey != key {
+		// route by the key the history is for
+		hop, nkey := m.find(hkey)
+		if ghop, ok := hop.(GetterHop); ok {
+			return ghop.Get(key[0:len(key)-len(hkey)]+nkey, version)
+		}
+
+		return 0, nil, Eperm
+	}
+
 	hop, nkey := m.find(key)
 
 	if ghop, ok := hop.(GetterHop); ok {
@@ -80,6 +150,16 @@ func (m *MHop) Get(key string, version uint64) (ver uint64, val []byte, err erro
 	}
 }
 
+func (m *MHop) Stat(key string) (st *Stat, err error) {
+	hop, nkey := m.find(key)
+
+	if ghop, ok := hop.(GetterHop); ok {
+		return GetStat(ghop, nkey)
+	} else {
+		return nil, Eperm
+	}
+}
+
 func (m *MHop) Set(key string, value []byte) (ver uint64, err error) {
 	hop, nkey := m.find(key)
 
@@ -143,6 +223,232 @@ func (m *MHop) find(key string) (hop interface{}, newkey string) {
 	return nd.hop, newkey
 }
 
+// A Hop that is reachable through the MHop, with the full prefix it was
+// mounted at
+type mmount struct {
+	prefix  string
+	cutpref bool
+	hop     GetterHop
+}
+
+// Returns the list of all Hops that implement GetterHop, starting with
+// the default one
+func (m *MHop) mounts() (ms []*mmount) {
+	if ghop, ok := m.dflt.(GetterHop); ok {
+		ms = append(ms, &mmount{"", false, ghop})
+	}
+
+	if m.root != nil {
+		ms = m.root.mounts("", ms)
+	}
+
+	return
+}
+
+func (nd *mnode) mounts(prefix string, ms []*mmount) []*mmount {
+	prefix += nd.prefix
+	if ghop, ok := nd.hop.(GetterHop); ok {
+		ms = append(ms, &mmount{prefix, nd.cutpref, ghop})
+	}
+
+	for _, nd1 := range nd.sub {
+		ms = nd1.mounts(prefix, ms)
+	}
+
+	return ms
+}
+
+// Reads the #/keys or #/keynum entry from all Hops and combines the values.
+func (m *MHop) getAll(key string, version uint64) (ver uint64, val []byte, err error) {
+	var re *regexp.Regexp
+
+	mkey := key
+	if strings.HasPrefix(key, "#/keys:") {
+		// the expression is matched against the combined names,
+		// ask the Hops for all their keys
+		re, err = regexp.Compile(key[7:])
+		if err != nil {
+			return
+		}
+
+		mkey = "#/keys"
+	}
+
+	ms := m.mounts()
+	vers := make([]uint64, len(ms))
+	vals := make([][]byte, len(ms))
+	for i, mnt := range ms {
+		vers[i], vals[i], err = mnt.hop.Get(mkey, Any)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ver += vers[i]
+	}
+
+	switch version {
+	case Any, Newest:
+		version = ver
+	case PastNewest:
+		version = ver + 1
+	}
+
+	if ver < version {
+		hops := make([]GetterHop, len(ms))
+		for i, mnt := range ms {
+			hops[i] = mnt.hop
+		}
+
+		ver, err = m.watches.waitAll(hops, mkey, version, vers, vals)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if ver == 0 {
+		// none of the Hops has the entry
+		return 0, nil, nil
+	}
+
+	if mkey == "#/keynum" {
+		var n uint64
+
+		for i, v := range vals {
+			if vers[i] == 0 {
+				continue
+			}
+
+			k, e := strconv.ParseUint(string(v), 10, 64)
+			if e != nil {
+				return 0, nil, errors.New("invalid #/keynum value: " + e.Error())
+			}
+
+			n += k
+		}
+
+		return ver, []byte(fmt.Sprintf("%d", n)), nil
+	}
+
+	kmap := make(map[string]bool)
+	val = []byte{}
+	for i, mnt := range ms {
+		if vers[i] == 0 || len(vals[i]) == 0 {
+			continue
+		}
+
+		for _, k := range bytes.Split(vals[i], []byte{0}) {
+			name := string(k)
+			if mnt.cutpref {
+				name = mnt.prefix + name
+			}
+
+			// skip keys that are hidden by another mount
+			if h, _ := m.find(name); h != mnt.hop {
+				continue
+			}
+
+			if kmap[name] || (re != nil && !re.MatchString(name)) {
+				continue
+			}
+
+			kmap[name] = true
+			val = append(val, []byte(name)...)
+			val = append(val, 0)
+		}
+	}
+
+	if len(val) > 0 {
+		// remove the trailing zero
+		val = val[0 : len(val)-1]
+	}
+
+	return
+}
+
+// Waits until the sum of the versions of the entry in all Hops reaches the
+// specified version. Updates vers and vals with the latest entry values and
+// returns the new combined version.
+// There is no way to cancel a pending Get, so the Gets waiting on the Hops
+// that didn't change stay around until their entries are modified. They
+// are shared by the calls that wait for the same versions, so repeated
+// calls don't add more of them.
+func (ws *watchSet) waitAll(hops []GetterHop, key string, version uint64, vers []uint64, vals [][]byte) (ver uint64, err error) {
+	if len(hops) == 0 {
+		return 0, nil
+	}
+
+	// at most one pending Get per Hop, so the sends never block
+	rchan := make(chan *mresult, len(hops))
+	pending := make([]bool, len(hops))
+	for {
+		ver = 0
+		for _, v := range vers {
+			ver += v
+		}
+
+		if ver >= version {
+			return
+		}
+
+		for i, ghop := range hops {
+			if pending[i] {
+				continue
+			}
+
+			pending[i] = true
+			ws.watch(ghop, key, vers[i]+1, i, rchan)
+		}
+
+		r := <-rchan
+		pending[r.idx] = false
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.ver > vers[r.idx] {
+			vers[r.idx] = r.ver
+			vals[r.idx] = r.val
+		} else if r.ver == 0 {
+			// the entry was removed, nothing to wait for
+			return 0, Eremoved
+		}
+	}
+}
+
+// Sends the result of Get(key, version) on the Hop to c, starting the Get
+// if there is no pending one
+func (ws *watchSet) watch(ghop GetterHop, key string, version uint64, idx int, c chan *mresult) {
+	wk := mwkey{ghop, key, version}
+	ws.Lock()
+	w := ws.watches[wk]
+	if w == nil {
+		if ws.watches == nil {
+			ws.watches = make(map[mwkey]*mwatch)
+		}
+
+		w = new(mwatch)
+		ws.watches[wk] = w
+		go ws.watchproc(wk)
+	}
+
+	w.subs = append(w.subs, mwsub{idx, c})
+	ws.Unlock()
+}
+
+func (ws *watchSet) watchproc(wk mwkey) {
+	ver, val, err := wk.hop.Get(wk.key, wk.version)
+
+	ws.Lock()
+	w := ws.watches[wk]
+	delete(ws.watches, wk)
+	ws.Unlock()
+
+	// the values are shared, the callers don't modify them
+	for _, s := range w.subs {
+		s.c <- &mresult{s.idx, ver, val, err}
+	}
+}
+
 func (m *MHop) add(id int, pattern string, exact bool, cutprefix bool, h interface{}) error {
 	ndprev, nd, n, i := m.match(pattern)
 	//	fmt.Printf("ndprev %v nd %v n %d i %d\n", ndprev, nd, n, i)
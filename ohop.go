@@ -0,0 +1,451 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// OHop is a Hop implementation that layers a writable upper Hop over a
+// lower Hop that is only read from. Get looks for the key in the upper Hop
+// first and falls through to the lower one. Create, Set, TestSet and Atomic
+// always modify the upper Hop. If the entry exists only in the lower Hop,
+// its value is copied up into the upper Hop before it is modified. Remove
+// of an entry that exists in the lower Hop leaves a whiteout that hides the
+// lower entry until the key is created again.
+//
+// To keep the versions monotonic across copy-up, the versions of the
+// entries in the upper Hop are offset by the version the entry had in the
+// lower Hop when it was copied up. The whiteouts and the version offsets
+// are kept in memory by the OHop.
+type OHop struct {
+	sync.Mutex
+	upper Hop
+	lower GetterHop
+
+	base    map[string]uint64 // version offset of the copied-up entries
+	wh      map[string]bool   // whiteouts
+	whentry whEntry           // version changes when the whiteouts change
+	watches watchSet
+}
+
+// Entry used to wait for changes in the whiteouts list
+type whEntry struct {
+	Entry
+}
+
+func NewOHop(upper Hop, lower GetterHop) *OHop {
+	o := new(OHop)
+	o.upper = upper
+	o.lower = lower
+	o.base = make(map[string]uint64)
+	o.wh = make(map[string]bool)
+	o.whentry.L = o.whentry.RLocker()
+
+	return o
+}
+
+func (o *OHop) Create(key, flags string, value []byte) (ver uint64, err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.wh[key] {
+		ver, _, err = o.lower.Get(key, Any)
+		if err != nil {
+			return 0, err
+		}
+
+		if ver != 0 {
+			return 0, Eexist
+		}
+	}
+
+	ver, err = o.upper.Create(key, flags, value)
+	if err != nil || ver == 0 {
+		return
+	}
+
+	if o.wh[key] {
+		delete(o.wh, key)
+		o.whentry.SetValue(nil)
+	}
+
+	return ver + o.base[key], nil
+}
+
+func (o *OHop) Remove(key string) (err error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.wh[key] {
+		return Enoent
+	}
+
+	err = o.upper.Remove(key)
+	if err != nil && err != Enoent {
+		return
+	}
+
+	lver, _, lerr := o.lower.Get(key, Any)
+	if lerr != nil {
+		return lerr
+	}
+
+	if lver != 0 {
+		o.wh[key] = true
+		o.whentry.SetValue(nil)
+		err = nil
+	}
+
+	return
+}
+
+func (o *OHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key == "#/keys" || key == "#/keynum" || strings.HasPrefix(key, "#/keys:") {
+		return o.getKeys(key, version)
+	} else if strings.HasPrefix(key, FlagsPrefix) {
+		return o.getFlags(key, key[len(FlagsPrefix):], version)
+	} else if hkey := HistoryKey(key); hkey != key {
+		return o.getFlags(key, hkey, version)
+	}
+
+	type oresult struct {
+		upper bool
+		ver   uint64
+		val   []byte
+		err   error
+	}
+
+	var rchan chan *oresult
+
+	target := version
+	for {
+		o.Lock()
+		wh := o.wh[key]
+		base := o.base[key]
+		o.Unlock()
+
+		ver, val, err = o.upper.Get(key, Any)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if ver != 0 || wh {
+			// the upper Hop has (or will have) the entry
+			if target != Any {
+				ver, val, err = o.upper.Get(key, upperVersion(target, base))
+			}
+
+			if ver != 0 {
+				ver += base
+			}
+
+			return
+		}
+
+		ver, val, err = o.lower.Get(key, Any)
+		if err != nil || ver == 0 && (target == Any || target == Newest) {
+			return
+		}
+
+		switch target {
+		case Any:
+			return
+		case Newest:
+			return o.lower.Get(key, Newest)
+		case PastNewest:
+			target = ver + 1
+		}
+
+		if ver >= target {
+			return
+		}
+
+		// Wait for either a newer value in the lower Hop, or the
+		// entry to be copied up. We can't cancel the other Get, it
+		// will stay around until the entry changes.
+		if rchan == nil {
+			rchan = make(chan *oresult, 2)
+			go func() {
+				r := &oresult{upper: false}
+				r.ver, r.val, r.err = o.lower.Get(key, target)
+				rchan <- r
+			}()
+
+			go func() {
+				r := &oresult{upper: true}
+				r.ver, r.val, r.err = o.upper.Get(key, Lowest)
+				rchan <- r
+			}()
+		}
+
+		r := <-rchan
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+
+		if !r.upper {
+			o.Lock()
+			wh = o.wh[key]
+			o.Unlock()
+
+			if !wh {
+				ver, _, err = o.upper.Get(key, Any)
+				if err == nil && ver == 0 {
+					return r.ver, r.val, nil
+				}
+			}
+		}
+
+		// the entry was copied up or removed, try again
+		rchan = nil
+	}
+}
+
+func (o *OHop) Stat(key string) (st *Stat, err error) {
+	o.Lock()
+	wh := o.wh[key]
+	base := o.base[key]
+	o.Unlock()
+
+	st, err = GetStat(o.upper, key)
+	if err != nil || st != nil {
+		if st != nil {
+			st.Version += base
+		}
+
+		return
+	}
+
+	if wh {
+		return nil, nil
+	}
+
+	return GetStat(o.lower, key)
+}
+
+func (o *OHop) Set(key string, value []byte) (ver uint64, err error) {
+	base, ok, err := o.copyUp(key)
+	if !ok || err != nil {
+		return 0, err
+	}
+
+	ver, err = o.upper.Set(key, value)
+	if ver != 0 {
+		ver += base
+	}
+
+	return
+}
+
+func (o *OHop) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	base, ok, err := o.copyUp(key)
+	if !ok || err != nil {
+		return 0, nil, err
+	}
+
+	if oldversion != Any {
+		if oldversion <= base {
+			// older than the copied-up value, can't match
+			return 0, nil, nil
+		}
+
+		oldversion -= base
+	}
+
+	ver, val, err = o.upper.TestSet(key, oldversion, oldvalue, value)
+	if ver != 0 {
+		ver += base
+	}
+
+	return
+}
+
+func (o *OHop) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	base, ok, err := o.copyUp(key)
+	if !ok || err != nil {
+		return 0, nil, err
+	}
+
+	ver, vals, err = o.upper.Atomic(key, op, values)
+	if ver != 0 {
+		ver += base
+	}
+
+	return
+}
+
+// Makes sure that the entry is in the upper Hop, copying it from the lower
+// Hop if necessary. Returns the version offset of the entry, and false if
+// the entry doesn't exist.
+func (o *OHop) copyUp(key string) (base uint64, ok bool, err error) {
+	var ver uint64
+	var val []byte
+
+	ver, _, err = o.upper.Get(key, Any)
+	if err != nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	base = o.base[key]
+	if ver != 0 {
+		return base, true, nil
+	}
+
+	if o.wh[key] {
+		return 0, false, nil
+	}
+
+	ver, val, err = o.lower.Get(key, Any)
+	if err != nil || ver == 0 {
+		return 0, false, err
+	}
+
+	// the copied-up entry keeps the version and the flags it had in
+	// the lower Hop
+	flags := ""
+	if f, e := GetFlags(o.lower, key); e == nil {
+		flags = f.String()
+	}
+
+	base = ver - Lowest
+	o.base[key] = base
+	_, err = o.upper.Create(key, flags, val)
+	if err == Eexist {
+		err = nil
+	}
+
+	return base, err == nil, err
+}
+
+// The flags (or history) of the entry in the upper Hop, or in the lower
+// one if the entry wasn't copied up
+func (o *OHop) getFlags(key, ekey string, version uint64) (ver uint64, val []byte, err error) {
+	o.Lock()
+	wh := o.wh[ekey]
+	o.Unlock()
+
+	if wh {
+		return 0, nil, nil
+	}
+
+	ver, val, err = o.upper.Get(key, version)
+	if err != nil || ver != 0 {
+		return
+	}
+
+	return o.lower.Get(key, version)
+}
+
+// Converts the specified version to the one the upper Hop uses for an
+// entry with the specified offset.
+func upperVersion(version, base uint64) uint64 {
+	switch version {
+	case Any, Newest, PastNewest:
+		return version
+	}
+
+	if version <= base {
+		return Any
+	}
+
+	return version - base
+}
+
+// Combines the #/keys entries of the upper and lower Hops, removing the
+// keys that have whiteouts.
+func (o *OHop) getKeys(key string, version uint64) (ver uint64, val []byte, err error) {
+	var re *regexp.Regexp
+
+	if strings.HasPrefix(key, "#/keys:") {
+		re, err = regexp.Compile(key[7:])
+		if err != nil {
+			return
+		}
+	}
+
+	hops := []GetterHop{o.upper, o.lower, &o.whentry}
+	vers := make([]uint64, len(hops))
+	vals := make([][]byte, len(hops))
+	for i, h := range hops {
+		vers[i], vals[i], err = h.Get("#/keys", Any)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		ver += vers[i]
+	}
+
+	switch version {
+	case Any, Newest:
+		version = ver
+	case PastNewest:
+		version = ver + 1
+	}
+
+	if ver < version {
+		ver, err = o.watches.waitAll(hops, "#/keys", version, vers, vals)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	o.Lock()
+	n := 0
+	kmap := make(map[string]bool)
+	val = []byte{}
+	for i := 0; i < 2; i++ {
+		if vers[i] == 0 || len(vals[i]) == 0 {
+			continue
+		}
+
+		for _, k := range bytes.Split(vals[i], []byte{0}) {
+			name := string(k)
+			if o.wh[name] || kmap[name] {
+				continue
+			}
+
+			kmap[name] = true
+			n++
+			if re != nil && !re.MatchString(name) {
+				continue
+			}
+
+			val = append(val, k...)
+			val = append(val, 0)
+		}
+	}
+	o.Unlock()
+
+	if key == "#/keynum" {
+		return ver, []byte(fmt.Sprintf("%d", n)), nil
+	}
+
+	if len(val) > 0 {
+		// remove the trailing zero
+		val = val[0 : len(val)-1]
+	}
+
+	return
+}
+
+func (e *whEntry) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	e.RLock()
+	for e.Version < version {
+		e.Wait()
+	}
+
+	ver = e.Version
+	e.RUnlock()
+
+	return ver, nil, nil
+}
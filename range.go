@@ -0,0 +1,169 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"errors"
+	"io"
+)
+
+// Implemented by the Hops that can read and write part of a value without
+// transferring (or loading) all of it.
+type RangeHop interface {
+	// Retrieves up to count bytes of the value starting at offset. The
+	// version is interpreted as in Get. Returns the version, the size of
+	// the whole value, and the data (empty if offset is past the end).
+	// Version 0 means that the entry doesn't exist.
+	GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error)
+
+	// Writes data at offset, zero-filling the gap if offset is past the
+	// end of the value. If truncate is true, the value ends after the
+	// written data. Returns the new version, 0 if the entry doesn't exist.
+	SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error)
+}
+
+var Emodified = errors.New("value modified while reading")
+
+// Reads part of the value. If the Hop doesn't implement RangeHop, gets the
+// whole value and returns the requested part.
+func GetRange(h GetterHop, key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	if rh, ok := h.(RangeHop); ok {
+		return rh.GetRange(key, version, offset, count)
+	}
+
+	return getRange(h, key, version, offset, count)
+}
+
+// Writes part of the value. If the Hop doesn't implement RangeHop, gets
+// the whole value, modifies it and sets it back. The modification is not
+// atomic in that case, concurrent changes to the value may be lost.
+func SetRange(h Hop, key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	if rh, ok := h.(RangeHop); ok {
+		return rh.SetRange(key, offset, data, truncate)
+	}
+
+	return setRange(h, key, offset, data, truncate)
+}
+
+func getRange(h GetterHop, key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	ver, v, err := h.Get(key, version)
+	if err != nil || ver == 0 {
+		return 0, 0, nil, err
+	}
+
+	size = uint64(len(v))
+	val = RangeOf(v, offset, count)
+	return
+}
+
+func setRange(h Hop, key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	ver, v, err := h.Get(key, Any)
+	if err != nil || ver == 0 {
+		return 0, err
+	}
+
+	return h.Set(key, Splice(v, offset, data, truncate, false))
+}
+
+// Returns the part of val with up to count bytes starting at offset
+func RangeOf(val []byte, offset, count uint64) []byte {
+	size := uint64(len(val))
+	if offset >= size {
+		return []byte{}
+	}
+
+	if count > size-offset {
+		count = size - offset
+	}
+
+	return val[offset : offset+count]
+}
+
+// Returns val with data written at offset (see RangeHop.SetRange). val is
+// modified in place only if inplace is true and the data is appended at
+// its end, otherwise a new slice is allocated.
+func Splice(val []byte, offset uint64, data []byte, truncate, inplace bool) []byte {
+	size := uint64(len(val))
+	end := offset + uint64(len(data))
+	if inplace && offset == size {
+		return append(val, data...)
+	}
+
+	nsize := size
+	if truncate || end > nsize {
+		nsize = end
+	}
+
+	nval := make([]byte, nsize)
+	if size > nsize {
+		size = nsize
+	}
+
+	copy(nval, val[0:size])
+	copy(nval[offset:], data)
+	return nval
+}
+
+// Writes the value of the entry to w in parts of up to chunk bytes. The
+// version is interpreted as in Get. If the value changes while it is
+// being read, returns Emodified. Returns the version of the value and the
+// number of bytes written.
+func GetStream(h GetterHop, key string, version uint64, w io.Writer, chunk uint64) (ver uint64, n int64, err error) {
+	var size uint64
+	var val []byte
+
+	if chunk == 0 {
+		return 0, 0, errors.New("invalid chunk size")
+	}
+
+	ver, size, val, err = GetRange(h, key, version, 0, chunk)
+	for err == nil && ver != 0 {
+		var m int
+
+		m, err = w.Write(val)
+		n += int64(m)
+		if err != nil || uint64(n) >= size || len(val) == 0 {
+			break
+		}
+
+		var v uint64
+		v, _, val, err = GetRange(h, key, Any, uint64(n), chunk)
+		if err == nil && v != ver {
+			err = Emodified
+		}
+	}
+
+	return
+}
+
+// Replaces the value of the entry with the content of r, written in parts
+// of up to chunk bytes. The entry must exist. The value is modified with
+// each part, the readers can see the partially written value. Returns the
+// final version (0 if the entry doesn't exist) and the number of bytes
+// written.
+func SetStream(h Hop, key string, r io.Reader, chunk uint64) (ver uint64, n int64, err error) {
+	if chunk == 0 {
+		return 0, 0, errors.New("invalid chunk size")
+	}
+
+	buf := make([]byte, chunk)
+	for {
+		m, rerr := io.ReadFull(r, buf)
+		if m > 0 || n == 0 {
+			ver, err = SetRange(h, key, uint64(n), buf[0:m], true)
+			if err != nil || ver == 0 {
+				return
+			}
+
+			n += int64(m)
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return
+		} else if rerr != nil {
+			return ver, n, rerr
+		}
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package repl implements one-way asynchronous replication of the entries
+// of a Hop (usually a cluster) to another one.
+//
+// The Replicator reads the changes from one or more Sources and applies
+// them to the target Hop. It keeps the source version of each replicated
+// key in the target, in the <prefix>ver/<key> entries, and ignores the
+// changes that are older than the version already applied. That orders
+// the changes of the same key coming from different sources (e.g. the
+// journals of the servers that hold its replicas). The position of each
+// source is checkpointed in the <prefix>pos/<source> entry after the
+// changes are applied, and the replication resumes from there. A change
+// that fails is retried after the retry interval, the changes after it
+// wait, and the position is checkpointed only up to it.
+//
+// When an entry is removed and created again, its version starts from
+// the beginning, so a delayed change from another source can overwrite
+// the new value until the next change of the entry.
+package repl
+
+import (
+	"hash/fnv"
+	"hop"
+	"hop/rmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Replicator struct {
+	sync.Mutex
+	target   hop.Hop
+	prefix   string
+	include  []string
+	exclude  []string
+	sources  []*source
+	versions map[string]uint64
+
+	klocks [64]sync.Mutex
+}
+
+type source struct {
+	Source
+	pos     uint64
+	stats   Stats
+	running bool
+}
+
+// Replication statistics of a source
+type Stats struct {
+	Name    string
+	Pos     uint64        // last applied position
+	Applied uint64        // changes applied
+	Skipped uint64        // changes older than the applied version, or filtered
+	Errors  uint64        // failed attempts to apply a change
+	Delay   time.Duration // delay of the last applied change
+	Behind  uint64        // number of changes not applied yet, if known
+	Last    time.Time     // when the last change was applied
+	Err     error         // last error
+}
+
+// Creates a replicator that keeps its state in the target entries with
+// the specified prefix
+func NewReplicator(target hop.Hop, prefix string) *Replicator {
+	r := new(Replicator)
+	r.target = target
+	r.prefix = prefix
+	r.versions = make(map[string]uint64)
+	return r
+}
+
+// Replicates the keys with the prefix. If no prefixes are included, all
+// keys are replicated.
+func (r *Replicator) Include(prefix string) {
+	r.Lock()
+	r.include = append(r.include, prefix)
+	r.Unlock()
+}
+
+// Doesn't replicate the keys with the prefix, even if they are included
+func (r *Replicator) Exclude(prefix string) {
+	r.Lock()
+	r.exclude = append(r.exclude, prefix)
+	r.Unlock()
+}
+
+// Adds a source, the replication from it starts at the checkpointed
+// position
+func (r *Replicator) AddSource(src Source) (err error) {
+	s := &source{Source: src}
+	s.stats.Name = src.Name()
+	ver, val, err := r.target.Get(r.prefix+"pos/"+src.Name(), hop.Any)
+	if err != nil {
+		return
+	}
+
+	if ver != 0 {
+		if s.pos, err = strconv.ParseUint(string(val), 10, 64); err != nil {
+			return
+		}
+	}
+
+	s.stats.Pos = s.pos
+	r.Lock()
+	r.sources = append(r.sources, s)
+	r.Unlock()
+	return
+}
+
+// Starts the replication from the sources that aren't replicated yet. The
+// errors from the sources are reported in the Stats, and the reading is
+// retried after the retry interval.
+func (r *Replicator) Start(retry time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, s := range r.sources {
+		if !s.running {
+			s.running = true
+			go r.replproc(s, retry)
+		}
+	}
+}
+
+func (r *Replicator) Stats() (st []Stats) {
+	r.Lock()
+	sources := r.sources
+	r.Unlock()
+
+	for _, s := range sources {
+		behind, err := s.Behind(r.pos(s))
+		r.Lock()
+		s.stats.Behind = behind
+		if err != nil {
+			s.stats.Err = err
+		}
+
+		st = append(st, s.stats)
+		r.Unlock()
+	}
+
+	return
+}
+
+func (r *Replicator) pos(s *source) uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return s.pos
+}
+
+func (r *Replicator) replproc(s *source, retry time.Duration) {
+	for {
+		pos := r.pos(s)
+		chs, npos, err := s.Changes(pos)
+		if err != nil {
+			r.Lock()
+			s.stats.Err = err
+			r.Unlock()
+			time.Sleep(retry)
+			continue
+		}
+
+		// a failed change is retried before the ones after it, and only the
+		// changes before it are checkpointed
+		cpos := pos
+		for i := 0; i < len(chs); {
+			ch := chs[i]
+			applied, err := r.apply(ch)
+			r.Lock()
+			switch {
+			case err != nil:
+				s.stats.Errors++
+				s.stats.Err = err
+			case applied:
+				s.stats.Applied++
+				s.stats.Last = time.Now()
+				s.stats.Delay = s.stats.Last.Sub(ch.Time)
+			default:
+				s.stats.Skipped++
+			}
+			r.Unlock()
+
+			if err != nil {
+				r.checkpoint(s, cpos)
+				time.Sleep(retry)
+				continue
+			}
+
+			if ch.Pos != 0 {
+				cpos = ch.Pos
+			}
+
+			i++
+		}
+
+		r.checkpoint(s, npos)
+	}
+}
+
+// Saves the position of the source if it changed
+func (r *Replicator) checkpoint(s *source, pos uint64) {
+	if pos == r.pos(s) {
+		return
+	}
+
+	if err := r.setEntry(r.prefix+"pos/"+s.Name(), "", []byte(strconv.FormatUint(pos, 10))); err != nil {
+		r.Lock()
+		s.stats.Err = err
+		r.Unlock()
+	}
+
+	r.Lock()
+	s.pos = pos
+	s.stats.Pos = pos
+	r.Unlock()
+}
+
+func (r *Replicator) replicated(key string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if strings.HasPrefix(key, "#/") || strings.HasPrefix(key, r.prefix) {
+		return false
+	}
+
+	for _, p := range r.exclude {
+		if strings.HasPrefix(key, p) {
+			return false
+		}
+	}
+
+	if len(r.include) == 0 {
+		return true
+	}
+
+	for _, p := range r.include {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Replicator) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &r.klocks[h.Sum32()%uint32(len(r.klocks))]
+}
+
+// Returns the source version of the key applied to the target
+func (r *Replicator) version(key string) (ver uint64, err error) {
+	r.Lock()
+	ver, ok := r.versions[key]
+	r.Unlock()
+	if ok {
+		return
+	}
+
+	tver, val, err := r.target.Get(r.prefix+"ver/"+key, hop.Any)
+	if err != nil {
+		return
+	}
+
+	if tver != 0 {
+		if ver, err = strconv.ParseUint(string(val), 10, 64); err != nil {
+			return
+		}
+	}
+
+	r.Lock()
+	r.versions[key] = ver
+	r.Unlock()
+	return
+}
+
+func (r *Replicator) apply(ch *Change) (applied bool, err error) {
+	if !r.replicated(ch.Key) {
+		return false, nil
+	}
+
+	l := r.keyLock(ch.Key)
+	l.Lock()
+	defer l.Unlock()
+
+	ver, err := r.version(ch.Key)
+	if err != nil {
+		return
+	}
+
+	if ch.Version == 0 {
+		// removed
+		if err = r.target.Remove(ch.Key); err != nil && !rmt.IsError(err, hop.Enoent) {
+			return
+		}
+
+		if err = r.target.Remove(r.prefix + "ver/" + ch.Key); err != nil && !rmt.IsError(err, hop.Enoent) {
+			return
+		}
+
+		r.Lock()
+		delete(r.versions, ch.Key)
+		r.Unlock()
+		return true, nil
+	}
+
+	if ch.Version <= ver {
+		return false, nil
+	}
+
+	if err = r.setEntry(ch.Key, ch.Flags, ch.Value); err != nil {
+		return
+	}
+
+	if err = r.setEntry(r.prefix+"ver/"+ch.Key, "", []byte(strconv.FormatUint(ch.Version, 10))); err != nil {
+		return
+	}
+
+	r.Lock()
+	r.versions[ch.Key] = ch.Version
+	r.Unlock()
+	return true, nil
+}
+
+// Sets the value of the entry, creating it if it doesn't exist
+func (r *Replicator) setEntry(key, flags string, value []byte) (err error) {
+	ver, err := r.target.Set(key, value)
+	if err == nil && ver == 0 {
+		_, err = r.target.Create(key, flags, value)
+	}
+
+	return
+}
+
+func prefixRegexp(prefixes []string) string {
+	if len(prefixes) == 0 {
+		return ".*"
+	}
+
+	qs := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		qs[i] = regexp.QuoteMeta(p)
+	}
+
+	return "^(" + strings.Join(qs, "|") + ")"
+}
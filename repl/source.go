@@ -0,0 +1,183 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repl
+
+import (
+	"bytes"
+	"hop"
+	"time"
+)
+
+// Change of a source entry
+type Change struct {
+	Key     string
+	Version uint64 // zero if the entry was removed
+	Flags   string
+	Value   []byte
+	Time    time.Time // when the change was made (or noticed)
+	Pos     uint64    // source position after the change, zero if unknown
+}
+
+// Source of the changes. Position is opaque for the Replicator, it is
+// checkpointed after the changes are applied and passed back when the
+// replication resumes. Zero position means from the beginning.
+type Source interface {
+	Name() string
+
+	// Returns the changes after the position and the new position.
+	// Blocks until there are some.
+	Changes(pos uint64) (chs []*Change, npos uint64, err error)
+
+	// Returns how many changes the position is behind the source
+	Behind(pos uint64) (n uint64, err error)
+}
+
+// JournalSource reads the changes from the journal of a server that runs
+// a hop.JHop. The servers of a cluster have separate journals, so each one
+// needs its own JournalSource.
+type JournalSource struct {
+	name string
+	h    hop.GetterHop
+}
+
+// ScanSource finds the changes by periodically listing the keys of the
+// Hop and comparing their versions with the ones from the previous scan.
+// It works with any Hop, but misses the intermediate values and costs a
+// request per key. The first scan returns all entries.
+type ScanSource struct {
+	name     string
+	h        hop.GetterHop
+	prefixes []string
+	interval time.Duration
+	known    map[string]uint64
+	scans    uint64
+}
+
+func NewJournalSource(name string, h hop.GetterHop) *JournalSource {
+	return &JournalSource{name, h}
+}
+
+func (s *JournalSource) Name() string {
+	return s.name
+}
+
+func (s *JournalSource) Changes(pos uint64) (chs []*Change, npos uint64, err error) {
+	recs, err := hop.ReadJournal(s.h, pos, true)
+	if err != nil {
+		return nil, pos, err
+	}
+
+	npos = pos
+	for _, r := range recs {
+		npos = r.Seq
+		ch := &Change{Key: r.Key, Version: r.Version, Value: r.Value, Time: r.Time, Pos: r.Seq}
+		switch r.Op {
+		case hop.JRemove:
+			ch.Version = 0
+			ch.Value = nil
+
+		case hop.JCreate:
+			if f, err := hop.GetFlags(s.h, r.Key); err == nil {
+				ch.Flags = f.String()
+			}
+		}
+
+		chs = append(chs, ch)
+	}
+
+	return
+}
+
+func (s *JournalSource) Behind(pos uint64) (n uint64, err error) {
+	_, val, err := s.h.Get("#/journal", hop.Any)
+	if err != nil {
+		return
+	}
+
+	if len(val) < 16 {
+		return 0, hop.Ejournal
+	}
+
+	_, p := hop.Gint64(val)
+	last, _ := hop.Gint64(p)
+	if last > pos {
+		n = last - pos
+	}
+
+	return
+}
+
+// Scans only the keys with the prefixes (all keys if none)
+func NewScanSource(name string, h hop.GetterHop, prefixes []string, interval time.Duration) *ScanSource {
+	return &ScanSource{name: name, h: h, prefixes: prefixes, interval: interval}
+}
+
+func (s *ScanSource) Name() string {
+	return s.name
+}
+
+func (s *ScanSource) Changes(pos uint64) (chs []*Change, npos uint64, err error) {
+	if s.known != nil {
+		time.Sleep(s.interval)
+	}
+
+	ver, val, err := s.h.Get("#/keys:"+prefixRegexp(s.prefixes), hop.Any)
+	if err != nil {
+		return nil, pos, err
+	}
+
+	now := time.Now()
+	known := make(map[string]uint64)
+	if ver != 0 && len(val) > 0 {
+		for _, k := range bytes.Split(val, []byte{0}) {
+			key := string(k)
+			if len(key) > 1 && key[0:2] == "#/" {
+				continue
+			}
+
+			st, err := hop.GetStat(s.h, key)
+			if err != nil {
+				return nil, pos, err
+			}
+
+			if st == nil {
+				continue
+			}
+
+			known[key] = st.Version
+			if s.known[key] == st.Version {
+				continue
+			}
+
+			ver, val, err := s.h.Get(key, hop.Any)
+			if err != nil {
+				return nil, pos, err
+			}
+
+			if ver == 0 {
+				delete(known, key)
+				continue
+			}
+
+			known[key] = ver
+			chs = append(chs, &Change{Key: key, Version: ver, Flags: st.Flags, Value: val, Time: now})
+		}
+	}
+
+	for key := range s.known {
+		if _, ok := known[key]; !ok {
+			chs = append(chs, &Change{Key: key, Time: now})
+		}
+	}
+
+	s.known = known
+	s.scans++
+	return chs, s.scans, nil
+}
+
+// The scan source doesn't know
+func (s *ScanSource) Behind(pos uint64) (n uint64, err error) {
+	return 0, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Measures the throughput of the TCP transport with small messages. Runs
+// an SHop server and its clients in the same process, once writing each
+// message separately and once coalescing the queued messages, and prints
+// the operations per second and the memory allocated per operation.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hop"
+	"hop/rmt"
+	"hop/rmt/hopclnt"
+	"hop/rmt/hopsrv"
+	"hop/shop"
+	"log"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var addr = flag.String("addr", "127.0.0.1:5090", "server address")
+var vminlen = flag.Int("vmin", 8, "minimum value length")
+var vmaxlen = flag.Int("vmax", 64, "maximum value length")
+var keynum = flag.Int("knum", 1024, "number of keys")
+var connnum = flag.Int("connnum", 4, "number of client connections")
+var threadnum = flag.Int("threadnum", 16, "number of op threads per connection")
+var numop = flag.Int("N", 20000, "number of operations per thread")
+var async = flag.Int("async", 0, "if not zero, each thread keeps that many asynchronous requests in flight")
+var batch = flag.Int("batch", rmt.NetMaxBatch, "maximum number of messages per write")
+
+func value(r *rand.Rand) []byte {
+	n := *vminlen
+	if *vmaxlen > n {
+		n += r.Intn(*vmaxlen - n)
+	}
+
+	return make([]byte, n)
+}
+
+func thread(clnt *hopclnt.Clnt, id int) (err error) {
+	r := rand.New(rand.NewSource(int64(id)))
+	fs := make([]*hop.Future, 0, *async)
+	for i := 0; i < *numop; i++ {
+		key := fmt.Sprintf("key%d", r.Intn(*keynum))
+		get := r.Intn(2) == 0
+		if *async == 0 {
+			if get {
+				_, _, err = clnt.Get(key, hop.Any)
+			} else {
+				_, err = clnt.Set(key, value(r))
+			}
+
+			if err != nil {
+				return
+			}
+
+			continue
+		}
+
+		if get {
+			fs = append(fs, clnt.GetAsync(key, hop.Any))
+		} else {
+			fs = append(fs, clnt.SetAsync(key, value(r)))
+		}
+
+		if len(fs) == cap(fs) {
+			if err = hop.WaitAll(fs...); err != nil {
+				return
+			}
+
+			fs = fs[:0]
+		}
+	}
+
+	return hop.WaitAll(fs...)
+}
+
+func run(nbatch int) {
+	var wg sync.WaitGroup
+	var ms0, ms1 runtime.MemStats
+
+	rmt.NetMaxBatch = nbatch
+	clnts := make([]*hopclnt.Clnt, *connnum)
+	for i := range clnts {
+		c, err := hopclnt.Connect("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		clnts[i] = c.(*hopclnt.Clnt)
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&ms0)
+	st := time.Now()
+	for i, c := range clnts {
+		for j := 0; j < *threadnum; j++ {
+			wg.Add(1)
+			go func(c *hopclnt.Clnt, id int) {
+				if err := thread(c, id); err != nil {
+					log.Println(err)
+				}
+
+				wg.Done()
+			}(c, i**threadnum+j)
+		}
+	}
+
+	wg.Wait()
+	d := time.Since(st)
+	runtime.ReadMemStats(&ms1)
+	for _, c := range clnts {
+		c.Close()
+	}
+
+	nops := uint64(*connnum * *threadnum * *numop)
+	fmt.Printf("batch %3d: %d ops in %v, %.0f ops/s, %d bytes/op, %d allocs/op\n", nbatch, nops, d,
+		float64(nops)/d.Seconds(), (ms1.TotalAlloc-ms0.TotalAlloc)/nops, (ms1.Mallocs-ms0.Mallocs)/nops)
+}
+
+func main() {
+	flag.Parse()
+
+	sh := shop.NewSHop()
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < *keynum; i++ {
+		sh.Create(fmt.Sprintf("key%d", i), "", value(r))
+	}
+
+	srv := new(hopsrv.Srv)
+	if !srv.Start(sh) {
+		log.Fatal("can't start the server")
+	}
+
+	if _, err := rmt.Listen("tcp", *addr, srv); err != nil {
+		log.Fatal(err)
+	}
+
+	run(1)
+	if *batch > 1 {
+		run(*batch)
+	}
+
+	srv.Shutdown(time.Second)
+}
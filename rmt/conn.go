@@ -25,7 +25,9 @@ type Conn interface {
 
 	// Releases a message that contains incoming data.
 	// The Msg should be one passed to the Incoming method of the
-	// MsgHandler interface assigned to the connection
+	// MsgHandler interface assigned to the connection. The values
+	// of the message may point to the connection's receive buffer
+	// and should not be used after the message is released.
 	ReleaseInbound(*Msg)
 
 	// Assigns a handler to receive incoming request (T messages)
@@ -39,11 +41,36 @@ type Conn interface {
 	// Automatically calls ReleaseOutbound once the message is sent.
 	Send(m *Msg) error
 
+	// Sets the maximum size of the incoming messages, the connection is
+	// closed if a larger one is received. Zero means no limit.
+	SetMsize(msize uint32)
+
+	// Returns the maximum size of the incoming messages
+	Msize() uint32
+
 	Close()
 	RemoteAddr() string
 	LocalAddr() string
 }
 
+// Implemented by the connections that write the sent messages
+// asynchronously
+type Flusher interface {
+	// Waits until the messages passed to Send are written
+	Flush()
+}
+
+// Implemented by the connections that can stop reading the incoming
+// messages, used by the receivers for flow control
+type Pauser interface {
+	// Stops delivering the incoming messages and reading from the
+	// connection, until Resume is called or the connection is closed
+	Pause()
+
+	// Continues reading from the connection
+	Resume()
+}
+
 type Listener interface {
 	NewConnection(c Conn)
 }
@@ -53,6 +80,12 @@ type Protocol interface {
 	Listen(proto, addr string, lstn Listener) (string, error)
 }
 
+// Implemented by the protocols that can stop listening
+type Unlistener interface {
+	// Stops accepting connections for the listener
+	Unlisten(lstn Listener) error
+}
+
 var protos map[string]Protocol
 var Eproto = errors.New("unknown protocol")
 
@@ -90,3 +123,17 @@ func Listen(proto, addr string, lstn Listener) (string, error) {
 
 	return p.Listen(proto, addr, lstn)
 }
+
+// Stops accepting new connections for the listener on all protocols that
+// support it. The established connections are not closed.
+func Unlisten(lstn Listener) (err error) {
+	for _, p := range protos {
+		if u, ok := p.(Unlistener); ok {
+			if e := u.Unlisten(lstn); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	return
+}
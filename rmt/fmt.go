@@ -24,7 +24,11 @@ func (m *Msg) String() string {
 
 	switch m.Type {
 	default:
-		ret = fmt.Sprintf("invalid message: %d", m.Type)
+		if mt := GetMsgType(m.Type); mt != nil {
+			ret = mt.format(m)
+		} else {
+			ret = fmt.Sprintf("invalid message: %d", m.Type)
+		}
 	case Rerror:
 		ret = fmt.Sprintf("Rerror tag %d ename '%s' ecode %d", m.Tag, m.Edescr, m.Ecode)
 	case Tget:
@@ -55,6 +59,22 @@ func (m *Msg) String() string {
 		ret = fmt.Sprintf("Tatomic tag %d op '%s' key '%s' vals %v", m.Tag, atomicNames[m.Atmop], m.Key, m.Vals)
 	case Ratomic:
 		ret = fmt.Sprintf("Ratomic tag %d version %d vals %v", m.Tag, m.Version, m.Vals)
+	case Tstat:
+		ret = fmt.Sprintf("Tstat tag %d key '%s'", m.Tag, m.Key)
+	case Rstat:
+		ret = fmt.Sprintf("Rstat tag %d version %d size %d ctime %d mtime %d flags '%s' creator '%s'", m.Tag, m.Version, m.Valsize, m.Ctime, m.Mtime, m.Flags, m.Creator)
+	case Tversion:
+		ret = fmt.Sprintf("Tversion tag %d version %d msize %d tagbits %d features %v", m.Tag, m.Pversion, m.Msize, m.Tagbits, m.Features)
+	case Rversion:
+		ret = fmt.Sprintf("Rversion tag %d version %d msize %d tagbits %d features %v", m.Tag, m.Pversion, m.Msize, m.Tagbits, m.Features)
+	case Tgetrange:
+		ret = fmt.Sprintf("Tgetrange tag %d key '%s' version %d offset %d count %d", m.Tag, m.Key, m.Version, m.Offset, m.Count)
+	case Rgetrange:
+		ret = fmt.Sprintf("Rgetrange tag %d version %d size %d datalen %d", m.Tag, m.Version, m.Valsize, len(m.Value))
+	case Tsetrange:
+		ret = fmt.Sprintf("Tsetrange tag %d key '%s' offset %d truncate %v datalen %d", m.Tag, m.Key, m.Offset, m.Truncate, len(m.Value))
+	case Rsetrange:
+		ret = fmt.Sprintf("Rsetrange tag %d version %d", m.Tag, m.Version)
 	}
 
 	return ret
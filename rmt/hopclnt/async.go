@@ -0,0 +1,119 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopclnt
+
+import (
+	"hop"
+	"hop/rmt"
+)
+
+// The asynchronous operations send the request and return without
+// waiting for the response. The returned Future is completed from the
+// goroutine that receives the responses, no goroutine is started per
+// request. If all tags are in use, the call blocks until a response
+// frees one.
+
+// Sends the request and completes the future with the values returned by
+// unpack when the response arrives
+func (clnt *Clnt) rpcAsync(tc *rmt.Msg, unpack func(rc *rmt.Msg) (uint64, []byte, [][]byte)) *hop.Future {
+	f := hop.NewFuture()
+	r := clnt.ReqAlloc()
+	r.Done = nil
+	r.cb = func(r *Req) {
+		var ver uint64
+		var val []byte
+		var vals [][]byte
+
+		err := r.Err
+		if err == nil && unpack != nil {
+			ver, val, vals = unpack(r.Rc)
+		}
+
+		clnt.ReqFree(r)
+		f.Complete(ver, val, vals, err)
+	}
+
+	if err := clnt.Rpcnb(r, tc); err != nil {
+		clnt.ReqFree(r)
+		clnt.conn.ReleaseOutbound(tc)
+		f.Complete(0, nil, nil, err)
+	}
+
+	return f
+}
+
+// Returns a completed future with the error
+func failed(clnt *Clnt, tc *rmt.Msg, err error) *hop.Future {
+	clnt.conn.ReleaseOutbound(tc)
+	f := hop.NewFuture()
+	f.Complete(0, nil, nil, err)
+	return f
+}
+
+func unpackVersion(rc *rmt.Msg) (uint64, []byte, [][]byte) {
+	return rc.Version, nil, nil
+}
+
+func unpackValue(rc *rmt.Msg) (uint64, []byte, [][]byte) {
+	return rc.Version, clone(rc.Value), nil
+}
+
+func unpackVals(rc *rmt.Msg) (uint64, []byte, [][]byte) {
+	return rc.Version, nil, cloneVals(rc.Vals)
+}
+
+func (clnt *Clnt) CreateAsync(key, flags string, value []byte) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTcreate(tc, key, flags, value); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, unpackVersion)
+}
+
+func (clnt *Clnt) RemoveAsync(key string) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTremove(tc, key); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, nil)
+}
+
+func (clnt *Clnt) GetAsync(key string, version uint64) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTget(tc, key, version); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, unpackValue)
+}
+
+func (clnt *Clnt) SetAsync(key string, value []byte) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTset(tc, key, value); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, unpackVersion)
+}
+
+func (clnt *Clnt) TestSetAsync(key string, oldversion uint64, oldvalue, value []byte) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTtestset(tc, key, oldversion, oldvalue, value); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, unpackValue)
+}
+
+func (clnt *Clnt) AtomicAsync(key string, op uint16, values [][]byte) *hop.Future {
+	tc := clnt.conn.GetOutbound()
+	if err := rmt.PackTatomic(tc, op, key, values); err != nil {
+		return failed(clnt, tc, err)
+	}
+
+	return clnt.rpcAsync(tc, unpackVals)
+}
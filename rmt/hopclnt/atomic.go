@@ -21,7 +21,7 @@ func (clnt *Clnt) Atomic(key string, op uint16, vals [][]byte) (version uint64,
 	rc, err = clnt.Rpc(tc)
 	if err == nil {
 		version = rc.Version
-		values = rc.Vals
+		values = cloneVals(rc.Vals)
 	}
 
 	if rc != nil {
@@ -23,9 +23,9 @@ const (
 	DbgLogPackets                 // keep the last N Hop messages (can be accessed over http)
 )
 
-const (
-	Msize = 1024 * 1024
-)
+// Maximum message size and tag bits proposed to the servers
+var Msize uint32 = 8 * 1024 * 1024
+var Tagbits uint8 = rmt.MaxTagbits
 
 type StatsOps interface {
 	statsRegister()
@@ -42,6 +42,7 @@ type Clnt struct {
 	Log        *hop.Logger
 
 	conn     rmt.Conn
+	ver      *rmt.Version // nil if not negotiated
 	tagpool  *pool
 	reqfirst *Req
 	reqlast  *Req
@@ -68,6 +69,7 @@ type Req struct {
 	Rc         *rmt.Msg
 	Err        error
 	Done       chan *Req
+	cb         func(r *Req) // if set, called instead of sending to Done
 	tag        uint16
 	donechan   chan *Req
 	prev, next *Req
@@ -91,6 +93,11 @@ func (clnt *Clnt) Rpcnb(r *Req, tc *rmt.Msg) error {
 		return clnt.err
 	}
 
+	if clnt.ver != nil && tc.Size > clnt.ver.Msize {
+		clnt.Unlock()
+		return rmt.Etoolarge
+	}
+
 	if clnt.reqlast != nil {
 		clnt.reqlast.next = r
 	} else {
@@ -181,7 +188,9 @@ func (clnt *Clnt) Incoming(m *rmt.Msg) {
 		}
 	}
 
-	if r.Done != nil {
+	if r.cb != nil {
+		r.cb(r)
+	} else if r.Done != nil {
 		r.Done <- r
 	}
 }
@@ -199,11 +208,17 @@ func (clnt *Clnt) ConnError(err error) {
 	}
 	clnt.tagpool.close()
 	clnt.Unlock()
-	for ; r != nil; r = r.next {
+	for r != nil {
+		// the request may be freed once it's done
+		next := r.next
 		r.Err = err
-		if r.Done != nil {
+		if r.cb != nil {
+			r.cb(r)
+		} else if r.Done != nil {
 			r.Done <- r
 		}
+
+		r = next
 	}
 
 	clnts.Lock()
@@ -228,6 +243,10 @@ func (clnt *Clnt) ConnError(err error) {
 // Creates and initializes a new Clnt object. Doesn't send any data
 // on the wire.
 func NewClient(c rmt.Conn) rmt.RemoteHop {
+	return newClient(c)
+}
+
+func newClient(c rmt.Conn) *Clnt {
 	clnt := new(Clnt)
 	clnt.conn = c
 	clnt.Debuglevel = DefaultDebuglevel
@@ -256,13 +275,76 @@ func NewClient(c rmt.Conn) rmt.RemoteHop {
 	return clnt
 }
 
+// Connects to the server and negotiates the protocol parameters
 func Connect(proto, addr string) (rmt.RemoteHop, error) {
 	c, err := rmt.Connect(proto, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewClient(c), nil
+	clnt := newClient(c)
+	if err = clnt.Negotiate(); err != nil {
+		clnt.Close()
+		return nil, err
+	}
+
+	return clnt, nil
+}
+
+// Sends Tversion and sets up the client with the parameters the server
+// agreed to. Should be called before any other requests are sent.
+func (clnt *Clnt) Negotiate() (err error) {
+	var rc *rmt.Msg
+
+	msize := Msize
+	if cmsize := clnt.conn.Msize(); cmsize != 0 && cmsize < msize {
+		msize = cmsize
+	}
+
+	// the server can't respond with larger messages than proposed
+	clnt.conn.SetMsize(msize)
+	tc := clnt.conn.GetOutbound()
+	err = rmt.PackTversion(tc, rmt.ProtoVersion, msize, Tagbits, rmt.Features())
+	if err != nil {
+		clnt.conn.ReleaseOutbound(tc)
+		return
+	}
+
+	// the connection releases tc once it's sent
+	ptc := *tc
+	rc, err = clnt.Rpc(tc)
+	if rc != nil {
+		defer clnt.conn.ReleaseInbound(rc)
+	}
+
+	if err != nil {
+		if rc == nil {
+			// the servers that don't support Tversion close the connection
+			err = &rmt.Error{Edescr: fmt.Sprintf("protocol negotiation failed (incompatible server?): %v", err), Ecode: rmt.EPROTO}
+		}
+
+		return
+	}
+
+	v, err := rmt.CheckVersion(&ptc, rc)
+	if err != nil {
+		return
+	}
+
+	clnt.conn.SetMsize(v.Msize)
+	clnt.tagpool.setMaxid(uint32(1)<<v.Tagbits - 1)
+	clnt.Lock()
+	clnt.ver = v
+	clnt.Unlock()
+	return
+}
+
+// Returns the negotiated protocol parameters, nil if the client didn't
+// negotiate them
+func (clnt *Clnt) Version() *rmt.Version {
+	clnt.Lock()
+	defer clnt.Unlock()
+	return clnt.ver
 }
 
 func (clnt *Clnt) Close() {
@@ -296,6 +378,7 @@ func (clnt *Clnt) ReqFree(req *Req) {
 	}
 
 	req.Done = nil
+	req.cb = nil
 	req.Err = nil
 	req.next = nil
 	req.prev = nil
@@ -308,6 +391,29 @@ func (clnt *Clnt) ReqFree(req *Req) {
 	}
 }
 
+// The values of the received messages may be overwritten once the
+// messages are released, the values returned to the caller are copied.
+func clone(val []byte) []byte {
+	if val == nil {
+		return nil
+	}
+
+	return append([]byte{}, val...)
+}
+
+func cloneVals(vals [][]byte) [][]byte {
+	if vals == nil {
+		return nil
+	}
+
+	cvals := make([][]byte, len(vals))
+	for i, v := range vals {
+		cvals[i] = clone(v)
+	}
+
+	return cvals
+}
+
 func (clnt *Clnt) logMsg(m *rmt.Msg) {
 	if clnt.Debuglevel&DbgLogPackets != 0 {
 		pkt := make([]byte, len(m.Pkt))
@@ -319,6 +425,9 @@ func (clnt *Clnt) logMsg(m *rmt.Msg) {
 		mm := new(rmt.Msg)
 		*mm = *m
 		mm.Pkt = nil
+		mm.Value = clone(m.Value)
+		mm.Oldval = clone(m.Oldval)
+		mm.Vals = cloneVals(m.Vals)
 		clnt.Log.Log(mm, clnt, DbgLogMsgs)
 	}
 }
@@ -21,7 +21,7 @@ func (clnt *Clnt) Get(key string, version uint64) (ver uint64, val []byte, err e
 	rc, err = clnt.Rpc(tc)
 	if err == nil {
 		ver = rc.Version
-		val = rc.Value
+		val = clone(rc.Value)
 	}
 
 	if rc != nil {
@@ -47,6 +47,19 @@ func newPool(maxid uint32) *pool {
 	return p
 }
 
+// Limits the ids to maxid, which should be one less than a multiple
+// of 8. The ids above it that are in use are not reused when released.
+func (p *pool) setMaxid(maxid uint32) {
+	p.Lock()
+	if maxid < p.maxid {
+		p.maxid = maxid
+		if n := int(maxid/8 + 1); len(p.imap) > n {
+			p.imap = p.imap[0:n]
+		}
+	}
+	p.Unlock()
+}
+
 func (p *pool) close() {
 	p.Lock()
 	close(p.nchan)
@@ -95,6 +108,11 @@ func (p *pool) getId() uint32 {
 
 func (p *pool) putId(id uint32) {
 	p.Lock()
+	if id > p.maxid {
+		p.Unlock()
+		return
+	}
+
 	if p.need > 0 {
 		p.nchan <- id
 		p.need--
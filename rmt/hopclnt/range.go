@@ -0,0 +1,136 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopclnt
+
+import (
+	"hop"
+	"hop/rmt"
+	"io"
+	"io/ioutil"
+)
+
+// Reads part of the value. If the server doesn't support ranged reads, the
+// whole value is transferred.
+func (clnt *Clnt) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	var rc *rmt.Msg
+
+	v := clnt.Version()
+	if !v.HasFeature(rmt.RangeFeature) {
+		ver, val, err = clnt.Get(key, version)
+		if err != nil || ver == 0 {
+			return 0, 0, nil, err
+		}
+
+		return ver, uint64(len(val)), hop.RangeOf(val, offset, count), nil
+	}
+
+	if max := uint64(rmt.MaxGetrange(v.Msize)); count > max {
+		count = max
+	}
+
+	tc := clnt.conn.GetOutbound()
+	err = rmt.PackTgetrange(tc, key, version, offset, uint32(count))
+	if err != nil {
+		clnt.conn.ReleaseOutbound(tc)
+		return
+	}
+
+	rc, err = clnt.Rpc(tc)
+	if err == nil {
+		ver = rc.Version
+		size = rc.Valsize
+		val = clone(rc.Value)
+	}
+
+	if rc != nil {
+		clnt.conn.ReleaseInbound(rc)
+	}
+
+	return
+}
+
+// Writes part of the value. If the server doesn't support ranged writes,
+// the value is read, modified and set back whole, and the concurrent
+// modifications may be lost.
+func (clnt *Clnt) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	var rc *rmt.Msg
+
+	if !clnt.Version().HasFeature(rmt.RangeFeature) {
+		var val []byte
+
+		ver, val, err = clnt.Get(key, hop.Any)
+		if err != nil || ver == 0 {
+			return 0, err
+		}
+
+		return clnt.Set(key, hop.Splice(val, offset, data, truncate, false))
+	}
+
+	tc := clnt.conn.GetOutbound()
+	err = rmt.PackTsetrange(tc, key, offset, data, truncate)
+	if err != nil {
+		clnt.conn.ReleaseOutbound(tc)
+		return
+	}
+
+	rc, err = clnt.Rpc(tc)
+	if err == nil {
+		ver = rc.Version
+	}
+
+	if rc != nil {
+		clnt.conn.ReleaseInbound(rc)
+	}
+
+	return
+}
+
+// Writes the value of the entry to w, in as many messages as necessary to
+// keep them within the negotiated message size. Fails with hop.Emodified
+// if the value changes while it is being read. Returns the version and the
+// number of bytes written.
+func (clnt *Clnt) GetStream(key string, version uint64, w io.Writer) (ver uint64, n int64, err error) {
+	v := clnt.Version()
+	if !v.HasFeature(rmt.RangeFeature) {
+		var val []byte
+		var m int
+
+		ver, val, err = clnt.Get(key, version)
+		if err != nil || ver == 0 {
+			return
+		}
+
+		m, err = w.Write(val)
+		return ver, int64(m), err
+	}
+
+	return hop.GetStream(clnt, key, version, w, uint64(rmt.MaxGetrange(v.Msize)))
+}
+
+// Replaces the value of the entry with the content of r, in as many
+// messages as necessary to keep them within the negotiated message size.
+// The entry must exist. The readers can see the partially written value.
+// Returns the final version (0 if the entry doesn't exist) and the number
+// of bytes read from r.
+func (clnt *Clnt) SetStream(key string, r io.Reader) (ver uint64, n int64, err error) {
+	v := clnt.Version()
+	if !v.HasFeature(rmt.RangeFeature) {
+		var val []byte
+
+		if val, err = ioutil.ReadAll(r); err != nil {
+			return
+		}
+
+		ver, err = clnt.Set(key, val)
+		return ver, int64(len(val)), err
+	}
+
+	chunk := rmt.MaxSetrange(v.Msize, key)
+	if chunk == 0 {
+		return 0, 0, rmt.Etoolarge
+	}
+
+	return hop.SetStream(clnt, key, r, uint64(chunk))
+}
@@ -0,0 +1,47 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopclnt
+
+import (
+	"hop"
+	"hop/rmt"
+	"time"
+)
+
+func (clnt *Clnt) Stat(key string) (st *hop.Stat, err error) {
+	var rc *rmt.Msg
+
+	tc := clnt.conn.GetOutbound()
+	err = rmt.PackTstat(tc, key)
+	if err != nil {
+		clnt.conn.ReleaseOutbound(tc)
+		return
+	}
+
+	rc, err = clnt.Rpc(tc)
+	if err == nil && rc.Version != 0 {
+		st = new(hop.Stat)
+		st.Version = rc.Version
+		st.Size = rc.Valsize
+		st.Ctime = nsecToTime(rc.Ctime)
+		st.Mtime = nsecToTime(rc.Mtime)
+		st.Flags = rc.Flags
+		st.Creator = rc.Creator
+	}
+
+	if rc != nil {
+		clnt.conn.ReleaseInbound(rc)
+	}
+
+	return
+}
+
+func nsecToTime(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(ns))
+}
@@ -21,7 +21,7 @@ func (clnt *Clnt) TestSet(key string, version uint64, oldvalue, value []byte) (v
 	rc, err = clnt.Rpc(tc)
 	if err == nil {
 		ver = rc.Version
-		val = rc.Value
+		val = clone(rc.Value)
 	}
 
 	if rc != nil {
@@ -12,9 +12,13 @@ import (
 )
 
 const (
-	Msize = 8 * 1024 * 1024 // the default read buffer size
+	Msize              = 8 * 1024 * 1024 // the default maximum message size
+	DefaultMaxConnReqs = 64              // the default per-connection concurrency limit
+	DefaultMaxPending  = 1024            // the default per-connection limit of pending requests
 )
 
+var Ebusy error = &rmt.Error{Edescr: "too many pending requests", Ecode: rmt.EAGAIN}
+
 func (srv *Srv) NewConn(c rmt.Conn) {
 	conn := new(Conn)
 	conn.Srv = srv
@@ -22,14 +26,25 @@ func (srv *Srv) NewConn(c rmt.Conn) {
 	conn.conn = c
 	conn.ops, _ = srv.Ops.(hop.Hop)
 	conn.done = make(chan bool)
+	conn.waits = make(map[*rmt.Msg]bool)
 	conn.prev = nil
 
 	srv.Lock()
 	conn.next = srv.connlist
+	if conn.next != nil {
+		conn.next.prev = conn
+	}
 	srv.connlist = conn
+	if srv.stopping {
+		conn.refused = Eshutdown
+	}
 	srv.Unlock()
 
 	conn.Id = c.RemoteAddr()
+	if c.Msize() == 0 {
+		c.SetMsize(srv.Msize)
+	}
+
 	c.SetRequestHandler(conn)
 	if op, ok := (conn.Srv.Ops).(ConnOps); ok {
 		op.ConnOpened(conn)
@@ -53,6 +68,12 @@ func (conn *Conn) ConnError(err error) {
 	}
 	conn.Srv.Unlock()
 
+	if n := conn.Srv.dropQueued(conn); n > 0 {
+		conn.Lock()
+		conn.npend -= n
+		conn.Unlock()
+	}
+
 	if sop, ok := (interface{}(conn)).(StatsOps); ok {
 		sop.statsUnregister()
 	}
@@ -74,16 +95,44 @@ func (conn *Conn) Incoming(m *rmt.Msg) {
 		}
 	}
 
+	longpoll := isLongPoll(m)
 	conn.Lock()
 	conn.nreqs++
 	conn.tsz += uint64(m.Size)
+	refused := conn.refused
 	conn.npend++
 	if conn.npend > conn.maxpend {
 		conn.maxpend = conn.npend
 	}
+
+	if refused == nil && !longpoll {
+		// flow control: stop reading from the connection until some of
+		// the pending requests are completed
+		conn.checkPause()
+	}
+
+	if longpoll {
+		conn.nwait++
+		if max := conn.Srv.MaxWaits; refused == nil && max > 0 && conn.nwait > max {
+			refused = Ebusy
+		}
+
+		if refused == nil {
+			conn.waits[m] = true
+		}
+	}
 	conn.Unlock()
 
-	go conn.Process(m)
+	if refused != nil && (m.Type != rmt.Tversion || refused == Eshutdown) {
+		conn.reply(m, conn.conn.GetOutbound(), refused)
+		return
+	}
+
+	if longpoll {
+		go conn.Process(m)
+	} else {
+		conn.Srv.enqueue(conn, m)
+	}
 }
 
 func (conn *Conn) RemoteAddr() string {
@@ -128,6 +177,14 @@ func (conn *Conn) logMsg(m *rmt.Msg) {
 		mm := new(rmt.Msg)
 		*mm = *m
 		mm.Pkt = nil
+
+		// the values may be overwritten once the message is released
+		mm.Value = append([]byte(nil), m.Value...)
+		mm.Oldval = append([]byte(nil), m.Oldval...)
+		mm.Vals = nil
+		for _, v := range m.Vals {
+			mm.Vals = append(mm.Vals, append([]byte(nil), v...))
+		}
 		conn.Srv.Log.Log(mm, conn, DbgLogMsgs)
 	}
 }
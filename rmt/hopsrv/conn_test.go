@@ -0,0 +1,76 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopsrv
+
+import (
+	"hop"
+	"hop/rmt"
+	"hop/rmt/hopclnt"
+	"hop/shop"
+	"testing"
+	"time"
+)
+
+// SHop with Sets that wait until the gate is closed
+type gateHop struct {
+	*shop.SHop
+	gate chan bool
+}
+
+func (h *gateHop) Set(key string, value []byte) (uint64, error) {
+	<-h.gate
+	return h.SHop.Set(key, value)
+}
+
+// The server stops reading from the connection while MaxPending requests
+// are pending, and continues when they complete
+func TestMaxPending(t *testing.T) {
+	h := &gateHop{shop.NewSHop(), make(chan bool)}
+	h.Create("k", "", []byte("0"))
+	srv := new(Srv)
+	srv.MaxPending = 4
+	srv.Start(h)
+	addr := "127.0.0.1:5291"
+	if _, err := rmt.Listen("tcp", addr, srv); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(time.Second)
+
+	c, err := hopclnt.Connect("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	clnt := c.(*hopclnt.Clnt)
+	var fs []*hop.Future
+	for i := 0; i < 20; i++ {
+		fs = append(fs, clnt.SetAsync("k", []byte{byte(i)}))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	srv.Lock()
+	conn := srv.connlist
+	srv.Unlock()
+
+	conn.Lock()
+	npend, paused := conn.npend, conn.paused
+	conn.Unlock()
+	if npend != srv.MaxPending || !paused {
+		t.Fatalf("%d pending requests, paused %v, expected %d and paused", npend, paused, srv.MaxPending)
+	}
+
+	close(h.gate)
+	if err := hop.WaitAll(fs...); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Lock()
+	maxpend := conn.maxpend
+	conn.Unlock()
+	if maxpend > srv.MaxPending {
+		t.Fatalf("%d requests were pending, the limit is %d", maxpend, srv.MaxPending)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopsrv
+
+import (
+	"fmt"
+	"hop/rmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A request passed through the interceptors. The messages are valid only
+// until the After methods return.
+type Req struct {
+	Conn     *Conn
+	Tc       *rmt.Msg      // decoded request
+	Rc       *rmt.Msg      // response, set before After is called
+	Err      error         // result of the operation, set before After is called
+	Start    time.Time     // time the processing started
+	Duration time.Duration // processing time, set before After is called
+}
+
+// Interceptors are called around the processing of each request. Before is
+// called in the order the interceptors are listed in Srv.Interceptors. If
+// it returns an error, the request is not processed and the error is sent
+// to the client. After is called in reverse order, only for the
+// interceptors whose Before succeeded.
+type Interceptor interface {
+	Before(r *Req) error
+	After(r *Req)
+}
+
+var opNames = map[uint16]string{
+	rmt.Tcreate:   "create",
+	rmt.Tremove:   "remove",
+	rmt.Tget:      "get",
+	rmt.Tset:      "set",
+	rmt.Ttestset:  "testset",
+	rmt.Tatomic:   "atomic",
+	rmt.Tstat:     "stat",
+	rmt.Tversion:  "version",
+	rmt.Tgetrange: "getrange",
+	rmt.Tsetrange: "setrange",
+}
+
+// Returns the name of the operation
+func (r *Req) Op() string {
+	if s, ok := opNames[r.Tc.Type]; ok {
+		return s
+	}
+
+	if mt := rmt.GetMsgType(r.Tc.Type); mt != nil {
+		return mt.Name
+	}
+
+	return fmt.Sprintf("op%d", r.Tc.Type)
+}
+
+// Returns the size of the values in the request
+func (r *Req) ValueSize() int {
+	n := len(r.Tc.Value) + len(r.Tc.Oldval)
+	for _, v := range r.Tc.Vals {
+		n += len(v)
+	}
+
+	return n
+}
+
+func (r *Req) String() string {
+	s := fmt.Sprintf("%s %s key '%s' version %d size %d: %v", r.Conn, r.Op(), r.Tc.Key, r.Tc.Version, r.ValueSize(), r.Duration)
+	if r.Err != nil {
+		s += " error: " + r.Err.Error()
+	}
+
+	return s
+}
+
+// Processes the request through the interceptors
+func (conn *Conn) intercept(tc *rmt.Msg, ics []Interceptor) (rc *rmt.Msg, err error) {
+	var n int
+
+	r := &Req{Conn: conn, Tc: tc, Start: time.Now()}
+	for n = 0; n < len(ics); n++ {
+		if err = ics[n].Before(r); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		rc, err = conn.process(tc)
+	} else {
+		rc = conn.conn.GetOutbound()
+	}
+
+	r.Rc, r.Err, r.Duration = rc, err, time.Since(r.Start)
+	for n--; n >= 0; n-- {
+		ics[n].After(r)
+	}
+
+	return
+}
+
+// Logs all requests
+type LogInterceptor struct{}
+
+func (LogInterceptor) Before(r *Req) error {
+	return nil
+}
+
+func (LogInterceptor) After(r *Req) {
+	log.Println(r)
+}
+
+// Logs the requests that take longer than Threshold
+type SlowInterceptor struct {
+	Threshold time.Duration
+}
+
+func (s *SlowInterceptor) Before(r *Req) error {
+	return nil
+}
+
+func (s *SlowInterceptor) After(r *Req) {
+	if r.Duration >= s.Threshold {
+		log.Println("slow:", r)
+	}
+}
+
+// Operation counts
+type OpCount struct {
+	N      uint64        // number of requests
+	Errors uint64        // number of failed requests
+	Time   time.Duration // total processing time
+}
+
+// Counts the operations on the keys with each prefix. The requests for
+// keys without any of the prefixes are counted under the empty prefix. If
+// no prefixes are specified, the prefix of a key is its part up to (and
+// including) the first '/'.
+type PrefixCounter struct {
+	sync.Mutex
+	prefixes []string
+	counts   map[string]map[string]*OpCount
+}
+
+func NewPrefixCounter(prefixes ...string) *PrefixCounter {
+	pc := new(PrefixCounter)
+	pc.prefixes = append([]string(nil), prefixes...)
+
+	// the longest prefix matches first
+	sort.Sort(sort.Reverse(sort.StringSlice(pc.prefixes)))
+	pc.counts = make(map[string]map[string]*OpCount)
+	return pc
+}
+
+func (pc *PrefixCounter) prefix(key string) string {
+	if len(pc.prefixes) == 0 {
+		if n := strings.Index(key, "/"); n >= 0 {
+			return key[0 : n+1]
+		}
+
+		return ""
+	}
+
+	for _, p := range pc.prefixes {
+		if strings.HasPrefix(key, p) {
+			return p
+		}
+	}
+
+	return ""
+}
+
+func (pc *PrefixCounter) Before(r *Req) error {
+	return nil
+}
+
+func (pc *PrefixCounter) After(r *Req) {
+	p := pc.prefix(r.Tc.Key)
+	op := r.Op()
+
+	pc.Lock()
+	defer pc.Unlock()
+	ops := pc.counts[p]
+	if ops == nil {
+		ops = make(map[string]*OpCount)
+		pc.counts[p] = ops
+	}
+
+	c := ops[op]
+	if c == nil {
+		c = new(OpCount)
+		ops[op] = c
+	}
+
+	c.N++
+	c.Time += r.Duration
+	if r.Err != nil {
+		c.Errors++
+	}
+}
+
+// Returns a copy of the counts, by prefix and operation name
+func (pc *PrefixCounter) Counts() map[string]map[string]OpCount {
+	pc.Lock()
+	defer pc.Unlock()
+
+	counts := make(map[string]map[string]OpCount)
+	for p, ops := range pc.counts {
+		m := make(map[string]OpCount)
+		for op, c := range ops {
+			m[op] = *c
+		}
+
+		counts[p] = m
+	}
+
+	return counts
+}
+
+// Resets the counts
+func (pc *PrefixCounter) Reset() {
+	pc.Lock()
+	pc.counts = make(map[string]map[string]*OpCount)
+	pc.Unlock()
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopsrv
+
+import (
+	"hop"
+	"hop/rmt"
+)
+
+// The requests of each connection are queued and served by the workers.
+// The connections that have queued requests and are below MaxConnReqs are
+// kept in the ready list, and the workers take one request at a time from
+// the connection at its head, so a busy connection can't starve the
+// others. If Workers is zero, a worker is started for each connection that
+// becomes ready.
+//
+// The long-poll Gets may wait for a new value for a long time, they are
+// processed in their own goroutines and don't take worker slots.
+
+// Returns true if the request may wait for a new value
+func isLongPoll(m *rmt.Msg) bool {
+	switch m.Type {
+	case rmt.Tget, rmt.Tgetrange:
+		return m.Version != hop.Any && m.Version != hop.Newest
+	}
+
+	return false
+}
+
+// Queues the request for processing
+func (srv *Srv) enqueue(conn *Conn, m *rmt.Msg) {
+	srv.slock.Lock()
+	conn.queue = append(conn.queue, m)
+	srv.makeReady(conn)
+	srv.slock.Unlock()
+}
+
+// Adds the connection to the end of the ready list if it has queued
+// requests and can process more. Should be called with slock held.
+func (srv *Srv) makeReady(conn *Conn) {
+	if conn.inready || len(conn.queue) == 0 {
+		return
+	}
+
+	if srv.MaxConnReqs > 0 && conn.nrun >= srv.MaxConnReqs {
+		return
+	}
+
+	conn.inready = true
+	srv.ready = append(srv.ready, conn)
+	if srv.Workers > 0 {
+		srv.scond.Signal()
+	} else {
+		go srv.worker(false)
+	}
+}
+
+// Processes the requests of the ready connections. If pool is false,
+// returns when there are no ready connections.
+func (srv *Srv) worker(pool bool) {
+	srv.slock.Lock()
+	for {
+		for len(srv.ready) == 0 {
+			if !pool || srv.done {
+				srv.slock.Unlock()
+				return
+			}
+
+			srv.scond.Wait()
+		}
+
+		conn := srv.ready[0]
+		copy(srv.ready, srv.ready[1:])
+		srv.ready[len(srv.ready)-1] = nil
+		srv.ready = srv.ready[0 : len(srv.ready)-1]
+		conn.inready = false
+		if len(conn.queue) == 0 {
+			// the connection was closed
+			continue
+		}
+
+		m := conn.queue[0]
+		conn.queue[0] = nil
+		conn.queue = conn.queue[1:]
+		conn.nrun++
+		srv.makeReady(conn)
+		srv.slock.Unlock()
+
+		conn.Process(m)
+
+		srv.slock.Lock()
+		conn.nrun--
+		srv.makeReady(conn)
+	}
+}
+
+// Drops the queued requests of the connection. Returns their number.
+func (srv *Srv) dropQueued(conn *Conn) int {
+	srv.slock.Lock()
+	q := conn.queue
+	conn.queue = nil
+	srv.slock.Unlock()
+
+	for _, m := range q {
+		conn.conn.ReleaseInbound(m)
+	}
+
+	return len(q)
+}
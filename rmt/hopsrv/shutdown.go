@@ -0,0 +1,131 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hopsrv
+
+import (
+	"hop/rmt"
+	"time"
+)
+
+var Eshutdown error = &rmt.Error{Edescr: "server shutting down", Ecode: rmt.ESHUTDOWN}
+var Etimedout error = &rmt.Error{Edescr: "pending requests not completed", Ecode: rmt.EAGAIN}
+
+// Stops accepting new connections and requests. The new requests on the
+// established connections fail with Eshutdown. The long-poll Gets that are
+// waiting for a new value are answered with Eshutdown and no longer count
+// as pending, but a Hop can't be asked to stop a Get, so their goroutines
+// stay blocked until the entries change and then drop the responses. They
+// don't take worker slots. The other requests in flight are completed.
+func (srv *Srv) Stop() {
+	srv.Lock()
+	if srv.stopping {
+		srv.Unlock()
+		return
+	}
+
+	srv.stopping = true
+	conns := srv.conns()
+	srv.Unlock()
+
+	rmt.Unlisten(srv)
+	for _, conn := range conns {
+		conn.Lock()
+		if conn.refused == nil {
+			conn.refused = Eshutdown
+		}
+
+		waits := conn.waits
+		conn.waits = make(map[*rmt.Msg]bool)
+		conn.Unlock()
+
+		// The Gets are still blocked in their own goroutines, they
+		// release the requests when they return
+		for tc := range waits {
+			conn.send(tc, conn.conn.GetOutbound(), Eshutdown)
+			conn.completed(true)
+		}
+	}
+}
+
+// Waits up to timeout for the pending requests to complete. Returns
+// Etimedout if some of them are still pending.
+func (srv *Srv) Wait(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := 0
+		srv.Lock()
+		for _, conn := range srv.conns() {
+			conn.Lock()
+			n += conn.npend
+			conn.Unlock()
+		}
+		srv.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return Etimedout
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Stops the server, waits up to timeout for the pending requests, and
+// closes the connections
+func (srv *Srv) Shutdown(timeout time.Duration) (err error) {
+	srv.Stop()
+	err = srv.Wait(timeout)
+
+	srv.Lock()
+	conns := srv.conns()
+	srv.Unlock()
+
+	for _, conn := range conns {
+		if f, ok := conn.conn.(rmt.Flusher); ok {
+			f.Flush()
+		}
+
+		conn.Close()
+	}
+
+	srv.slock.Lock()
+	srv.done = true
+	if srv.scond != nil {
+		srv.scond.Broadcast()
+	}
+	srv.slock.Unlock()
+
+	if sop, ok := (interface{}(srv)).(StatsOps); ok {
+		sop.statsUnregister()
+	}
+
+	return
+}
+
+// Returns the connections, called with srv locked
+func (srv *Srv) conns() (conns []*Conn) {
+	for conn := srv.connlist; conn != nil; conn = conn.next {
+		conns = append(conns, conn)
+	}
+
+	return
+}
+
+// Removes the long-poll Get from the waiting ones. Returns false if it was
+// already answered.
+func (conn *Conn) unwait(tc *rmt.Msg) bool {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if !conn.waits[tc] {
+		return false
+	}
+
+	delete(conn.waits, tc)
+	return true
+}
@@ -46,10 +46,24 @@ type Srv struct {
 	Id          string    // Used for debugging and stats
 	Debuglevel  int       // debug level
 	Log         *hop.Logger
+	Msize       uint32    // maximum message size, Msize if zero
+	Tagbits     uint8     // maximum tag bits, rmt.MaxTagbits if zero
+	Workers     int       // requests processed in parallel by the server, unlimited if zero
+	MaxConnReqs int       // requests processed in parallel per connection, DefaultMaxConnReqs if zero
+	MaxPending  int       // requests pending per connection before it stops reading, DefaultMaxPending if zero
+	MaxWaits    int       // long-poll Gets waiting per connection, unlimited if zero
 
-	Ops interface{} // operations
+	Ops          interface{}   // operations
+	Interceptors []Interceptor // called around the processing of each request, in order
 
 	connlist *Conn // List of connections
+	stopping bool  // Stop was called
+
+	// scheduler
+	slock sync.Mutex
+	scond *sync.Cond // signalled when a connection becomes ready
+	ready []*Conn    // connections with queued requests, served round-robin
+	done  bool       // the workers should exit
 }
 
 // The Conn type represents a connection from a client to the file server
@@ -62,15 +76,27 @@ type Conn struct {
 	conn rmt.Conn
 	ops  hop.Hop         // operations
 
+	ver     *rmt.Version // nil if not negotiated
+	refused error        // if not nil, the requests are refused
+
 	done       chan bool
 	prev, next *Conn
 
+	// scheduling, protected by Srv.slock
+	queue   []*rmt.Msg // requests waiting for a worker
+	nrun    int        // requests being processed
+	inready bool       // in Srv.ready
+
+	waits  map[*rmt.Msg]bool // long-poll Gets being processed
+	paused bool              // the connection is paused, see checkPause
+
 	// stats
 	nreqs   int    // number of requests processed by the server
 	tsz     uint64 // total size of the T messages received
 	rsz     uint64 // total size of the R messages sent
 	npend   int    // number of currently pending messages
 	maxpend int    // maximum number of pending messages
+	nwait   int    // number of pending long-poll Gets
 	nreads  int    // number of reads
 	nwrites int    // number of writes
 }
@@ -87,6 +113,27 @@ func (srv *Srv) Start(ops interface{}) bool {
 		srv.Log = hop.NewLogger(1024)
 	}
 
+	if srv.Msize == 0 {
+		srv.Msize = Msize
+	}
+
+	if srv.Tagbits == 0 {
+		srv.Tagbits = rmt.MaxTagbits
+	}
+
+	if srv.MaxConnReqs == 0 {
+		srv.MaxConnReqs = DefaultMaxConnReqs
+	}
+
+	if srv.MaxPending == 0 {
+		srv.MaxPending = DefaultMaxPending
+	}
+
+	srv.scond = sync.NewCond(&srv.slock)
+	for i := 0; i < srv.Workers; i++ {
+		go srv.worker(true)
+	}
+
 	if sop, ok := (interface{}(srv)).(StatsOps); ok {
 		sop.statsRegister()
 	}
@@ -103,11 +150,31 @@ func (srv *Srv) String() string {
 // implementer should call it only if the Hop server implements
 // the ReqProcessOps within the ReqProcess operation.
 func (conn *Conn) Process(tc *rmt.Msg) {
+	var rc *rmt.Msg
+	var err error
+
+	if ics := conn.Srv.Interceptors; len(ics) > 0 {
+		rc, err = conn.intercept(tc, ics)
+	} else {
+		rc, err = conn.process(tc)
+	}
+
+	if isLongPoll(tc) && !conn.unwait(tc) {
+		// already answered by Stop
+		conn.conn.ReleaseOutbound(rc)
+		conn.conn.ReleaseInbound(tc)
+		return
+	}
+
+	conn.reply(tc, rc, err)
+}
+
+// Calls the operation for the request. Returns the response, packed unless
+// err is not nil.
+func (conn *Conn) process(tc *rmt.Msg) (rc *rmt.Msg, err error) {
 	var ver uint64
 	var val []byte
 	var vals [][]byte
-	var err error
-	var rc *rmt.Msg
 
 	ops := conn.ops
 	c := conn.conn
@@ -115,10 +182,18 @@ func (conn *Conn) Process(tc *rmt.Msg) {
 	switch tc.Type {
 	default:
 		rc = c.GetOutbound()
-		err = &rmt.Error{"unknown message type", rmt.ENOSYS}
+		if mt := rmt.GetMsgType(tc.Type); mt != nil && mt.Serve != nil && tc.Type == mt.Ttype() {
+			err = mt.Serve(ops, tc, rc)
+		} else {
+			err = &rmt.Error{"unknown message type", rmt.ENOSYS}
+		}
 
 	case rmt.Tcreate:
-		ver, err = ops.Create(tc.Key, tc.Flags, tc.Value)
+		if cop, ok := ops.(hop.CreateAsHop); ok {
+			ver, err = cop.CreateAs(conn.Id, tc.Key, tc.Flags, tc.Value)
+		} else {
+			ver, err = ops.Create(tc.Key, tc.Flags, tc.Value)
+		}
 		rc = c.GetOutbound()
 		if err == nil {
 			err = rmt.PackRcreate(rc, ver)
@@ -158,6 +233,61 @@ func (conn *Conn) Process(tc *rmt.Msg) {
 		if err == nil {
 			err = rmt.PackRatomic(rc, ver, vals)
 		}
+
+	case rmt.Tgetrange:
+		var size uint64
+
+		count := tc.Count
+		if msize := conn.msize(); msize != 0 && count > rmt.MaxGetrange(msize) {
+			count = rmt.MaxGetrange(msize)
+		}
+
+		ver, size, val, err = hop.GetRange(ops, tc.Key, tc.Version, tc.Offset, uint64(count))
+		rc = c.GetOutbound()
+		if err == nil {
+			err = rmt.PackRgetrange(rc, ver, size, val)
+		}
+
+	case rmt.Tsetrange:
+		ver, err = hop.SetRange(ops, tc.Key, tc.Offset, tc.Value, tc.Truncate)
+		rc = c.GetOutbound()
+		if err == nil {
+			err = rmt.PackRsetrange(rc, ver)
+		}
+
+	case rmt.Tversion:
+		var v *rmt.Version
+
+		rc = c.GetOutbound()
+		if v, err = conn.negotiate(tc); err == nil {
+			err = rmt.PackRversion(rc, v)
+		}
+
+	case rmt.Tstat:
+		var st *hop.Stat
+
+		// the Hops without Stat return the version and size
+		rc = c.GetOutbound()
+		if st, err = hop.GetStat(ops, tc.Key); err == nil {
+			err = rmt.PackRstat(rc, st)
+		}
+	}
+
+	return
+}
+
+// Sends the response to the request, or Rerror if err is not nil
+func (conn *Conn) reply(tc, rc *rmt.Msg, err error) {
+	longpoll := isLongPoll(tc)
+	conn.send(tc, rc, err)
+	conn.conn.ReleaseInbound(tc)
+	conn.completed(longpoll)
+}
+
+// Packs the error, if any, and sends the response
+func (conn *Conn) send(tc, rc *rmt.Msg, err error) {
+	if msize := conn.msize(); err == nil && msize != 0 && rc.Size > msize {
+		err = &rmt.Error{Edescr: "response too large", Ecode: rmt.EINVAL}
 	}
 
 	if err != nil {
@@ -184,7 +314,84 @@ func (conn *Conn) Process(tc *rmt.Msg) {
 	}
 
 	conn.conn.Send(rc)
-	conn.conn.ReleaseInbound(tc)
+}
+
+// Updates the pending requests after a response is sent
+func (conn *Conn) completed(longpoll bool) {
+	conn.Lock()
+	conn.npend--
+	if longpoll {
+		conn.nwait--
+	}
+	conn.checkPause()
+	conn.Unlock()
+}
+
+// Pauses the connection if there are MaxPending requests pending that are
+// not long-poll Gets, and resumes it when they drop below. The connections
+// that can't pause queue the requests.
+// called with conn lock held
+func (conn *Conn) checkPause() {
+	p, ok := conn.conn.(rmt.Pauser)
+	if !ok {
+		return
+	}
+
+	full := conn.npend-conn.nwait >= conn.Srv.MaxPending
+	if full && !conn.paused {
+		conn.paused = true
+		p.Pause()
+	} else if !full && conn.paused {
+		conn.paused = false
+		p.Resume()
+	}
+}
+
+// Sets up the connection with the parameters agreed to for the client's
+// Tversion. The incompatible clients are refused.
+func (conn *Conn) negotiate(tc *rmt.Msg) (v *rmt.Version, err error) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.ver != nil {
+		return nil, &rmt.Error{Edescr: "protocol already negotiated", Ecode: rmt.EPROTO}
+	}
+
+	msize := conn.Srv.Msize
+	if cmsize := conn.conn.Msize(); cmsize != 0 && cmsize < msize {
+		msize = cmsize
+	}
+
+	v, err = rmt.AcceptVersion(tc, msize, conn.Srv.Tagbits)
+	if err != nil {
+		conn.refused = err
+		return
+	}
+
+	conn.ver = v
+	conn.conn.SetMsize(v.Msize)
+	return
+}
+
+// Returns the maximum size of the responses, zero if the client didn't
+// negotiate it
+func (conn *Conn) msize() uint32 {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.ver != nil {
+		return conn.ver.Msize
+	}
+
+	return 0
+}
+
+// Returns the negotiated protocol parameters, nil if the client didn't
+// negotiate them
+func (conn *Conn) Version() *rmt.Version {
+	conn.Lock()
+	defer conn.Unlock()
+	return conn.ver
 }
 
 func (conn *Conn) String() string {
@@ -48,6 +48,7 @@ _	"log"
 	"net"
 	_ "runtime"
 	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -95,6 +96,7 @@ type IBconn struct {
 	rspHandler MsgHandler
 	recvchan   chan *Msg
 	errchan    chan error
+	msize      uint32 // accessed atomically
 
 	// RDMA fields
 	cmid  *C.struct_rdma_cm_id
@@ -353,6 +355,7 @@ func (c *IBconn) ReleaseOutbound(m *Msg) {
 	m.Value = nil
 	m.Oldval = nil
 	m.Vals = nil
+	m.Ext = nil
 	m.Pkt = nil
 	select {
 	case c.dev.omsgchan <- m:
@@ -369,6 +372,7 @@ func (c *IBconn) ReleaseInbound(m *Msg) {
 	m.Value = nil
 	m.Oldval = nil
 	m.Vals = nil
+	m.Ext = nil
 	m.Pkt = nil
 	select {
 	case c.dev.imsgchan <- m:
@@ -376,6 +380,14 @@ func (c *IBconn) ReleaseInbound(m *Msg) {
 	}
 }
 
+func (c *IBconn) SetMsize(msize uint32) {
+	atomic.StoreUint32(&c.msize, msize)
+}
+
+func (c *IBconn) Msize() uint32 {
+	return atomic.LoadUint32(&c.msize)
+}
+
 func (conn *IBconn) RemoteAddr() string {
 	return conn.addr
 }
@@ -388,6 +400,11 @@ func (conn *IBconn) recvproc() {
 	for conn.err == nil {
 		select {
 		case m := <-conn.recvchan:
+			if msize := conn.Msize(); msize != 0 && uint32(len(m.Pkt)) > msize {
+				conn.err = Etoolarge
+				break
+			}
+
 			if e := Unpack(m, m.Pkt); e != nil {
 				fmt.Printf("Error while unpacking: %v\n", e)
 				conn.err = e
@@ -0,0 +1,123 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rmt
+
+import (
+	"fmt"
+	"hop"
+	"sync"
+)
+
+// The message types from Textfirst up can be registered by the packages
+// that extend the protocol. The T message types are odd, and the type of
+// the response is one larger. The extension packs the messages itself,
+// using PackHeader to allocate them.
+const Textfirst = 1001
+
+// Operations of a T/R message pair registered by an extension
+type MsgType struct {
+	// Name of the operation, also registered as a protocol feature.
+	// The clients should send the T message only if the feature was
+	// negotiated with the server.
+	Name string
+
+	// Unpack the body of the message (without the common header).
+	// The unpacked values are usually stored in Msg.Ext.
+	UnpackT func(m *Msg, body []byte) error
+	UnpackR func(m *Msg, body []byte) error
+
+	// Return the text representation of the message (optional)
+	StringT func(m *Msg) string
+	StringR func(m *Msg) string
+
+	// Processes the request on the server and packs the response in rc.
+	// ops is the Hop the server connection serves. If it returns an
+	// error, Rerror is sent instead.
+	Serve func(ops hop.Hop, tc, rc *Msg) error
+
+	ttype uint16
+}
+
+var mtlock sync.RWMutex
+var msgtypes map[uint16]*MsgType
+
+func init() {
+	msgtypes = make(map[uint16]*MsgType)
+}
+
+// Registers the message pair with T message type ttype and R message type
+// ttype+1
+func AddMsgType(ttype uint16, mt *MsgType) error {
+	if ttype < Textfirst || ttype%2 == 0 || ttype == 0xFFFF {
+		return fmt.Errorf("invalid message type %d", ttype)
+	}
+
+	if mt.UnpackT == nil || mt.UnpackR == nil {
+		return fmt.Errorf("message type %d: no unpack functions", ttype)
+	}
+
+	mtlock.Lock()
+	defer mtlock.Unlock()
+	if msgtypes[ttype] != nil {
+		return fmt.Errorf("message type %d already registered", ttype)
+	}
+
+	if err := AddFeature(mt.Name); err != nil {
+		return err
+	}
+
+	mt.ttype = ttype
+	msgtypes[ttype] = mt
+	return nil
+}
+
+// Returns the registered message pair the T or R message type belongs to
+func GetMsgType(mtype uint16) *MsgType {
+	if mtype%2 == 0 {
+		mtype--
+	}
+
+	mtlock.RLock()
+	mt := msgtypes[mtype]
+	mtlock.RUnlock()
+	return mt
+}
+
+// Returns the T message type of the pair
+func (mt *MsgType) Ttype() uint16 {
+	return mt.ttype
+}
+
+// Returns the R message type of the pair
+func (mt *MsgType) Rtype() uint16 {
+	return mt.ttype + 1
+}
+
+func (mt *MsgType) unpack(m *Msg, body []byte) error {
+	if m.Type == mt.ttype {
+		return mt.UnpackT(m, body)
+	}
+
+	return mt.UnpackR(m, body)
+}
+
+func (mt *MsgType) format(m *Msg) string {
+	f, name := mt.StringR, "R"
+	if m.Type == mt.ttype {
+		f, name = mt.StringT, "T"
+	}
+
+	if f != nil {
+		return f(m)
+	}
+
+	return fmt.Sprintf("%s%s tag %d size %d", name, mt.Name, m.Tag, m.Size)
+}
+
+// Allocates the packet for a message of the specified type with size
+// bytes of body and packs the common header. Returns the body.
+func PackHeader(m *Msg, size int, mtype uint16) ([]byte, error) {
+	return packCommon(m, size, mtype)
+}
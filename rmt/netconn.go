@@ -10,18 +10,48 @@ import (
 	"hop"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 const (
 	Msize = 1024 * 1024 // the default read buffer size
 )
 
+// Maximum number of queued messages written with a single writev call.
+// One writes each message separately.
+var NetMaxBatch = 64
+
+// Received messages up to that size are copied to their own buffer, so
+// the ones kept for a long time (e.g. the long-poll Gets) don't hold the
+// whole receive buffer. The larger ones reference the receive buffer.
+var NetCopySize = 512
+
+// Receive buffer shared by the messages unpacked from it. The messages
+// reference the data in the buffer, and it is reused once the receiver is
+// done with it and all of them are released with ReleaseInbound.
+type netbuf struct {
+	buf []byte
+	ref int32
+}
+
+var netbufs = make(chan *netbuf, 64)
+
+var netlock sync.Mutex
+var netlisteners = make(map[Listener][]net.Listener)
+
 type Netconn struct {
 	conn     net.Conn
 	done     chan bool
 	msgout   chan *Msg
+	flushch  chan chan bool
+	sdone    chan bool // closed when send() exits
 	imsgchan chan *Msg
 	omsgchan chan *Msg
+	msize    uint32 // accessed atomically
+	paused   int32  // accessed atomically, see Pause
+	plock    sync.Mutex
+	pcond    *sync.Cond // signalled when the connection is resumed
 
 	reqHandler MsgHandler
 	rspHandler MsgHandler
@@ -30,9 +60,12 @@ type Netconn struct {
 func NewNetconn(conn net.Conn) *Netconn {
 	c := new(Netconn)
 	c.conn = conn
-	c.msgout = make(chan *Msg)
+	c.msgout = make(chan *Msg, NetMaxBatch)
+	c.flushch = make(chan chan bool)
+	c.sdone = make(chan bool)
 	c.imsgchan = make(chan *Msg, 512)
 	c.omsgchan = make(chan *Msg, 512)
+	c.pcond = sync.NewCond(&c.plock)
 
 	go c.recv()
 	go c.send()
@@ -75,6 +108,7 @@ func (c *Netconn) ReleaseOutbound(m *Msg) {
 	m.Value = nil
 	m.Oldval = nil
 	m.Vals = nil
+	m.Ext = nil
 	m.Pkt = nil
 	select {
 	case c.omsgchan <- m:
@@ -95,20 +129,69 @@ func (c *Netconn) GetInbound() (m *Msg) {
 }
 
 func (c *Netconn) ReleaseInbound(m *Msg) {
-	// make sure we don't keep stuff that should be garbage-collected
-	m.Value = nil
-	m.Oldval = nil
-	m.Vals = nil
-	m.Pkt = nil
-	m.Buf = nil
+	if m.nbuf != nil {
+		m.nbuf.release()
+		m.nbuf = nil
+	}
+
+	// make sure we don't keep stuff that should be garbage-collected,
+	// and the next message doesn't see the fields of this one. The
+	// buffer small messages are copied to is reused.
+	buf := m.Buf
+	*m = Msg{}
+	m.Buf = buf
 	select {
-	case c.omsgchan <- m:
+	case c.imsgchan <- m:
 	default:
 	}
 }
 
+func (c *Netconn) SetMsize(msize uint32) {
+	atomic.StoreUint32(&c.msize, msize)
+}
+
+func (c *Netconn) Msize() uint32 {
+	return atomic.LoadUint32(&c.msize)
+}
+
+// Waits until the messages passed to Send are written
+func (conn *Netconn) Flush() {
+	ch := make(chan bool)
+	select {
+	case conn.flushch <- ch:
+		<-ch
+	case <-conn.sdone:
+	}
+}
+
 func (conn *Netconn) Close() {
 	conn.conn.Close()
+	conn.Resume()
+}
+
+// The receive goroutine stops before the next message. The messages of
+// both directions are read from the same stream, so the responses to our
+// requests are not delivered either until the connection is resumed.
+func (conn *Netconn) Pause() {
+	conn.plock.Lock()
+	atomic.StoreInt32(&conn.paused, 1)
+	conn.plock.Unlock()
+}
+
+func (conn *Netconn) Resume() {
+	conn.plock.Lock()
+	atomic.StoreInt32(&conn.paused, 0)
+	conn.pcond.Broadcast()
+	conn.plock.Unlock()
+}
+
+// Waits until the connection is resumed
+func (conn *Netconn) waitResume() {
+	conn.plock.Lock()
+	for atomic.LoadInt32(&conn.paused) != 0 {
+		conn.pcond.Wait()
+	}
+	conn.plock.Unlock()
 }
 
 func (conn *Netconn) RemoteAddr() string {
@@ -119,54 +202,122 @@ func (conn *Netconn) LocalAddr() string {
 	return conn.conn.LocalAddr().String()
 }
 
+// Returns a receive buffer of at least size bytes
+func getNetbuf(size int) *netbuf {
+	if size <= Msize {
+		select {
+		case b := <-netbufs:
+			b.ref = 1
+			return b
+		default:
+		}
+
+		size = Msize
+	}
+
+	return &netbuf{buf: make([]byte, size), ref: 1}
+}
+
+func (b *netbuf) release() {
+	if atomic.AddInt32(&b.ref, -1) != 0 || len(b.buf) != Msize {
+		return
+	}
+
+	select {
+	case netbufs <- b:
+	default:
+	}
+}
+
+// Moves the unprocessed data between start and pos to the beginning of a
+// buffer with space for at least size bytes. Reuses the current buffer if
+// none of the received messages use it.
+func (conn *Netconn) rebuf(nb *netbuf, start, pos, size int) (*netbuf, int) {
+	if atomic.LoadInt32(&nb.ref) != 1 || len(nb.buf) < size {
+		b := getNetbuf(size)
+		copy(b.buf, nb.buf[start:pos])
+		nb.release()
+		nb = b
+	} else {
+		copy(nb.buf, nb.buf[start:pos])
+	}
+
+	return nb, pos - start
+}
+
 func (conn *Netconn) recv() {
 	var err error
 	var n int
 
-	buf := make([]byte, Msize)
-	pos := 0
+	// the data between start and pos is received but not unpacked
+	nb := getNetbuf(Msize)
+	start, pos := 0, 0
 	for {
-		if len(buf) < int(64) {
-			b := make([]byte, Msize)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
+		if len(nb.buf)-pos < 64 && start > 0 {
+			nb, pos = conn.rebuf(nb, start, pos, pos-start+64)
+			start = 0
+		}
+
+		if atomic.LoadInt32(&conn.paused) != 0 {
+			conn.waitResume()
 		}
 
-		n, err = conn.conn.Read(buf[pos:])
+		n, err = conn.conn.Read(nb.buf[pos:])
 		if err != nil || n == 0 {
 			goto closed
 		}
 
 		pos += n
-		for pos > 4 {
-			sz, _ := hop.Gint32(buf)
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					nsz := sz
-					if nsz < Msize {
-						nsz = Msize
-					}
-
-					b := make([]byte, nsz)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
+		for pos-start > 4 {
+			if atomic.LoadInt32(&conn.paused) != 0 {
+				conn.waitResume()
+			}
+
+			sz, _ := hop.Gint32(nb.buf[start:])
+			if msize := conn.Msize(); msize != 0 && sz > msize {
+				err = Etoolarge
+				log.Println(fmt.Sprintf("invalid packet: %v: size %d larger than %d", conn.RemoteAddr(), sz, msize))
+				conn.conn.Close()
+				goto closed
+			}
+
+			if pos-start < int(sz) {
+				if len(nb.buf)-start < int(sz) {
+					nb, pos = conn.rebuf(nb, start, pos, int(sz))
+					start = 0
 				}
 
 				break
 			}
 
 			m := conn.GetInbound()
-			err := Unpack(m, buf)
+			end := start + int(sz)
+			pkt := nb.buf[start:end:end]
+			small := int(sz) <= NetCopySize
+			if small {
+				if len(m.Buf) < int(sz) {
+					m.Buf = make([]byte, (sz+63)&^63)
+				}
+
+				pkt = m.Buf[0:sz:sz]
+				copy(pkt, nb.buf[start:end])
+			}
+
+			err := Unpack(m, pkt)
 			if err != nil {
-				log.Println(fmt.Sprintf("invalid packet : %v: %v %v", conn.RemoteAddr(), err, buf))
+				log.Println(fmt.Sprintf("invalid packet : %v: %v %v", conn.RemoteAddr(), err, pkt))
 				conn.conn.Close()
 				goto closed
 			}
 
+			if !small {
+				atomic.AddInt32(&nb.ref, 1)
+				m.nbuf = nb
+			}
+
+			start = end
+
 			//			log.Println("]]]", m.String())
-			msize := m.Size
 			if m.Type%2 == 0 {
 				if conn.rspHandler != nil {
 					conn.rspHandler.Incoming(m)
@@ -184,13 +335,11 @@ func (conn *Netconn) recv() {
 					goto closed
 				}
 			}
-
-			buf = buf[msize:]
-			pos -= int(msize)
 		}
 	}
 
 closed:
+	nb.release()
 	conn.conn.Close()		// just in case...
 	if err == nil {
 		err = errors.New("connection closed")
@@ -210,28 +359,73 @@ closed:
 }
 
 func (conn *Netconn) send() {
+	var ms []*Msg
+	var bufs net.Buffers
+
+	defer close(conn.sdone)
 	for {
 		select {
 		case <-conn.done:
 			return
 
-		case m := <-conn.msgout:
-			for buf := m.Pkt; len(buf) > 0; {
-				n, err := conn.conn.Write(buf)
-				if err != nil {
-					/* just close the socket, will get signal on conn.done */
-					log.Println(fmt.Sprintf("error while writing: %v", err))
-					conn.conn.Close()
+		case ch := <-conn.flushch:
+			// write all messages sent before Flush was called
+			for {
+				if ms = conn.batch(ms[:0]); len(ms) == 0 {
 					break
 				}
 
-				buf = buf[n:]
+				bufs = conn.write(ms, bufs)
 			}
 
-			//			log.Println("[[[", m.String())
-			//			conn.ReleaseOutbound(m)
+			close(ch)
+
+		case m := <-conn.msgout:
+			ms = conn.batch(append(ms[:0], m))
+			bufs = conn.write(ms, bufs)
+		}
+	}
+}
+
+// Adds the queued messages to ms, up to NetMaxBatch
+func (conn *Netconn) batch(ms []*Msg) []*Msg {
+	for len(ms) < NetMaxBatch {
+		select {
+		case m := <-conn.msgout:
+			ms = append(ms, m)
+		default:
+			return ms
 		}
 	}
+
+	return ms
+}
+
+// Writes the messages with a single writev call (if the connection
+// supports it) and releases them. Returns bufs to be reused by the next
+// call.
+func (conn *Netconn) write(ms []*Msg, bufs net.Buffers) net.Buffers {
+	bufs = bufs[:0]
+	for _, m := range ms {
+		bufs = append(bufs, m.Pkt)
+		//		log.Println("[[[", m.String())
+	}
+
+	// WriteTo consumes bufs, keep the slice to reuse it
+	b := bufs
+	if _, err := b.WriteTo(conn.conn); err != nil {
+		/* just close the socket, will get signal on conn.done */
+		log.Println(fmt.Sprintf("error while writing: %v", err))
+		conn.conn.Close()
+	}
+
+	for i, m := range ms {
+		conn.ReleaseOutbound(m)
+		ms[i] = nil
+		bufs[i] = nil
+	}
+
+	return bufs
 }
 
 func StartNetListener(ntype, addr string, listener Listener) (err error) {
@@ -240,9 +434,17 @@ func StartNetListener(ntype, addr string, listener Listener) (err error) {
 		return &Error{err.Error(), EIO}
 	}
 
+	netlock.Lock()
+	netlisteners[listener] = append(netlisteners[listener], l)
+	netlock.Unlock()
+
 	go func() {
 		for {
 			if c, err := l.Accept(); err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
 				log.Println(err)
 			} else {
 				listener.NewConnection(NewNetconn(c))
@@ -253,6 +455,22 @@ func StartNetListener(ntype, addr string, listener Listener) (err error) {
 	return nil
 }
 
+// Stops accepting connections for the listener
+func StopNetListener(listener Listener) (err error) {
+	netlock.Lock()
+	ls := netlisteners[listener]
+	delete(netlisteners, listener)
+	netlock.Unlock()
+
+	for _, l := range ls {
+		if e := l.Close(); e != nil && err == nil {
+			err = &Error{e.Error(), EIO}
+		}
+	}
+
+	return
+}
+
 type netprototype int
 
 var netproto netprototype
@@ -271,6 +489,10 @@ func (netprototype) Listen(proto, addr string, lstn Listener) (string, error) {
 	return addr, err
 }
 
+func (netprototype) Unlisten(lstn Listener) error {
+	return StopNetListener(lstn)
+}
+
 func init() {
 	if err := AddProtocol("tcp", netproto); err != nil {
 		fmt.Printf("Error: %v\n", err)
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"hop"
 	"math"
+	"strings"
 )
 
 func PackRerror(m *Msg, edescr string, ecode uint32) error {
@@ -127,3 +128,91 @@ func PackRatomic(m *Msg, version uint64, values [][]byte) error {
 
 	return nil
 }
+
+// If st is nil, the entry doesn't exist and all values are zero
+func PackRstat(m *Msg, st *hop.Stat) error {
+	var ctime, mtime uint64
+
+	if st == nil {
+		st = new(hop.Stat)
+	}
+
+	size := 8 + 8 + 8 + 8 + 2 + len(st.Flags) + 2 + len(st.Creator) /* version[8] size[8] ctime[8] mtime[8] flags[s] creator[s] */
+	p, err := packCommon(m, size, Rstat)
+	if err != nil {
+		return err
+	}
+
+	if !st.Ctime.IsZero() {
+		ctime = uint64(st.Ctime.UnixNano())
+	}
+
+	if !st.Mtime.IsZero() {
+		mtime = uint64(st.Mtime.UnixNano())
+	}
+
+	m.Version = st.Version
+	m.Valsize = st.Size
+	m.Ctime = ctime
+	m.Mtime = mtime
+	m.Flags = st.Flags
+	m.Creator = st.Creator
+	p = hop.Pint64(st.Version, p)
+	p = hop.Pint64(st.Size, p)
+	p = hop.Pint64(ctime, p)
+	p = hop.Pint64(mtime, p)
+	p = hop.Pstr(st.Flags, p)
+	hop.Pstr(st.Creator, p)
+
+	return nil
+}
+
+func PackRversion(m *Msg, v *Version) error {
+	fs := strings.Join(v.Features, " ")
+	size := 2 + 4 + 1 + 2 + len(fs) /* pversion[2] msize[4] tagbits[1] features[s] */
+	p, err := packCommon(m, size, Rversion)
+	if err != nil {
+		return err
+	}
+
+	m.Pversion = v.Version
+	m.Msize = v.Msize
+	m.Tagbits = v.Tagbits
+	m.Features = v.Features
+	p = hop.Pint16(v.Version, p)
+	p = hop.Pint32(v.Msize, p)
+	p = hop.Pint8(v.Tagbits, p)
+	hop.Pstr(fs, p)
+
+	return nil
+}
+
+func PackRgetrange(m *Msg, version, valsize uint64, value []byte) error {
+	size := 8 + 8 + 4 + len(value) /* version[8] size[8] value[n] */
+	p, err := packCommon(m, size, Rgetrange)
+	if err != nil {
+		return err
+	}
+
+	m.Version = version
+	m.Valsize = valsize
+	m.Value = value
+	p = hop.Pint64(version, p)
+	p = hop.Pint64(valsize, p)
+	hop.Pblob(value, p)
+
+	return nil
+}
+
+func PackRsetrange(m *Msg, version uint64) error {
+	size := 8 /* version[8] */
+	p, err := packCommon(m, size, Rsetrange)
+	if err != nil {
+		return err
+	}
+
+	m.Version = version
+	hop.Pint64(version, p)
+
+	return nil
+}
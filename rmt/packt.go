@@ -8,6 +8,7 @@ import (
 	"errors"
 	"hop"
 	"math"
+	"strings"
 )
 
 func PackTget(m *Msg, key string, version uint64) error {
@@ -101,6 +102,18 @@ func PackTtestset(m *Msg, key string, version uint64, oldvalue []byte, value []b
 	return nil
 }
 
+func PackTstat(m *Msg, key string) error {
+	size := 2 + len(key) /* key[s] */
+	p, err := packCommon(m, size, Tstat)
+	if err != nil {
+		return err
+	}
+
+	m.Key = key
+	p = hop.Pstr(key, p)
+	return nil
+}
+
 func PackTatomic(m *Msg, op uint16, key string, values [][]byte) error {
 	size := 2 + 2 + len(key) + 2 /* op[2] key[s] valnum[2] */
 	valnum := uint16(0)
@@ -135,3 +148,63 @@ func PackTatomic(m *Msg, op uint16, key string, values [][]byte) error {
 
 	return nil
 }
+
+func PackTversion(m *Msg, pversion uint16, msize uint32, tagbits uint8, features []string) error {
+	fs := strings.Join(features, " ")
+	size := 2 + 4 + 1 + 2 + len(fs) /* pversion[2] msize[4] tagbits[1] features[s] */
+	p, err := packCommon(m, size, Tversion)
+	if err != nil {
+		return err
+	}
+
+	m.Pversion = pversion
+	m.Msize = msize
+	m.Tagbits = tagbits
+	m.Features = features
+	p = hop.Pint16(pversion, p)
+	p = hop.Pint32(msize, p)
+	p = hop.Pint8(tagbits, p)
+	p = hop.Pstr(fs, p)
+	return nil
+}
+
+func PackTgetrange(m *Msg, key string, version, offset uint64, count uint32) error {
+	size := 2 + len(key) + 8 + 8 + 4 /* key[s] version[8] offset[8] count[4] */
+	p, err := packCommon(m, size, Tgetrange)
+	if err != nil {
+		return err
+	}
+
+	m.Key = key
+	m.Version = version
+	m.Offset = offset
+	m.Count = count
+	p = hop.Pstr(key, p)
+	p = hop.Pint64(version, p)
+	p = hop.Pint64(offset, p)
+	p = hop.Pint32(count, p)
+	return nil
+}
+
+func PackTsetrange(m *Msg, key string, offset uint64, value []byte, truncate bool) error {
+	size := 2 + len(key) + 8 + 1 + 4 + len(value) /* key[s] offset[8] truncate[1] value[n] */
+	p, err := packCommon(m, size, Tsetrange)
+	if err != nil {
+		return err
+	}
+
+	trunc := uint8(0)
+	if truncate {
+		trunc = 1
+	}
+
+	m.Key = key
+	m.Offset = offset
+	m.Truncate = truncate
+	m.Value = value
+	p = hop.Pstr(key, p)
+	p = hop.Pint64(offset, p)
+	p = hop.Pint8(trunc, p)
+	p = hop.Pblob(value, p)
+	return nil
+}
@@ -25,6 +25,14 @@ const (
 	Rtestset
 	Tatomic
 	Ratomic
+	Tstat
+	Rstat
+	Tversion
+	Rversion
+	Tgetrange
+	Rgetrange
+	Tsetrange
+	Rsetrange
 	Tlast
 )
 
@@ -36,12 +44,15 @@ const (
 
 // Error values
 const (
+	EAGAIN     = syscall.EAGAIN
 	ECONNRESET = syscall.ECONNRESET
 	EINVAL     = syscall.EINVAL
 	EIO        = syscall.EIO
 	ENOENT     = syscall.ENOENT
 	ENOSYS     = syscall.ENOSYS
 	EPERM      = syscall.EPERM
+	EPROTO     = syscall.EPROTO
+	ESHUTDOWN  = syscall.ESHUTDOWN
 )
 
 type RemoteHop interface {
@@ -60,18 +71,33 @@ type Msg struct {
 	Type uint16 // message type
 	Tag  uint16 // message tag
 
-	Key     string   // key
-	Version uint64   // version of the key
-	Value   []byte   // value
-	Oldval  []byte   // old value
-	Vals    [][]byte // list of values for the atomic operations
-	Atmop   uint16   // atomic set operation
-	Flags   string   // create flags
-	Edescr  string   // error description
-	Ecode   uint32   // error code
+	Key      string   // key
+	Version  uint64   // version of the key
+	Value    []byte   // value
+	Oldval   []byte   // old value
+	Vals     [][]byte // list of values for the atomic operations
+	Atmop    uint16   // atomic set operation
+	Flags    string   // create flags
+	Valsize  uint64   // value size (Rstat, Rgetrange)
+	Ctime    uint64   // creation time, in nanoseconds since the epoch (Rstat)
+	Mtime    uint64   // modification time, in nanoseconds since the epoch (Rstat)
+	Creator  string   // identity of the entry's creator (Rstat)
+	Pversion uint16   // protocol version (Tversion, Rversion)
+	Msize    uint32   // maximum message size (Tversion, Rversion)
+	Tagbits  uint8    // number of bits used by the tags (Tversion, Rversion)
+	Features []string // optional features (Tversion, Rversion)
+	Offset   uint64   // offset in the value (Tgetrange, Tsetrange)
+	Count    uint32   // maximum number of bytes to read (Tgetrange)
+	Truncate bool     // truncate the value after the data (Tsetrange)
+	Edescr   string   // error description
+	Ecode    uint32   // error code
+
+	Ext interface{} // unpacked body of the extension messages (see AddMsgType)
 
 	Pkt []uint8 // raw packet data
 	Buf []uint8 // buffer to put the raw data in
+
+	nbuf *netbuf // Netconn receive buffer the message was unpacked from
 }
 
 // Error represents a Hop error
@@ -96,8 +122,14 @@ var minMsgsize = [...]uint32{
 	20, /* Rtestset version[8] value[n] */
 	14, /* Tatomic op[2] key[s] valnum[2] value[n] value[n] ... */
 	10, /* Ratomic version[8] valnum[2] value[n] value[n] ... */
-	18, /* Tgetnewer key[s] version[8] */
-	20, /* Rgetnewer version[8] value[n] */
+	10, /* Tstat key[s] */
+	44, /* Rstat version[8] size[8] ctime[8] mtime[8] flags[s] creator[s] */
+	17, /* Tversion pversion[2] msize[4] tagbits[1] features[s] */
+	17, /* Rversion pversion[2] msize[4] tagbits[1] features[s] */
+	30, /* Tgetrange key[s] version[8] offset[8] count[4] */
+	28, /* Rgetrange version[8] size[8] value[n] */
+	23, /* Tsetrange key[s] offset[8] truncate[1] value[n] */
+	16, /* Rsetrange version[8] */
 }
 
 // Allocates a new Fcall.
@@ -143,3 +175,19 @@ func (err *Error) Error() string {
 
 	return ""
 }
+
+// Returns true if err is target, or an error received from a remote Hop
+// with the same description. The responses carry only the description and
+// the code of an error, so a remote hop.Enoent can be recognized only by
+// its description.
+func IsError(err, target error) bool {
+	if err == nil || target == nil {
+		return err == target
+	}
+
+	if e, ok := err.(*Error); ok {
+		return e.Edescr == target.Error()
+	}
+
+	return err == target
+}
@@ -49,6 +49,10 @@ func Unpack(m *Msg, buf []byte) error {
 	p = p[0 : m.Size-8]
 	m.Pkt = buf[0:m.Size]
 	if m.Type < Rerror || m.Type >= Tlast {
+		if mt := GetMsgType(m.Type); mt != nil {
+			return mt.unpack(m, p)
+		}
+
 		return &Error{"invalid id", EINVAL}
 	}
 
@@ -146,6 +150,58 @@ func Unpack(m *Msg, buf []byte) error {
 			}
 		}
 
+	case Tstat:
+		m.Key, p = hop.Gstr(p)
+
+	case Rstat:
+		m.Version, p = hop.Gint64(p)
+		m.Valsize, p = hop.Gint64(p)
+		m.Ctime, p = hop.Gint64(p)
+		m.Mtime, p = hop.Gint64(p)
+		m.Flags, p = hop.Gstr(p)
+		if p == nil {
+			goto szerror
+		}
+
+		m.Creator, p = hop.Gstr(p)
+
+	case Tversion, Rversion:
+		m.Pversion, p = hop.Gint16(p)
+		m.Msize, p = hop.Gint32(p)
+		m.Tagbits, p = hop.Gint8(p)
+		m.Features, p = unpackFeatures(p)
+
+	case Tgetrange:
+		m.Key, p = hop.Gstr(p)
+		if p == nil || len(p) < 20 {
+			goto szerror
+		}
+
+		m.Version, p = hop.Gint64(p)
+		m.Offset, p = hop.Gint64(p)
+		m.Count, p = hop.Gint32(p)
+
+	case Rgetrange:
+		m.Version, p = hop.Gint64(p)
+		m.Valsize, p = hop.Gint64(p)
+		m.Value, p = hop.Gblob(p)
+
+	case Tsetrange:
+		var trunc uint8
+
+		m.Key, p = hop.Gstr(p)
+		if p == nil || len(p) < 13 {
+			goto szerror
+		}
+
+		m.Offset, p = hop.Gint64(p)
+		trunc, p = hop.Gint8(p)
+		m.Truncate = trunc != 0
+		m.Value, p = hop.Gblob(p)
+
+	case Rsetrange:
+		m.Version, p = hop.Gint64(p)
+
 	case Ratomic:
 		var n uint16
 
@@ -0,0 +1,211 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rmt
+
+import (
+	"fmt"
+	"hop"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The client starts the connection with a Tversion message that proposes
+// the protocol version, the maximum message size, the number of bits the
+// tags can use, and the optional features it supports:
+//
+//	Tversion pversion[2] msize[4] tagbits[1] features[s]
+//	Rversion pversion[2] msize[4] tagbits[1] features[s]
+//
+// The features are separated by spaces. The server responds with the
+// protocol version it is going to use (not larger than the proposed one),
+// the message size and tag bits not larger than the proposed ones, and the
+// features from the proposal it supports, ignoring the unknown ones. If
+// the server can't talk to the client, it responds with Rerror and refuses
+// the following requests. Servers treat the clients that don't send
+// Tversion as legacy clients that use the default parameters and no
+// features.
+const (
+	ProtoVersion    = 1    // protocol version implemented by the package
+	MinProtoVersion = 1    // oldest protocol version the package can talk
+	MinMsize        = 8192 // smallest maximum message size that can be negotiated
+	MinTagbits      = 8    // smallest number of tag bits that can be negotiated
+	MaxTagbits      = 16   // tags are 16 bits on the wire
+)
+
+// Parameters negotiated by the Tversion/Rversion exchange
+type Version struct {
+	Version  uint16   // protocol version
+	Msize    uint32   // maximum message size
+	Tagbits  uint8    // number of bits used by the tags
+	Features []string // optional features supported by both peers
+}
+
+// Features implemented by the package
+const (
+	RangeFeature = "range" // Tgetrange and Tsetrange messages
+)
+
+var Etoolarge = &Error{"message too large", EINVAL}
+
+var featlock sync.Mutex
+var features map[string]bool
+
+func init() {
+	features = make(map[string]bool)
+	features[RangeFeature] = true
+}
+
+// Registers an optional protocol feature. The features are proposed by
+// the clients and accepted by the servers only if they are registered on
+// both sides.
+func AddFeature(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid feature name '%s'", name)
+	}
+
+	featlock.Lock()
+	features[name] = true
+	featlock.Unlock()
+	return nil
+}
+
+// Returns the names of the registered features
+func Features() (fs []string) {
+	featlock.Lock()
+	for f := range features {
+		fs = append(fs, f)
+	}
+	featlock.Unlock()
+
+	sort.Strings(fs)
+	return
+}
+
+func supportedFeatures(fs []string) (sfs []string) {
+	featlock.Lock()
+	defer featlock.Unlock()
+
+	for _, f := range fs {
+		if features[f] {
+			sfs = append(sfs, f)
+		}
+	}
+
+	return
+}
+
+func unpackFeatures(buf []byte) ([]string, []byte) {
+	var s string
+
+	if s, buf = hop.Gstr(buf); s == "" {
+		return nil, buf
+	}
+
+	return strings.Fields(s), buf
+}
+
+// Returns true if the feature was negotiated. Connections from legacy
+// peers (nil Version) don't support any features.
+func (v *Version) HasFeature(name string) bool {
+	if v == nil {
+		return false
+	}
+
+	for _, f := range v.Features {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the parameters a server that supports messages up to msize bytes
+// and tags up to tagbits bits agrees to for the client's Tversion, or the
+// reason the client is refused.
+func AcceptVersion(tc *Msg, msize uint32, tagbits uint8) (v *Version, err error) {
+	if tc.Pversion < MinProtoVersion {
+		return nil, &Error{fmt.Sprintf("incompatible protocol version %d, server supports %d to %d", tc.Pversion, MinProtoVersion, ProtoVersion), EPROTO}
+	}
+
+	if tc.Msize < MinMsize {
+		return nil, &Error{fmt.Sprintf("message size %d smaller than %d", tc.Msize, MinMsize), EPROTO}
+	}
+
+	v = new(Version)
+	v.Version = tc.Pversion
+	if v.Version > ProtoVersion {
+		v.Version = ProtoVersion
+	}
+
+	v.Msize = tc.Msize
+	if msize != 0 && msize < v.Msize {
+		v.Msize = msize
+	}
+
+	v.Tagbits = tc.Tagbits
+	if tagbits < v.Tagbits {
+		v.Tagbits = tagbits
+	}
+
+	if v.Tagbits < MinTagbits {
+		return nil, &Error{fmt.Sprintf("tag bits %d smaller than %d", v.Tagbits, MinTagbits), EPROTO}
+	}
+
+	v.Features = supportedFeatures(tc.Features)
+	return
+}
+
+// Checks the server's Rversion response to the proposal in tc and returns
+// the negotiated parameters, or the reason the server can't be used.
+func CheckVersion(tc, rc *Msg) (v *Version, err error) {
+	if rc.Pversion < MinProtoVersion || rc.Pversion > tc.Pversion {
+		return nil, &Error{fmt.Sprintf("incompatible protocol version %d, client supports %d to %d", rc.Pversion, MinProtoVersion, tc.Pversion), EPROTO}
+	}
+
+	if rc.Msize < MinMsize || rc.Msize > tc.Msize {
+		return nil, &Error{fmt.Sprintf("invalid message size %d, proposed %d", rc.Msize, tc.Msize), EPROTO}
+	}
+
+	if rc.Tagbits < MinTagbits || rc.Tagbits > tc.Tagbits {
+		return nil, &Error{fmt.Sprintf("invalid tag bits %d, proposed %d", rc.Tagbits, tc.Tagbits), EPROTO}
+	}
+
+	v = new(Version)
+	v.Version = rc.Pversion
+	v.Msize = rc.Msize
+	v.Tagbits = rc.Tagbits
+
+	// ignore the features we didn't ask for
+	for _, f := range rc.Features {
+		for _, pf := range tc.Features {
+			if f == pf {
+				v.Features = append(v.Features, f)
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// Returns the maximum number of value bytes a Rgetrange can carry if the
+// messages are up to msize bytes
+func MaxGetrange(msize uint32) uint32 {
+	return msize - minMsgsize[Rgetrange-Rerror]
+}
+
+// Returns the maximum number of value bytes a Tsetrange for the key can
+// carry if the messages are up to msize bytes. Returns 0 if the key is too
+// long.
+func MaxSetrange(msize uint32, key string) uint32 {
+	sz := minMsgsize[Tsetrange-Rerror] + uint32(len(key))
+	if sz >= msize {
+		return 0
+	}
+
+	return msize - sz
+}
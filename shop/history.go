@@ -0,0 +1,103 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shop
+
+import (
+	"hop"
+	"time"
+)
+
+// old version of an entry
+type histEntry struct {
+	version uint64
+	value   []byte
+	t       time.Time // when the version was replaced
+}
+
+// Sets the history retention for the entries created without the
+// history flag. Zero n and window disable the history.
+func (s *SHop) SetHistory(n int, window time.Duration) {
+	s.histlock.Lock()
+	s.histn = n
+	s.histage = window
+	s.histlock.Unlock()
+}
+
+func (s *SHop) historyParams(f *hop.Flags) (n int, window time.Duration) {
+	if f.History != 0 || f.HistoryAge != 0 {
+		return f.History, f.HistoryAge
+	}
+
+	s.histlock.Lock()
+	defer s.histlock.Unlock()
+	return s.histn, s.histage
+}
+
+func (s *SHop) getVersions(key string) (ver uint64, val []byte, err error) {
+	se, ok := s.FindEntry(key).(*SEntry)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	se.trimHistory(time.Now())
+	vers := make([]uint64, 0, len(se.hist)+1)
+	for _, h := range se.hist {
+		vers = append(vers, h.version)
+	}
+
+	vers = append(vers, se.Version)
+	return se.Version, hop.PackVersions(vers), nil
+}
+
+func (s *SHop) getExact(key string, version uint64) (ver uint64, val []byte, err error) {
+	se, ok := s.FindEntry(key).(*SEntry)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	se.Lock()
+	defer se.Unlock()
+	if version == se.Version {
+		return se.Version, se.Value, nil
+	}
+
+	se.trimHistory(time.Now())
+	for _, h := range se.hist {
+		if h.version == version {
+			return h.version, h.value, nil
+		}
+	}
+
+	return 0, nil, hop.Enoversion
+}
+
+// Saves the current value before it is replaced. e is locked.
+func (e *SEntry) saveHistory() {
+	if e.histn == 0 && e.histage == 0 {
+		return
+	}
+
+	now := time.Now()
+	e.hist = append(e.hist, histEntry{e.Version, e.Value, now})
+	e.trimHistory(now)
+}
+
+// e is locked
+func (e *SEntry) trimHistory(now time.Time) {
+	n := 0
+	if e.histn > 0 && len(e.hist) > e.histn {
+		n = len(e.hist) - e.histn
+	}
+
+	for e.histage > 0 && n < len(e.hist) && now.Sub(e.hist[n].t) > e.histage {
+		n++
+	}
+
+	if n > 0 {
+		e.hist = append([]histEntry(nil), e.hist[n:]...)
+	}
+}
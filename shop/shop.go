@@ -11,11 +11,22 @@ import (
 	"hop"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 )
 
 // simple entry (all entries created by the client)
 type SEntry struct {
 	hop.Entry
+	flags   string // canonical form of the Create flags
+	creator string
+	ctime   time.Time
+	mtime   time.Time
+
+	// history of the old versions
+	histn   int
+	histage time.Duration
+	hist    []histEntry
 }
 
 type LocalEntry struct {
@@ -33,6 +44,11 @@ type SHop struct {
 	// local entries
 	keysEntry   KeysEntry
 	keynumEntry KeynumEntry
+
+	// default history retention
+	histlock sync.Mutex
+	histn    int
+	histage  time.Duration
 }
 
 var Eparams = errors.New("invalid parameter number")
@@ -96,6 +112,23 @@ func (s *SHop) keysModified() {
 }
 
 func (s *SHop) Create(key, flags string, value []byte) (version uint64, err error) {
+	return s.CreateAs("", key, flags, value)
+}
+
+func (s *SHop) CreateAs(ident, key, flags string, value []byte) (version uint64, err error) {
+	return s.createAs(ident, key, flags, hop.Lowest, value)
+}
+
+func (s *SHop) CreateVersion(key, flags string, version uint64, value []byte) (err error) {
+	if version == 0 || version >= hop.Newest {
+		return hop.Eperm
+	}
+
+	_, err = s.createAs("", key, flags, version, value)
+	return
+}
+
+func (s *SHop) createAs(ident, key, flags string, ver uint64, value []byte) (version uint64, err error) {
 	if strings.HasPrefix(key, "#/") {
 		return 0, hop.Eperm
 	}
@@ -104,16 +137,27 @@ func (s *SHop) Create(key, flags string, value []byte) (version uint64, err erro
 		return 0, Enil
 	}
 
+	f, err := hop.ParseFlags(flags)
+	if err != nil {
+		return
+	}
+
 	val := make([]byte, len(value))
 	copy(val, value)
 
-	_, err = s.AddEntry(key, val, new(SEntry))
+	se := new(SEntry)
+	se.flags = f.String()
+	se.creator = ident
+	se.ctime = time.Now()
+	se.mtime = se.ctime
+	se.histn, se.histage = s.historyParams(f)
+	_, err = s.AddEntryVersion(key, val, se, ver)
 	if err != nil {
 		return
 	}
 
 	s.keysModified()
-	return hop.Lowest, nil
+	return ver, nil
 }
 
 func (s *SHop) Remove(key string) (err error) {
@@ -129,11 +173,41 @@ func (s *SHop) Remove(key string) (err error) {
 func (s *SHop) Get(key string, version uint64) (ver uint64, val []byte, err error) {
 	if strings.HasPrefix(key, "#/keys:") {
 		return s.keysEntry.Get(key, version)
+	} else if strings.HasPrefix(key, hop.FlagsPrefix) {
+		return s.getFlags(key[len(hop.FlagsPrefix):])
+	} else if strings.HasPrefix(key, hop.VersionsPrefix) {
+		return s.getVersions(key[len(hop.VersionsPrefix):])
+	} else if v, k, ok := hop.ParseVersionKey(key); ok {
+		return s.getExact(k, v)
 	}
 
 	return s.KHop.Get(key, version)
 }
 
+// The virtual entries are read whole
+func (s *SHop) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	if strings.HasPrefix(key, "#/") {
+		ver, val, err = s.Get(key, version)
+		if err != nil || ver == 0 {
+			return 0, 0, nil, err
+		}
+
+		return ver, uint64(len(val)), hop.RangeOf(val, offset, count), nil
+	}
+
+	return s.KHop.GetRange(key, version, offset, count)
+}
+
+// The flags don't change, so the version is always the lowest one
+func (s *SHop) getFlags(key string) (ver uint64, val []byte, err error) {
+	se, ok := s.FindEntry(key).(*SEntry)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return hop.Lowest, []byte(se.flags), nil
+}
+
 func (e *SEntry) Get(key string, version uint64) (ver uint64, val []byte, err error) {
 	if e==nil {
 		panic("SEntry.Get!!!")
@@ -145,6 +219,42 @@ func (e *SEntry) Get(key string, version uint64) (ver uint64, val []byte, err er
 	return e.Version, e.Value, nil
 }
 
+func (e *SEntry) GetRange(key string, version, offset, count uint64) (ver, size uint64, val []byte, err error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	return e.Version, uint64(len(e.Value)), hop.RangeOf(e.Value, offset, count), nil
+}
+
+// The values returned by Get are shared, so the data is written in place
+// only if it is appended at the end of the value. Otherwise the value is
+// copied.
+func (e *SEntry) SetRange(key string, offset uint64, data []byte, truncate bool) (ver uint64, err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.saveHistory()
+	e.IncreaseVersion()
+	e.Value = hop.Splice(e.Value, offset, data, truncate, true)
+	e.mtime = time.Now()
+	return e.Version, nil
+}
+
+func (e *SEntry) Stat(key string) (st *hop.Stat, err error) {
+	e.RLock()
+	defer e.RUnlock()
+
+	st = new(hop.Stat)
+	st.Version = e.Version
+	st.Size = uint64(len(e.Value))
+	st.Ctime = e.ctime
+	st.Mtime = e.mtime
+	st.Flags = e.flags
+	st.Creator = e.creator
+
+	return st, nil
+}
+
 func (e *SEntry) Set(key string, value []byte) (ver uint64, err error) {
 	ver, _, err = e.TestSet(key, hop.Any, nil, value)
 	return
@@ -176,12 +286,14 @@ func (e *SEntry) TestSet(key string, oldversion uint64, oldvalue, value []byte)
 		}
 	}
 
+	e.saveHistory()
 	e.IncreaseVersion()
 	ver = e.Version
 
 	val = make([]byte, len(value))
 	copy(val, value)
 	e.Value = val
+	e.mtime = time.Now()
 
 done:
 	return
@@ -261,8 +373,10 @@ func (e *SEntry) Atomic(key string, op uint16, values [][]byte) (ver uint64, ret
 	}
 
 	if val != nil {
+		e.saveHistory()
 		e.IncreaseVersion()
 		e.Value = val
+		e.mtime = time.Now()
 	} else {
 		val = e.Value
 	}
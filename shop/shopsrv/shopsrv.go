@@ -8,10 +8,14 @@ import (
 	"flag"
 	"fmt"
 	"hop"
+	"hop/chop"
 	"hop/rmt"
 	"hop/rmt/hopsrv"
 	"hop/shop"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -19,15 +23,31 @@ var proto = flag.String("proto", "tcp", "connection protocol")
 var addr = flag.String("addr", ":5004", "network address")
 var debug = flag.Int("d", 0, "debuglevel")
 var logsz = flag.Int("l", 2048, "log size")
+var lease = flag.Duration("lease", 0, "send cache invalidations for leases of that duration")
+var journal = flag.Uint64("journal", 0, "keep a journal of the modifications of up to that many bytes")
+var journalage = flag.Duration("journalage", 0, "maximum age of the journal records")
+var drain = flag.Duration("drain", 10*time.Second, "time to complete the pending requests on shutdown")
 
 func main() {
 	flag.Parse()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
 	sh := shop.NewSHop()
 	sh.AddEntry("#/id", []byte("SHop"), nil)
 	rmtsrv := new(hopsrv.Srv)
 	rmtsrv.Log = hop.NewLogger(*logsz)
 	rmtsrv.Debuglevel = *debug
-	if !rmtsrv.Start(sh) {
+	h := hop.Hop(sh)
+	if *journal != 0 || *journalage != 0 {
+		h = hop.NewJHop(h, *journal, *journalage)
+	}
+
+	ops := interface{}(h)
+	if *lease != 0 {
+		ops = chop.NewLeaseHop(h, *lease)
+	}
+
+	if !rmtsrv.Start(ops) {
 		log.Println(fmt.Sprintf("Error: can't start the server\n"))
 		return
 	}
@@ -39,8 +59,10 @@ func main() {
 	}
 
 	fmt.Printf("Listening on %v\n", laddr)
-	for {
-		time.Sleep(1000 * time.Millisecond)
+	<-sigs
+	log.Println("shutting down")
+	if err := rmtsrv.Shutdown(*drain); err != nil {
+		log.Println(fmt.Sprintf("Error: %s", err))
 	}
 	return
 
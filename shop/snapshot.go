@@ -0,0 +1,48 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shop
+
+import (
+	"hop"
+	"time"
+)
+
+// SEntries are included in the KHop snapshots
+func (e *SEntry) SnapshotFlags() string {
+	return e.flags
+}
+
+// Restores the entries from the snapshot, keeping their versions and
+// flags. The SHop should be empty, the entries that already exist are
+// not modified and Eexist is returned after all other entries are restored.
+func (s *SHop) Restore(snap *hop.Snapshot) (err error) {
+	snap.VisitEntries(func(key string, e *hop.SnapEntry) {
+		f, ferr := hop.ParseFlags(e.Flags)
+		if ferr != nil {
+			f = new(hop.Flags)
+		}
+
+		val := make([]byte, len(e.Value))
+		copy(val, e.Value)
+
+		se := new(SEntry)
+		se.flags = f.String()
+		se.ctime = time.Now()
+		se.mtime = snap.Time
+		se.histn, se.histage = s.historyParams(f)
+		ver := e.Version
+		if ver == 0 {
+			ver = hop.Lowest
+		}
+
+		// the waiters see the entry with its version
+		if _, aerr := s.AddEntryVersion(key, val, se, ver); aerr != nil {
+			err = aerr
+		}
+	})
+
+	s.keysModified()
+	return
+}
@@ -0,0 +1,87 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shop
+
+import (
+	"bytes"
+	"hash/crc32"
+	"hop"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	s := NewSHop()
+	s.Create("a", "", []byte("a1"))
+	s.Set("a", []byte("a2"))
+	s.Set("a", []byte("a3"))
+	s.Create("b", "cache=no", []byte("b1"))
+
+	var buf bytes.Buffer
+	if _, err := s.Snapshot().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := hop.ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewSHop()
+	if err := r.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		ver, val, _ := s.Get(key, hop.Any)
+		rver, rval, err := r.Get(key, hop.Any)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rver != ver || !bytes.Equal(rval, val) {
+			t.Fatalf("%s: version %d value %q, expected %d %q", key, rver, rval, ver, val)
+		}
+	}
+
+	if _, f, _ := r.Get(hop.FlagsPrefix+"b", hop.Any); string(f) != "cache=no" {
+		t.Fatalf("flags %q", f)
+	}
+
+	// the next version follows the restored one
+	if ver, _ := r.Set("a", []byte("a4")); ver != 4 {
+		t.Fatalf("version %d after Set, expected 4", ver)
+	}
+}
+
+// Replaces the checksum after the snapshot is modified
+func reseal(data []byte) []byte {
+	data = data[0 : len(data)-4]
+	sum := make([]byte, 4)
+	hop.Pint32(crc32.ChecksumIEEE(data), sum)
+	return append(data, sum...)
+}
+
+func TestReadSnapshotCorrupt(t *testing.T) {
+	s := NewSHop()
+	s.Create("a", "", []byte("a1"))
+
+	var buf bytes.Buffer
+	s.Snapshot().WriteTo(&buf)
+	data := buf.Bytes()
+
+	// more entries than the data contains
+	more := append([]byte{}, data...)
+	hop.Pint32(2, more[8+8:])
+	if _, err := hop.ReadSnapshot(bytes.NewReader(reseal(more))); err != hop.Esnapshot {
+		t.Fatalf("count too large: %v", err)
+	}
+
+	// the entry ends after the version
+	short := append([]byte{}, data[0:8+8+4+2+1+8]...)
+	short = append(short, 0, 0, 0, 0)
+	if _, err := hop.ReadSnapshot(bytes.NewReader(reseal(short))); err != hop.Esnapshot {
+		t.Fatalf("truncated entry: %v", err)
+	}
+}
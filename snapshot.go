@@ -0,0 +1,412 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hop
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Snapshot
+//
+// A snapshot contains the versions and values of the KHop entries at the
+// moment it was taken. Taking a snapshot copies the entries map, the values
+// are captured afterwards, without holding the KHop lock. Until a value is
+// captured, the KHop operations that modify the entry save its current
+// value in the snapshot before changing it. The values are never modified in
+// place, so the snapshot shares them with the KHop.
+//
+// The snapshot includes the entries without ops, and the entries whose ops
+// implement SnapshotEntry. The #/ entries are not included.
+//
+// A snapshot implements a read-only Hop. It supports the #/keys, #/keys:,
+// #/keynum and #/flags/ virtual entries.
+type Snapshot struct {
+	sync.Mutex
+	Time time.Time
+
+	entries map[string]*SnapEntry
+	pending map[string]*snapPending // entries not captured yet
+}
+
+type SnapEntry struct {
+	Version uint64
+	Value   []byte
+	Flags   string
+}
+
+type snapPending struct {
+	e     *Entry
+	flags string
+}
+
+// Entry ops that are included in the snapshots
+type SnapshotEntry interface {
+	// Returns the flags the entry was created with
+	SnapshotFlags() string
+}
+
+const snapMagic = "hopsnap1"
+
+var Esnapshot = errors.New("invalid snapshot")
+
+// Takes a snapshot of the entries
+func (h *KHop) Snapshot() (s *Snapshot) {
+	s = new(Snapshot)
+	s.entries = make(map[string]*SnapEntry)
+	s.pending = make(map[string]*snapPending)
+
+	h.Lock()
+	s.Time = time.Now()
+	for key, e := range h.entries {
+		if strings.HasPrefix(key, "#/") {
+			continue
+		}
+
+		p := &snapPending{e: e}
+		if e.ops != nil {
+			se, ok := e.ops.(SnapshotEntry)
+			if !ok {
+				continue
+			}
+
+			p.flags = se.SnapshotFlags()
+		}
+
+		s.pending[key] = p
+	}
+
+	snaps := make([]*Snapshot, len(h.snaps)+1)
+	copy(snaps, h.snaps)
+	snaps[len(h.snaps)] = s
+	h.snaps = snaps
+	h.Unlock()
+
+	// capture the values that weren't modified meanwhile
+	s.Lock()
+	keys := make([]string, 0, len(s.pending))
+	for key := range s.pending {
+		keys = append(keys, key)
+	}
+	s.Unlock()
+
+	for _, key := range keys {
+		s.Lock()
+		if p, ok := s.pending[key]; ok {
+			s.capture(key, p)
+		}
+		s.Unlock()
+	}
+
+	h.Lock()
+	snaps = make([]*Snapshot, 0, len(h.snaps))
+	for _, ss := range h.snaps {
+		if ss != s {
+			snaps = append(snaps, ss)
+		}
+	}
+	h.snaps = snaps
+	h.Unlock()
+
+	return
+}
+
+// Called before the entry is modified
+func (h *KHop) preserve(key string, e *Entry) {
+	h.RLock()
+	snaps := h.snaps
+	h.RUnlock()
+
+	for _, s := range snaps {
+		s.preserve(key, e)
+	}
+}
+
+func (s *Snapshot) preserve(key string, e *Entry) {
+	s.Lock()
+	if p, ok := s.pending[key]; ok && p.e == e {
+		s.capture(key, p)
+	}
+	s.Unlock()
+}
+
+// called with s lock held
+func (s *Snapshot) capture(key string, p *snapPending) {
+	delete(s.pending, key)
+
+	p.e.RLock()
+	ver := p.e.Version
+	val := p.e.Value
+	p.e.RUnlock()
+
+	if ver != 0 && ver != Removed {
+		s.entries[key] = &SnapEntry{ver, val, p.flags}
+	}
+}
+
+// Returns the number of entries in the snapshot
+func (s *Snapshot) NumEntries() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+// Calls the visit function for each entry, ordered by key
+func (s *Snapshot) VisitEntries(visit func(key string, e *SnapEntry)) {
+	s.Lock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	s.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.Lock()
+		e := s.entries[key]
+		s.Unlock()
+
+		visit(key, e)
+	}
+}
+
+// Adds an entry to the snapshot, used when a snapshot is built from another
+// source
+func (s *Snapshot) AddEntry(key string, e *SnapEntry) {
+	s.Lock()
+	if s.entries == nil {
+		s.entries = make(map[string]*SnapEntry)
+	}
+
+	s.entries[key] = e
+	s.Unlock()
+}
+
+func (s *Snapshot) Create(key, flags string, value []byte) (ver uint64, err error) {
+	return 0, Eperm
+}
+
+func (s *Snapshot) Remove(key string) (err error) {
+	return Eperm
+}
+
+// The snapshot doesn't change, so waiting for a future version returns
+// Eperm
+func (s *Snapshot) Get(key string, version uint64) (ver uint64, val []byte, err error) {
+	if key == "#/keys" || key == "#/keynum" || strings.HasPrefix(key, "#/keys:") {
+		return s.getKeys(key)
+	}
+
+	s.Lock()
+	flags := strings.HasPrefix(key, FlagsPrefix)
+	if flags {
+		key = key[len(FlagsPrefix):]
+	}
+
+	e := s.entries[key]
+	s.Unlock()
+
+	if e == nil {
+		return 0, nil, nil
+	}
+
+	if flags {
+		return Lowest, []byte(e.Flags), nil
+	}
+
+	switch version {
+	case Any, Newest:
+	case PastNewest:
+		return 0, nil, Eperm
+	default:
+		if version > e.Version {
+			return 0, nil, Eperm
+		}
+	}
+
+	return e.Version, e.Value, nil
+}
+
+func (s *Snapshot) getKeys(key string) (ver uint64, val []byte, err error) {
+	var re *regexp.Regexp
+
+	if key == "#/keynum" {
+		return Lowest, []byte(strconv.Itoa(s.NumEntries())), nil
+	}
+
+	if strings.HasPrefix(key, "#/keys:") {
+		re, err = regexp.Compile(key[7:])
+		if err != nil {
+			return
+		}
+	}
+
+	var keys []string
+	s.VisitEntries(func(key string, e *SnapEntry) {
+		if re == nil || re.MatchString(key) {
+			keys = append(keys, key)
+		}
+	})
+
+	return Lowest, []byte(strings.Join(keys, "\000")), nil
+}
+
+func (s *Snapshot) Stat(key string) (st *Stat, err error) {
+	s.Lock()
+	e := s.entries[key]
+	s.Unlock()
+
+	if e == nil {
+		return nil, nil
+	}
+
+	return &Stat{Version: e.Version, Size: uint64(len(e.Value)), Mtime: s.Time, Flags: e.Flags}, nil
+}
+
+func (s *Snapshot) Set(key string, value []byte) (ver uint64, err error) {
+	return 0, Eperm
+}
+
+func (s *Snapshot) TestSet(key string, oldversion uint64, oldvalue, value []byte) (ver uint64, val []byte, err error) {
+	return 0, nil, Eperm
+}
+
+func (s *Snapshot) Atomic(key string, op uint16, values [][]byte) (ver uint64, vals [][]byte, err error) {
+	return 0, nil, Eperm
+}
+
+// Writes the snapshot in the following format:
+//
+//	magic[8] time[8] count[4] entries[count] crc32[4]
+//
+// Each entry is key[s] version[8] flags[s] value[n]. The checksum (IEEE)
+// covers everything before it.
+func (s *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+
+	buf := make([]byte, len(snapMagic)+8+4)
+	copy(buf, snapMagic)
+	p := Pint64(uint64(s.Time.UnixNano()), buf[len(snapMagic):])
+	Pint32(uint32(s.NumEntries()), p)
+	bw.Write(buf)
+	n = int64(len(buf))
+
+	s.VisitEntries(func(key string, e *SnapEntry) {
+		buf := make([]byte, 2+len(key)+8+2+len(e.Flags)+4+len(e.Value))
+		p := Pstr(key, buf)
+		p = Pint64(e.Version, p)
+		p = Pstr(e.Flags, p)
+		Pblob(e.Value, p)
+		bw.Write(buf)
+		n += int64(len(buf))
+	})
+
+	if err = bw.Flush(); err != nil {
+		return
+	}
+
+	buf = make([]byte, 4)
+	Pint32(crc.Sum32(), buf)
+	if _, err = w.Write(buf); err != nil {
+		return
+	}
+
+	return n + 4, nil
+}
+
+// Reads a snapshot written by WriteTo
+func ReadSnapshot(r io.Reader) (s *Snapshot, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	hlen := len(snapMagic) + 8 + 4
+	if len(data) < hlen+4 || string(data[0:len(snapMagic)]) != snapMagic {
+		return nil, Esnapshot
+	}
+
+	sum, _ := Gint32(data[len(data)-4:])
+	data = data[0 : len(data)-4]
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, Esnapshot
+	}
+
+	s = new(Snapshot)
+	s.entries = make(map[string]*SnapEntry)
+	t, p := Gint64(data[len(snapMagic):])
+	s.Time = time.Unix(0, int64(t))
+	count, p := Gint32(p)
+	for i := uint32(0); i < count; i++ {
+		var key string
+
+		// the count may be larger than the number of entries
+		if len(p) < 2 {
+			return nil, Esnapshot
+		}
+
+		e := new(SnapEntry)
+		key, p = Gstr(p)
+		if p == nil || len(p) < 8+2 {
+			return nil, Esnapshot
+		}
+
+		e.Version, p = Gint64(p)
+		e.Flags, p = Gstr(p)
+		if p == nil || len(p) < 4 {
+			return nil, Esnapshot
+		}
+
+		e.Value, p = Gblob(p)
+		if p == nil {
+			return nil, Esnapshot
+		}
+
+		s.entries[key] = e
+	}
+
+	if len(p) != 0 {
+		return nil, Esnapshot
+	}
+
+	return
+}
+
+// Writes the snapshot to a file
+func (s *Snapshot) Save(filename string) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+
+	_, err = s.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return
+}
+
+// Reads a snapshot from a file
+func LoadSnapshot(filename string) (s *Snapshot, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+	return ReadSnapshot(f)
+}
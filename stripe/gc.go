@@ -0,0 +1,80 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stripe
+
+import (
+	"bytes"
+	"hop"
+	"hop/rmt"
+	"regexp"
+	"time"
+)
+
+// Garbage collection statistics
+type GCStats struct {
+	Stripes int // stripes found
+	Removed int // orphaned stripes removed
+	Young   int // orphaned stripes skipped because they are younger than Grace
+	Errors  int // stripes that couldn't be removed
+}
+
+// Removes the stripes that don't belong to the current version of their
+// object: the ones left behind by failed or conflicting writes, and by
+// replaced and removed objects. The stripes of generations younger than
+// Grace are kept, they may belong to a write in progress.
+func (s *Store) GC() (st *GCStats, err error) {
+	ver, val, err := s.h.Get("#/keys:^"+regexp.QuoteMeta(s.prefix+"s/"), hop.Any)
+	if err != nil {
+		return
+	}
+
+	st = new(GCStats)
+	if ver == 0 || len(val) == 0 {
+		return
+	}
+
+	now := time.Now()
+	current := make(map[string]string) // current generation of the objects
+	for _, k := range bytes.Split(val, []byte{0}) {
+		key := string(k)
+		name, gen, ok := s.parseStripeKey(key)
+		if !ok {
+			continue
+		}
+
+		st.Stripes++
+		cgen, ok := current[name]
+		if !ok {
+			m, err := s.Stat(name)
+			if err != nil && err != Emanifest {
+				return st, err
+			}
+
+			if m != nil {
+				cgen = m.Gen
+			}
+
+			current[name] = cgen
+		}
+
+		if gen == cgen {
+			continue
+		}
+
+		if t, ok := genTime(gen); ok && now.Sub(t) < s.Grace {
+			st.Young++
+			continue
+		}
+
+		if err := s.h.Remove(key); err != nil && !rmt.IsError(err, hop.Enoent) {
+			st.Errors++
+			continue
+		}
+
+		st.Removed++
+	}
+
+	return
+}
@@ -0,0 +1,198 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stripe
+
+import (
+	"hop"
+	"io"
+	"sync"
+)
+
+// A version of an object opened for reading
+type Object struct {
+	Manifest
+	s    *Store
+	name string
+}
+
+// Opens the current version of the object. The object keeps reading the
+// same version, if it is replaced the reads fail with Ereplaced.
+func (s *Store) Open(name string) (o *Object, err error) {
+	m, err := s.Stat(name)
+	if err != nil {
+		return
+	}
+
+	if m == nil {
+		return nil, hop.Enoent
+	}
+
+	return &Object{*m, s, name}, nil
+}
+
+// Writes the current version of the object to w. Returns its manifest and
+// the number of bytes written.
+func (s *Store) Get(name string, w io.Writer) (m *Manifest, n int64, err error) {
+	o, err := s.Open(name)
+	if err != nil {
+		return
+	}
+
+	n, err = o.WriteTo(w)
+	return &o.Manifest, n, err
+}
+
+func (o *Object) getStripe(idx uint64) (data []byte, err error) {
+	ver, data, err := o.s.h.Get(o.s.stripeKey(o.name, o.Gen, idx), hop.Any)
+	if err != nil {
+		return
+	}
+
+	if ver == 0 || uint64(len(data)) != o.stripeLen(idx) {
+		return nil, Ereplaced
+	}
+
+	return
+}
+
+// Returns the expected size of the stripe
+func (o *Object) stripeLen(idx uint64) uint64 {
+	if off := idx * o.StripeSize; off+o.StripeSize > o.Size {
+		return o.Size - off
+	}
+
+	return o.StripeSize
+}
+
+// Reads len(p) bytes from offset off, the stripes are read in parallel.
+// Implements io.ReaderAt.
+func (o *Object) ReadAt(p []byte, off int64) (n int, err error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	start := uint64(off)
+	if start >= o.Size {
+		return 0, io.EOF
+	}
+
+	end := start + uint64(len(p))
+	if end > o.Size {
+		end = o.Size
+	}
+
+	workers := o.s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ch := make(chan uint64, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range ch {
+				data, e := o.getStripe(idx)
+				if e != nil {
+					lock.Lock()
+					if err == nil {
+						err = e
+					}
+					lock.Unlock()
+					continue
+				}
+
+				// copy the part of the stripe within [start, end)
+				soff := idx * o.StripeSize
+				lo, hi := start, soff+uint64(len(data))
+				if lo < soff {
+					lo = soff
+				}
+
+				if hi > end {
+					hi = end
+				}
+
+				copy(p[lo-start:hi-start], data[lo-soff:hi-soff])
+			}
+		}()
+	}
+
+	for idx := start / o.StripeSize; idx*o.StripeSize < end; idx++ {
+		ch <- idx
+	}
+
+	close(ch)
+	wg.Wait()
+	if err != nil {
+		return 0, err
+	}
+
+	n = int(end - start)
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Writes the object to w. Up to Workers stripes are read ahead in
+// parallel. Implements io.WriterTo.
+func (o *Object) WriteTo(w io.Writer) (n int64, err error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	workers := o.s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	// the results are queued in order, each one is filled by its goroutine
+	nstripes := o.Stripes()
+	queue := make(chan chan result, workers)
+	done := make(chan bool)
+	go func() {
+		defer close(queue)
+		for idx := uint64(0); idx < nstripes; idx++ {
+			rch := make(chan result, 1)
+			select {
+			case queue <- rch:
+			case <-done:
+				return
+			}
+
+			go func(idx uint64) {
+				data, err := o.getStripe(idx)
+				rch <- result{data, err}
+			}(idx)
+		}
+	}()
+
+	for rch := range queue {
+		var m int
+
+		r := <-rch
+		if r.err == nil {
+			m, r.err = w.Write(r.data)
+			n += int64(m)
+		}
+
+		if r.err != nil {
+			close(done)
+			for rch := range queue {
+				<-rch
+			}
+
+			return n, r.err
+		}
+	}
+
+	return
+}
@@ -0,0 +1,386 @@
+// Copyright 2013 The Hop Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package stripe stores large objects in a Hop, usually a D2Hop cluster,
+// split in fixed-size stripes that are spread over the servers.
+//
+// Each version of an object has a generation, a unique string that starts
+// with its creation time. The stripes of a generation are stored in the
+// entries
+//
+//	<prefix>s/<name>/<gen>/<index>
+//
+// and never modified, so they hash to different servers. The object's
+// manifest is stored in the <prefix>m/<name> entry:
+//
+//	gen[s] size[8] stripesize[8] mtime[8]
+//
+// A new version is written to new stripes first, and is published by
+// replacing the manifest with TestSet, so the readers see either the old
+// or the new version. The stripes of the replaced version are removed
+// after the manifest is swapped, so the readers that still read them fail
+// with Ereplaced. The stripes left behind by failed writes or removals are
+// collected by GC.
+package stripe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hop"
+	"hop/rmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultStripeSize = 1024 * 1024
+	DefaultWorkers    = 8
+	DefaultGrace      = time.Hour
+)
+
+// Store of the striped objects
+type Store struct {
+	StripeSize uint64        // size of the stripes of the new objects, must fit in a message
+	Workers    int           // number of stripes read or written in parallel
+	Flags      string        // create flags of the manifests and stripes (e.g. replicas)
+	Grace      time.Duration // GC doesn't remove the stripes younger than that
+
+	h      hop.Hop
+	prefix string
+}
+
+// Manifest of a version of an object
+type Manifest struct {
+	Gen        string // generation, part of the stripe keys
+	Size       uint64 // size of the object
+	StripeSize uint64
+	Mtime      time.Time
+	Version    uint64 // version of the manifest entry
+}
+
+var Econflict = errors.New("object modified concurrently")
+var Ereplaced = errors.New("object replaced or removed")
+var Emanifest = errors.New("invalid manifest")
+
+var genlock sync.Mutex
+var genrand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// Creates a store that keeps the objects in the entries of h with the
+// specified prefix
+func NewStore(h hop.Hop, prefix string) *Store {
+	s := new(Store)
+	s.StripeSize = DefaultStripeSize
+	s.Workers = DefaultWorkers
+	s.Grace = DefaultGrace
+	s.h = h
+	s.prefix = prefix
+	return s
+}
+
+func (s *Store) manifestKey(name string) string {
+	return s.prefix + "m/" + name
+}
+
+func (s *Store) stripeKey(name, gen string, idx uint64) string {
+	return s.prefix + "s/" + name + "/" + gen + "/" + strconv.FormatUint(idx, 10)
+}
+
+// Returns the object name and generation of a stripe key
+func (s *Store) parseStripeKey(key string) (name, gen string, ok bool) {
+	if !strings.HasPrefix(key, s.prefix+"s/") {
+		return
+	}
+
+	key = key[len(s.prefix)+2:]
+	n := strings.LastIndex(key, "/")
+	if n < 0 {
+		return
+	}
+
+	if _, err := strconv.ParseUint(key[n+1:], 10, 64); err != nil {
+		return
+	}
+
+	key = key[0:n]
+	if n = strings.LastIndex(key, "/"); n < 0 {
+		return
+	}
+
+	return key[0:n], key[n+1:], true
+}
+
+func newGen(now time.Time) string {
+	genlock.Lock()
+	r := genrand.Uint32()
+	genlock.Unlock()
+
+	return fmt.Sprintf("%016x%08x", now.UnixNano(), r)
+}
+
+// Returns the creation time of the generation
+func genTime(gen string) (t time.Time, ok bool) {
+	if len(gen) < 16 {
+		return
+	}
+
+	ns, err := strconv.ParseUint(gen[0:16], 16, 64)
+	if err != nil {
+		return
+	}
+
+	return time.Unix(0, int64(ns)), true
+}
+
+func (m *Manifest) pack() []byte {
+	buf := make([]byte, 2+len(m.Gen)+8+8+8)
+	p := hop.Pstr(m.Gen, buf)
+	p = hop.Pint64(m.Size, p)
+	p = hop.Pint64(m.StripeSize, p)
+	hop.Pint64(uint64(m.Mtime.UnixNano()), p)
+	return buf
+}
+
+func unpackManifest(ver uint64, buf []byte) (m *Manifest, err error) {
+	var mtime uint64
+
+	if len(buf) < 2+8+8+8 {
+		return nil, Emanifest
+	}
+
+	m = new(Manifest)
+	m.Version = ver
+	m.Gen, buf = hop.Gstr(buf)
+	if buf == nil || len(buf) != 8+8+8 {
+		return nil, Emanifest
+	}
+
+	m.Size, buf = hop.Gint64(buf)
+	m.StripeSize, buf = hop.Gint64(buf)
+	mtime, buf = hop.Gint64(buf)
+	m.Mtime = time.Unix(0, int64(mtime))
+	if m.StripeSize == 0 && m.Size != 0 {
+		return nil, Emanifest
+	}
+
+	return
+}
+
+// Returns the number of stripes of the object
+func (m *Manifest) Stripes() uint64 {
+	if m.Size == 0 {
+		return 0
+	}
+
+	return (m.Size + m.StripeSize - 1) / m.StripeSize
+}
+
+// Returns the manifest of the current version of the object, nil if it
+// doesn't exist
+func (s *Store) Stat(name string) (m *Manifest, err error) {
+	ver, val, err := s.h.Get(s.manifestKey(name), hop.Any)
+	if err != nil || ver == 0 {
+		return nil, err
+	}
+
+	return unpackManifest(ver, val)
+}
+
+// Stores the content of r as a new version of the object. The stripes are
+// written in parallel, and the new version is published after all of them
+// are stored. If the object is replaced by someone else in the meantime,
+// returns Econflict and the new version is discarded.
+func (s *Store) Put(name string, r io.Reader) (m *Manifest, err error) {
+	if s.StripeSize == 0 {
+		return nil, errors.New("invalid stripe size")
+	}
+
+	// the version we are replacing
+	ver, oldval, err := s.h.Get(s.manifestKey(name), hop.Any)
+	if err != nil {
+		return
+	}
+
+	m = new(Manifest)
+	m.Mtime = time.Now()
+	m.Gen = newGen(m.Mtime)
+	m.StripeSize = s.StripeSize
+	if m.Size, err = s.writeStripes(name, m, r); err != nil {
+		s.removeStripes(name, m)
+		return nil, err
+	}
+
+	if err = s.publish(name, m, ver, oldval); err != nil {
+		s.removeStripes(name, m)
+		return nil, err
+	}
+
+	if ver != 0 {
+		if old, err := unpackManifest(ver, oldval); err == nil {
+			s.removeStripes(name, old)
+		}
+	}
+
+	return m, nil
+}
+
+type stripe struct {
+	idx  uint64
+	data []byte
+}
+
+// Reads r in stripes and creates them in parallel. Returns the size of the
+// object.
+func (s *Store) writeStripes(name string, m *Manifest, r io.Reader) (size uint64, err error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	ch := make(chan *stripe, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for st := range ch {
+				lock.Lock()
+				failed := err != nil
+				lock.Unlock()
+				if failed {
+					continue
+				}
+
+				_, e := s.h.Create(s.stripeKey(name, m.Gen, st.idx), s.Flags, st.data)
+				if e != nil {
+					lock.Lock()
+					if err == nil {
+						err = e
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+
+	var rerr error
+	for idx := uint64(0); ; idx++ {
+		buf := make([]byte, m.StripeSize)
+		n, e := io.ReadFull(r, buf)
+		if n > 0 {
+			ch <- &stripe{idx, buf[0:n]}
+			size += uint64(n)
+		}
+
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		} else if e != nil {
+			rerr = e
+			break
+		}
+
+		lock.Lock()
+		failed := err != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+	}
+
+	close(ch)
+	wg.Wait()
+	if err == nil {
+		err = rerr
+	}
+
+	return
+}
+
+// Replaces the manifest with version ver and value oldval (or creates it if
+// ver is zero) with m
+func (s *Store) publish(name string, m *Manifest, ver uint64, oldval []byte) (err error) {
+	mkey := s.manifestKey(name)
+	val := m.pack()
+	if ver == 0 {
+		m.Version, err = s.h.Create(mkey, s.Flags, val)
+		if rmt.IsError(err, hop.Eexist) {
+			err = Econflict
+		}
+
+		return
+	}
+
+	// Not all Hops report the failed TestSet the same way, check if the
+	// manifest is ours.
+	if _, _, err = s.h.TestSet(mkey, ver, oldval, val); err != nil {
+		return
+	}
+
+	nver, nval, err := s.h.Get(mkey, hop.Any)
+	if err != nil {
+		return
+	}
+
+	if nver == 0 || !bytes.Equal(nval, val) {
+		return Econflict
+	}
+
+	m.Version = nver
+	return
+}
+
+// Removes the object and its stripes
+func (s *Store) Remove(name string) (err error) {
+	m, err := s.Stat(name)
+	if err != nil {
+		return
+	}
+
+	if m == nil {
+		return hop.Enoent
+	}
+
+	if err = s.h.Remove(s.manifestKey(name)); err != nil {
+		return
+	}
+
+	s.removeStripes(name, m)
+	return
+}
+
+// Removes the stripes of the object version, ignoring the errors. The
+// stripes that are not removed are collected by GC.
+func (s *Store) removeStripes(name string, m *Manifest) {
+	var wg sync.WaitGroup
+
+	workers := s.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	n := m.Stripes()
+	ch := make(chan uint64, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range ch {
+				s.h.Remove(s.stripeKey(name, m.Gen, idx))
+			}
+		}()
+	}
+
+	for idx := uint64(0); idx < n; idx++ {
+		ch <- idx
+	}
+
+	close(ch)
+	wg.Wait()
+}